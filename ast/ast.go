@@ -4,10 +4,30 @@ import (
 	"coolz-compiler/lexer"
 )
 
+// Node is any node of the syntax tree. Pos and End delimit the source it
+// was parsed from: the position of its first character and the position
+// just past its last one. Parentheses around an expression are not part
+// of it.
 type Node interface {
 	TokenLiteral() string
+	Pos() lexer.Position
+	End() lexer.Position
+	syntax() *Syntax
 }
 
+// Syntax is embedded in every node. When the program was lexed in trivia
+// mode, Tokens holds the tokens of the node that none of its children
+// holds, such as its keywords, its punctuation and the parentheses around
+// a child, with their trivia. They are grouped by the gaps between the
+// children listed by Children: Tokens[i] precede the i-th child and the
+// last group follows the last child. The program also holds its EOF token
+// and the tokens a syntax error left out of the tree.
+type Syntax struct {
+	Tokens [][]lexer.Token
+}
+
+func (s *Syntax) syntax() *Syntax { return s }
+
 type Statement interface {
 	Node
 	statementNode()
@@ -18,78 +38,148 @@ type Expression interface {
 	expressionNode()
 }
 
+// TypeTable maps expressions to the static type inferred for them by the
+// semantic analyser.
+type TypeTable map[Expression]string
+
 type Feature interface {
 	Node
 	featureNode()
 }
 
 type TypeIdentifier struct {
+	Syntax
 	Token lexer.Token
 	Value string
 }
 
 func (ti *TypeIdentifier) TokenLiteral() string { return ti.Token.Literal }
+func (ti *TypeIdentifier) Pos() lexer.Position  { return ti.Token.Pos() }
+func (ti *TypeIdentifier) End() lexer.Position  { return ti.Token.End() }
 
 type ObjectIdentifier struct {
+	Syntax
 	Token lexer.Token
 	Value string
 }
 
 func (oi *ObjectIdentifier) TokenLiteral() string { return oi.Token.Literal }
+func (oi *ObjectIdentifier) Pos() lexer.Position  { return oi.Token.Pos() }
+func (oi *ObjectIdentifier) End() lexer.Position  { return oi.Token.End() }
 func (oi *ObjectIdentifier) expressionNode()      {}
 
 type Program struct {
+	Syntax
+	Token   lexer.Token // The first token of the file, EOF if it is empty.
+	Imports []*Import
 	Classes []*Class
+	EOF     lexer.Token // The end of the file.
 }
 
 func (p *Program) TokenLiteral() string { return "" }
+func (p *Program) Pos() lexer.Position  { return p.Token.Pos() }
+func (p *Program) End() lexer.Position  { return p.EOF.Pos() }
+
+// Import represents an `import module;`, `import module as Alias;` or
+// `from module import A, B;` declaration. Imports are resolved by the
+// module loader and do not reach the later phases.
+type Import struct {
+	Syntax
+	Token  lexer.Token       // The 'import' or 'from' token.
+	Module *ObjectIdentifier // The name of the imported module.
+	Alias  *TypeIdentifier   // The qualifier for the module's classes, if any.
+	Names  []*TypeIdentifier // The classes named by a from import.
+}
+
+func (i *Import) TokenLiteral() string { return i.Token.Literal }
+func (i *Import) Pos() lexer.Position  { return i.Token.Pos() }
+func (i *Import) End() lexer.Position {
+	switch {
+	case len(i.Names) > 0:
+		return i.Names[len(i.Names)-1].End()
+	case i.Alias != nil:
+		return i.Alias.End()
+	case i.Module != nil:
+		return i.Module.End()
+	}
+	return i.Token.End()
+}
 
 type Class struct {
-	Token    lexer.Token
+	Syntax
+	Token    lexer.Token // The 'class' token.
 	Name     *TypeIdentifier
 	Parent   *TypeIdentifier
 	Features []Feature
+	RBrace   lexer.Token // The closing '}'.
+	External bool        // Declared by a module interface: signatures only, no bodies
+	Declared string      // Name as written in the source, set when imports qualify Name
 }
 
 func (c *Class) TokenLiteral() string { return c.Token.Literal }
+func (c *Class) Pos() lexer.Position  { return c.Token.Pos() }
+func (c *Class) End() lexer.Position  { return c.RBrace.End() }
+
+// DeclaredName returns the name the class was declared with. Name holds the
+// qualified name once imports are resolved, e.g. collections.list.Cons for
+// Cons.
+func (c *Class) DeclaredName() string {
+	if c.Declared != "" {
+		return c.Declared
+	}
+	return c.Name.Value
+}
 
 type Formal struct {
-	Token lexer.Token // Add this field
+	Syntax
+	Token lexer.Token // The name token.
 	Name  *ObjectIdentifier
 	Type  *TypeIdentifier
 }
 
 func (f *Formal) TokenLiteral() string { return f.Name.Value }
+func (f *Formal) Pos() lexer.Position  { return f.Token.Pos() }
+func (f *Formal) End() lexer.Position  { return typeEnd(f.Type, f.Token) }
 
 // IntegerLiteral represents an integer literal in the AST.
 type IntegerLiteral struct {
+	Syntax
 	Token lexer.Token // The token representing the integer literal.
 	Value int64       // The actual value of the integer literal.
 }
 
 func (il *IntegerLiteral) expressionNode()      {}
 func (il *IntegerLiteral) TokenLiteral() string { return il.Token.Literal }
+func (il *IntegerLiteral) Pos() lexer.Position  { return il.Token.Pos() }
+func (il *IntegerLiteral) End() lexer.Position  { return il.Token.End() }
 
 // StringLiteral represents a string literal in the AST.
 type StringLiteral struct {
+	Syntax
 	Token lexer.Token // The token representing the string literal.
 	Value string      // The actual value of the string literal.
 }
 
 func (sl *StringLiteral) expressionNode()      {}
 func (sl *StringLiteral) TokenLiteral() string { return sl.Token.Literal }
+func (sl *StringLiteral) Pos() lexer.Position  { return sl.Token.Pos() }
+func (sl *StringLiteral) End() lexer.Position  { return sl.Token.End() }
 
 // BooleanLiteral represents a boolean literal in the AST.
 type BooleanLiteral struct {
+	Syntax
 	Token lexer.Token // The token representing the boolean literal.
 	Value bool        // The actual value of the boolean literal.
 }
 
 func (bl *BooleanLiteral) expressionNode()      {}
 func (bl *BooleanLiteral) TokenLiteral() string { return bl.Token.Literal }
+func (bl *BooleanLiteral) Pos() lexer.Position  { return bl.Token.Pos() }
+func (bl *BooleanLiteral) End() lexer.Position  { return bl.Token.End() }
 
 // UnaryExpression represents a unary operation in the AST.
 type UnaryExpression struct {
+	Syntax
 	Token    lexer.Token // The operator token, e.g., 'not', '~', 'isvoid'.
 	Operator string      // The operator as a string.
 	Right    Expression  // The right-hand side expression.
@@ -97,9 +187,12 @@ type UnaryExpression struct {
 
 func (ue *UnaryExpression) expressionNode()      {}
 func (ue *UnaryExpression) TokenLiteral() string { return ue.Token.Literal }
+func (ue *UnaryExpression) Pos() lexer.Position  { return ue.Token.Pos() }
+func (ue *UnaryExpression) End() lexer.Position  { return endOf(ue.Right, ue.Token) }
 
 // BinaryExpression represents a binary operation in the AST.
 type BinaryExpression struct {
+	Syntax
 	Token    lexer.Token // The operator token, e.g., '+', '-', '*', '/'.
 	Operator string      // The operator as a string.
 	Left     Expression  // The left-hand side expression.
@@ -108,39 +201,54 @@ type BinaryExpression struct {
 
 func (be *BinaryExpression) expressionNode()      {}
 func (be *BinaryExpression) TokenLiteral() string { return be.Token.Literal }
+func (be *BinaryExpression) Pos() lexer.Position  { return posOf(be.Left, be.Token) }
+func (be *BinaryExpression) End() lexer.Position  { return endOf(be.Right, be.Token) }
 
 // IfExpression represents an if-else expression in the AST.
 type IfExpression struct {
+	Syntax
 	Token       lexer.Token // The 'if' token.
 	Condition   Expression  // The condition expression.
 	Consequence Expression  // The consequence expression (then branch).
 	Alternative Expression  // The alternative expression (else branch).
+	Fi          lexer.Token // The closing 'fi' token.
 }
 
 func (ie *IfExpression) expressionNode()      {}
 func (ie *IfExpression) TokenLiteral() string { return ie.Token.Literal }
+func (ie *IfExpression) Pos() lexer.Position  { return ie.Token.Pos() }
+func (ie *IfExpression) End() lexer.Position  { return ie.Fi.End() }
 
 // WhileExpression represents a while loop in the AST.
 type WhileExpression struct {
+	Syntax
 	Token     lexer.Token // The 'while' token.
 	Condition Expression  // The condition expression.
 	Body      Expression  // The body expression.
+	Pool      lexer.Token // The closing 'pool' token.
 }
 
 func (we *WhileExpression) expressionNode()      {}
 func (we *WhileExpression) TokenLiteral() string { return we.Token.Literal }
+func (we *WhileExpression) Pos() lexer.Position  { return we.Token.Pos() }
+func (we *WhileExpression) End() lexer.Position  { return we.Pool.End() }
 
 // BlockExpression represents a block of expressions in the AST.
 type BlockExpression struct {
+	Syntax
 	Token       lexer.Token  // The '{' token.
 	Expressions []Expression // The list of expressions within the block.
+	RBrace      lexer.Token  // The closing '}' token.
 }
 
 func (be *BlockExpression) expressionNode()      {}
 func (be *BlockExpression) TokenLiteral() string { return be.Token.Literal }
+func (be *BlockExpression) Pos() lexer.Position  { return be.Token.Pos() }
+func (be *BlockExpression) End() lexer.Position  { return be.RBrace.End() }
 
 // LetExpression represents a let expression in the AST.
 type LetExpression struct {
+	Syntax
 	Token    lexer.Token   // The 'let' token.
 	Bindings []*LetBinding // The list of bindings (variable declarations).
 	In       Expression    // The expression that follows the bindings.
@@ -148,51 +256,80 @@ type LetExpression struct {
 
 func (le *LetExpression) expressionNode()      {}
 func (le *LetExpression) TokenLiteral() string { return le.Token.Literal }
+func (le *LetExpression) Pos() lexer.Position  { return le.Token.Pos() }
+func (le *LetExpression) End() lexer.Position  { return endOf(le.In, le.Token) }
 
 // LetBinding represents a single binding in a let expression.
 type LetBinding struct {
+	Syntax
+	Token      lexer.Token       // The identifier token.
 	Identifier *ObjectIdentifier // The identifier of the binding.
 	Type       *TypeIdentifier   // The type of the binding.
 	Init       Expression        // The initialization expression, if any.
 }
 
+func (lb *LetBinding) TokenLiteral() string { return lb.Token.Literal }
+func (lb *LetBinding) Pos() lexer.Position  { return lb.Token.Pos() }
+func (lb *LetBinding) End() lexer.Position {
+	if lb.Init != nil {
+		return lb.Init.End()
+	}
+	return typeEnd(lb.Type, lb.Token)
+}
+
 // NewExpression represents the 'new' type expression in the AST.
 type NewExpression struct {
+	Syntax
 	Token lexer.Token     // The 'new' token.
 	Type  *TypeIdentifier // The type to be instantiated.
 }
 
 func (ne *NewExpression) expressionNode()      {}
 func (ne *NewExpression) TokenLiteral() string { return ne.Token.Literal }
+func (ne *NewExpression) Pos() lexer.Position  { return ne.Token.Pos() }
+func (ne *NewExpression) End() lexer.Position  { return typeEnd(ne.Type, ne.Token) }
 
 // IsVoidExpression represents an 'isvoid' expression in the AST.
 type IsVoidExpression struct {
+	Syntax
 	Token      lexer.Token // The 'isvoid' token.
 	Expression Expression  // The expression to check for being void.
 }
 
 func (ive *IsVoidExpression) expressionNode()      {}
 func (ive *IsVoidExpression) TokenLiteral() string { return ive.Token.Literal }
+func (ive *IsVoidExpression) Pos() lexer.Position  { return ive.Token.Pos() }
+func (ive *IsVoidExpression) End() lexer.Position  { return endOf(ive.Expression, ive.Token) }
 
 // Add CaseExpression and CaseBranch
 type CaseExpression struct {
+	Syntax
 	Token    lexer.Token // 'case' token
 	Expr     Expression  // Expression to evaluate
 	Branches []*CaseBranch
+	Esac     lexer.Token // The closing 'esac' token
 }
 
 func (ce *CaseExpression) expressionNode()      {}
 func (ce *CaseExpression) TokenLiteral() string { return ce.Token.Literal }
+func (ce *CaseExpression) Pos() lexer.Position  { return ce.Token.Pos() }
+func (ce *CaseExpression) End() lexer.Position  { return ce.Esac.End() }
 
 type CaseBranch struct {
+	Syntax
 	Token      lexer.Token // Identifier token
 	Identifier *ObjectIdentifier
 	Type       *TypeIdentifier
 	Expr       Expression
 }
 
+func (cb *CaseBranch) TokenLiteral() string { return cb.Token.Literal }
+func (cb *CaseBranch) Pos() lexer.Position  { return cb.Token.Pos() }
+func (cb *CaseBranch) End() lexer.Position  { return endOf(cb.Expr, cb.Token) }
+
 // Add Assignment expression
 type Assignment struct {
+	Syntax
 	Token lexer.Token // The := token
 	Left  Expression  // Should be an ObjectIdentifier
 	Value Expression
@@ -200,67 +337,123 @@ type Assignment struct {
 
 func (a *Assignment) expressionNode()      {}
 func (a *Assignment) TokenLiteral() string { return a.Token.Literal }
+func (a *Assignment) Pos() lexer.Position  { return posOf(a.Left, a.Token) }
+func (a *Assignment) End() lexer.Position  { return endOf(a.Value, a.Token) }
 
 // Add Dispatch expressions
 type DynamicDispatch struct {
+	Syntax
 	Token     lexer.Token // . token
 	Object    Expression  // Left side of dispatch
 	Method    *ObjectIdentifier
 	Arguments []Expression
+	RParen    lexer.Token // The closing ')' token
 }
 
 func (dd *DynamicDispatch) expressionNode()      {}
 func (dd *DynamicDispatch) TokenLiteral() string { return dd.Token.Literal }
+func (dd *DynamicDispatch) Pos() lexer.Position  { return posOf(dd.Object, dd.Token) }
+func (dd *DynamicDispatch) End() lexer.Position  { return dd.RParen.End() }
 
 type StaticDispatch struct {
+	Syntax
 	Token     lexer.Token // @ token
 	Object    Expression
 	Type      *TypeIdentifier
 	Method    *ObjectIdentifier
 	Arguments []Expression
+	RParen    lexer.Token // The closing ')' token
 }
 
 func (sd *StaticDispatch) expressionNode()      {}
 func (sd *StaticDispatch) TokenLiteral() string { return sd.Token.Literal }
+func (sd *StaticDispatch) Pos() lexer.Position  { return posOf(sd.Object, sd.Token) }
+func (sd *StaticDispatch) End() lexer.Position  { return sd.RParen.End() }
 
 // Add Self expression
 type Self struct {
+	Syntax
 	Token lexer.Token // 'self' keyword
 }
 
 func (s *Self) expressionNode()      {}
 func (s *Self) TokenLiteral() string { return s.Token.Literal }
+func (s *Self) Pos() lexer.Position  { return s.Token.Pos() }
+func (s *Self) End() lexer.Position  { return s.Token.End() }
 
 // Add Void literal
 type VoidLiteral struct {
+	Syntax
 	Token lexer.Token // 'void' keyword
 }
 
 func (vl *VoidLiteral) expressionNode()      {}
 func (vl *VoidLiteral) TokenLiteral() string { return vl.Token.Literal }
+func (vl *VoidLiteral) Pos() lexer.Position  { return vl.Token.Pos() }
+func (vl *VoidLiteral) End() lexer.Position  { return vl.Token.End() }
 
 // Modified Method struct to include body
 type Method struct {
+	Syntax
+	Token   lexer.Token // The name token.
 	Name    *ObjectIdentifier
 	Type    *TypeIdentifier
 	Formals []*Formal
-	Body    Expression // Added body expression
+	Body    Expression  // Added body expression
+	RBrace  lexer.Token // The '}' closing the body.
 }
 
 func (m *Method) TokenLiteral() string { return m.Name.Value }
+func (m *Method) Pos() lexer.Position  { return m.Token.Pos() }
+func (m *Method) End() lexer.Position  { return m.RBrace.End() }
 func (m *Method) featureNode()         {}
 
 // Modified Attribute struct to include initialization
 type Attribute struct {
-	Name *ObjectIdentifier
-	Type *TypeIdentifier
-	Init Expression // Added initialization expression (optional)
+	Syntax
+	Token lexer.Token // The name token.
+	Name  *ObjectIdentifier
+	Type  *TypeIdentifier
+	Init  Expression // Added initialization expression (optional)
 }
 
 func (a *Attribute) TokenLiteral() string { return a.Name.Value }
-func (a *Attribute) featureNode()         {}
+func (a *Attribute) Pos() lexer.Position  { return a.Token.Pos() }
+func (a *Attribute) End() lexer.Position {
+	if a.Init != nil {
+		return a.Init.End()
+	}
+	return typeEnd(a.Type, a.Token)
+}
+func (a *Attribute) featureNode() {}
 
 // Add helper for SELF_TYPE handling
 func IsSELF_TYPE(t *TypeIdentifier) bool {
 	return t.Value == "SELF_TYPE"
 }
+
+// posOf returns where node starts, or where tok does if node is missing
+// because it failed to parse.
+func posOf(node Node, tok lexer.Token) lexer.Position {
+	if node == nil {
+		return tok.Pos()
+	}
+	return node.Pos()
+}
+
+// endOf returns where node ends, or where tok does if node is missing.
+func endOf(node Node, tok lexer.Token) lexer.Position {
+	if node == nil {
+		return tok.End()
+	}
+	return node.End()
+}
+
+// typeEnd is endOf for a type, which is a nil pointer rather than a nil
+// interface when it is missing.
+func typeEnd(t *TypeIdentifier, tok lexer.Token) lexer.Position {
+	if t == nil {
+		return tok.End()
+	}
+	return t.End()
+}
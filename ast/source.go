@@ -0,0 +1,237 @@
+package ast
+
+import (
+	"coolz-compiler/lexer"
+	"errors"
+	"io"
+	"strings"
+)
+
+// Print writes the program by walking its nodes and writing their tokens
+// with the comments and whitespace around them. For a program as it was
+// parsed, this is exactly the input. The program must have been parsed
+// from a lexer in trivia mode.
+func (p *Program) Print(w io.Writer) error {
+	if len(p.Tokens) == 0 {
+		return errors.New("no trivia: the program was not parsed from a lexer in trivia mode")
+	}
+	var sb strings.Builder
+	for _, tok := range tokensOf(p) {
+		writeTrivia(&sb, tok.Leading)
+		sb.WriteString(tok.Text)
+		writeTrivia(&sb, tok.Trailing)
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// Source returns the source text of node, a node of the program, with the
+// comments and whitespace between its tokens but not those around it. The
+// program must have been parsed from a lexer in trivia mode.
+func (p *Program) Source(node Node) string {
+	var tokens []lexer.Token
+	for _, tok := range tokensOf(node) {
+		if tok.Type != lexer.EOF {
+			tokens = append(tokens, tok)
+		}
+	}
+
+	var sb strings.Builder
+	for i, tok := range tokens {
+		if i > 0 {
+			writeTrivia(&sb, tokens[i-1].Trailing)
+			writeTrivia(&sb, tok.Leading)
+		}
+		sb.WriteString(tok.Text)
+	}
+	return sb.String()
+}
+
+// AttachTokens stores tokens, every token of the program's source in
+// order, on the nodes of the program: each token goes to the innermost
+// node whose source it is part of, see Syntax. The parser calls it when
+// the lexer keeps trivia.
+func (p *Program) AttachTokens(tokens []lexer.Token) {
+	var eof []lexer.Token
+	var rest []lexer.Token
+	for _, tok := range tokens {
+		if tok.Type == lexer.EOF {
+			eof = append(eof, tok)
+		} else {
+			rest = append(rest, tok)
+		}
+	}
+	attach(p, rest)
+	last := len(p.Tokens) - 1
+	p.Tokens[last] = append(p.Tokens[last], eof...)
+}
+
+// attach hands each of tokens to the first child of node whose source it
+// is part of, recursively, and keeps the others as node's own, in the gap
+// after the children that start before them.
+func attach(node Node, tokens []lexer.Token) {
+	children := Children(node)
+	owned := make([][]lexer.Token, len(children))
+	own := make([][]lexer.Token, len(children)+1)
+	for _, tok := range tokens {
+		gap := 0
+		for i, child := range children {
+			if tok.Offset >= child.Pos().Offset && tok.EndOffset <= child.End().Offset {
+				owned[i] = append(owned[i], tok)
+				gap = -1
+				break
+			}
+			if child.Pos().Offset <= tok.Offset {
+				gap = i + 1
+			}
+		}
+		if gap >= 0 {
+			own[gap] = append(own[gap], tok)
+		}
+	}
+	node.syntax().Tokens = own
+	for i, child := range children {
+		attach(child, owned[i])
+	}
+}
+
+// tokensOf returns the tokens of node and its descendants in the order
+// they are printed: each child goes in its gap among the tokens of node.
+func tokensOf(node Node) []lexer.Token {
+	var tokens []lexer.Token
+	gaps := node.syntax().Tokens
+	children := Children(node)
+	for i, child := range children {
+		if i < len(gaps) {
+			tokens = append(tokens, gaps[i]...)
+		}
+		tokens = append(tokens, tokensOf(child)...)
+	}
+	for i := len(children); i < len(gaps); i++ {
+		tokens = append(tokens, gaps[i]...)
+	}
+	return tokens
+}
+
+// Tokens returns the tokens node holds itself, see Syntax.
+func Tokens(node Node) [][]lexer.Token {
+	return node.syntax().Tokens
+}
+
+// Children returns the child nodes of node in source order, leaving out
+// those that are missing because they failed to parse.
+func Children(node Node) []Node {
+	var children []Node
+	expr := func(e Expression) {
+		if e != nil {
+			children = append(children, e)
+		}
+	}
+	object := func(oi *ObjectIdentifier) {
+		if oi != nil {
+			children = append(children, oi)
+		}
+	}
+	typ := func(ti *TypeIdentifier) {
+		if ti != nil {
+			children = append(children, ti)
+		}
+	}
+
+	switch n := node.(type) {
+	case *Program:
+		for _, imp := range n.Imports {
+			children = append(children, imp)
+		}
+		for _, class := range n.Classes {
+			children = append(children, class)
+		}
+	case *Import:
+		object(n.Module)
+		typ(n.Alias)
+		for _, name := range n.Names {
+			typ(name)
+		}
+	case *Class:
+		typ(n.Name)
+		typ(n.Parent)
+		for _, feature := range n.Features {
+			children = append(children, feature)
+		}
+	case *Method:
+		object(n.Name)
+		for _, formal := range n.Formals {
+			children = append(children, formal)
+		}
+		typ(n.Type)
+		expr(n.Body)
+	case *Attribute:
+		object(n.Name)
+		typ(n.Type)
+		expr(n.Init)
+	case *Formal:
+		object(n.Name)
+		typ(n.Type)
+	case *UnaryExpression:
+		expr(n.Right)
+	case *BinaryExpression:
+		expr(n.Left)
+		expr(n.Right)
+	case *IfExpression:
+		expr(n.Condition)
+		expr(n.Consequence)
+		expr(n.Alternative)
+	case *WhileExpression:
+		expr(n.Condition)
+		expr(n.Body)
+	case *BlockExpression:
+		for _, e := range n.Expressions {
+			expr(e)
+		}
+	case *LetExpression:
+		for _, binding := range n.Bindings {
+			children = append(children, binding)
+		}
+		expr(n.In)
+	case *LetBinding:
+		object(n.Identifier)
+		typ(n.Type)
+		expr(n.Init)
+	case *NewExpression:
+		typ(n.Type)
+	case *IsVoidExpression:
+		expr(n.Expression)
+	case *CaseExpression:
+		expr(n.Expr)
+		for _, branch := range n.Branches {
+			children = append(children, branch)
+		}
+	case *CaseBranch:
+		object(n.Identifier)
+		typ(n.Type)
+		expr(n.Expr)
+	case *Assignment:
+		expr(n.Left)
+		expr(n.Value)
+	case *DynamicDispatch:
+		expr(n.Object)
+		object(n.Method)
+		for _, arg := range n.Arguments {
+			expr(arg)
+		}
+	case *StaticDispatch:
+		expr(n.Object)
+		typ(n.Type)
+		object(n.Method)
+		for _, arg := range n.Arguments {
+			expr(arg)
+		}
+	}
+	return children
+}
+
+func writeTrivia(sb *strings.Builder, trivia []lexer.Trivia) {
+	for _, t := range trivia {
+		sb.WriteString(t.Text)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"coolz-compiler/diagnostic"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// clangEnv names the environment variable that overrides clang discovery.
+const clangEnv = "COOLZ_CLANG"
+
+// clangError carries whatever clang wrote to stderr when it failed.
+type clangError struct {
+	err    error
+	stderr string
+}
+
+func (e *clangError) Error() string {
+	if e.stderr == "" {
+		return fmt.Sprintf("clang: %v", e.err)
+	}
+	return fmt.Sprintf("clang: %v\n%s", e.err, e.stderr)
+}
+
+// diagnostics returns clang's output one diagnostic per line, falling back
+// to the exit status when clang printed nothing.
+func (e *clangError) diagnostics() []*diagnostic.Diagnostic {
+	diags := diagnostic.Lines(diagnostic.Error, diagnostic.CodeLink, e.stderr)
+	if len(diags) == 0 {
+		diags = append(diags, diagnostic.New(diagnostic.CodeLink, "", "clang: %v", e.err))
+	}
+	return diags
+}
+
+// findClang resolves the clang executable: an explicit -clang flag wins,
+// then $COOLZ_CLANG, then clang on PATH.
+func findClang(override string) (string, error) {
+	if override == "" {
+		override = os.Getenv(clangEnv)
+	}
+	if override != "" {
+		path, err := exec.LookPath(override)
+		if err != nil {
+			return "", fmt.Errorf("clang %q not usable: %v", override, err)
+		}
+		return path, nil
+	}
+	path, err := exec.LookPath("clang")
+	if err != nil {
+		return "", fmt.Errorf("clang not found on PATH; install it, set %s or pass -clang", clangEnv)
+	}
+	return path, nil
+}
+
+// validOptLevel reports whether level is one clang accepts after -O.
+func validOptLevel(level string) bool {
+	switch level {
+	case "0", "1", "2", "3", "s", "z":
+		return true
+	}
+	return false
+}
+
+// valueFlags are the driver flags that take a value, which may be the next
+// argument.
+var valueFlags = map[string]bool{
+	"o": true, "I": true, "clang": true, "cache": true, "emit": true, "color": true, "diagnostics": true,
+}
+
+// normalizeFlags rewrites the compiler-style -O2 and -Idir into -O=2 and
+// -I=dir so that fs can parse them. A bare -O means -O2, as it does for
+// clang, unless it is followed by a level. -O is left alone when fs does
+// not define it, so that it is reported as an unknown flag. Rewriting stops
+// at the input file so that arguments meant for the compiled program are
+// passed through untouched.
+func normalizeFlags(fs *flag.FlagSet, args []string) []string {
+	optFlag := fs.Lookup("O") != nil
+	out := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-" || arg == "--" || !strings.HasPrefix(arg, "-"):
+			return append(out, args[i:]...)
+		case optFlag && arg == "-O" && i+1 < len(args) && validOptLevel(args[i+1]):
+			out = append(out, "-O="+args[i+1])
+			i++
+		case optFlag && arg == "-O":
+			out = append(out, "-O=2")
+		case optFlag && strings.HasPrefix(arg, "-O") && !strings.HasPrefix(arg, "-O="):
+			out = append(out, "-O="+arg[2:])
+		case strings.HasPrefix(arg, "-I") && len(arg) > 2 && arg[2] != '=':
+			out = append(out, "-I="+arg[2:])
+		case valueFlags[strings.TrimLeft(arg, "-")] && i+1 < len(args):
+			out = append(out, arg, args[i+1])
+			i++
+		default:
+			out = append(out, arg)
+		}
+	}
+	return out
+}
+
+// splitCommand finds the subcommand in args, which may follow options such
+// as -v. It returns the subcommand, or "" for the default mode, and the
+// arguments for that mode with the options in front.
+func splitCommand(args []string) (string, []string) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "build" || arg == "run":
+			rest := append([]string{}, args[:i]...)
+			return arg, append(rest, args[i+1:]...)
+		case arg == "-" || arg == "--" || !strings.HasPrefix(arg, "-"):
+			return "", args
+		case arg == "-O" && i+1 < len(args) && validOptLevel(args[i+1]):
+			i++
+		case valueFlags[strings.TrimLeft(arg, "-")] && i+1 < len(args):
+			i++
+		}
+	}
+	return "", args
+}
+
+// defaultExecutableName derives the executable name from the input file,
+// so prog.cl builds prog (or prog.exe on Windows). Source read from stdin
+// builds a.out (or a.exe).
+func defaultExecutableName(input string) string {
+	name := strings.TrimSuffix(filepath.Base(input), filepath.Ext(input))
+	if input == "-" {
+		if runtime.GOOS == "windows" {
+			return "a.exe"
+		}
+		return "a.out"
+	}
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+// clangArgs returns the command line that compiles irFiles into output.
+// The runtime lives in every module and only needs the C library, which
+// MSVC splits across extra import libraries on Windows.
+func clangArgs(irFiles []string, output, optLevel string) []string {
+	args := append([]string{"-O" + optLevel, "-Wno-override-module", "-o", output}, irFiles...)
+	if runtime.GOOS == "windows" {
+		args = append(args, "-llegacy_stdio_definitions")
+	}
+	return args
+}
+
+// buildExecutable compiles the LLVM IR files and links them into output
+// with clang. Anything clang printed on success (warnings) is returned so
+// the driver can report it.
+func buildExecutable(clang string, irFiles []string, output, optLevel string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(clang, clangArgs(irFiles, output, optLevel)...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", &clangError{err: err, stderr: stderr.String()}
+	}
+	return stderr.String(), nil
+}
+
+// cacheEnv names the environment variable that overrides where compiled
+// modules are cached.
+const cacheEnv = "COOLZ_CACHE"
+
+// cacheDir resolves the module cache: an explicit -cache flag wins, then
+// $COOLZ_CACHE, then coolz in the user's cache directory.
+func cacheDir(override string) (string, error) {
+	if override == "" {
+		override = os.Getenv(cacheEnv)
+	}
+	if override != "" {
+		return override, nil
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("no cache directory: %v; set %s or pass -cache", err, cacheEnv)
+	}
+	return filepath.Join(dir, "coolz"), nil
+}
+
+// compilerID identifies this build of the compiler by the hash of its
+// executable, so that modules cached by another build are not linked with
+// code generated by this one.
+func compilerID() string {
+	path, err := os.Executable()
+	if err != nil {
+		return ""
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// execute runs the program at path with args and the driver's standard
+// streams, and returns its exit status. While the child runs, the driver
+// catches interrupts and drops them so it survives to clean up after the
+// child, which still gets them with their default action.
+func execute(path string, args []string) (int, error) {
+	// A caught signal is reset to its default in the child, unlike an
+	// ignored one, which the child would inherit.
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	go func() {
+		for range interrupts {
+		}
+	}()
+	defer func() {
+		signal.Stop(interrupts)
+		close(interrupts)
+	}()
+
+	cmd := exec.Command(path, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status := exitErr.ExitCode(); status >= 0 {
+			return status, nil
+		}
+		// Killed by a signal, so there is no status to forward.
+		return 1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
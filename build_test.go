@@ -0,0 +1,222 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalizeFlags(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		expected []string
+	}{
+		{"Attached Level", []string{"-O2", "prog.cl"}, []string{"-O=2", "prog.cl"}},
+		{"Separate Level", []string{"-O", "3", "prog.cl"}, []string{"-O=3", "prog.cl"}},
+		{"Bare O Before File", []string{"-O", "prog.cl"}, []string{"-O=2", "prog.cl"}},
+		{"Bare O Last", []string{"-v", "-O"}, []string{"-v", "-O=2"}},
+		{"Already Normalized", []string{"-O=s", "-I=lib", "prog.cl"}, []string{"-O=s", "-I=lib", "prog.cl"}},
+		{"Attached Include", []string{"-Ilib", "-I../std", "prog.cl"}, []string{"-I=lib", "-I=../std", "prog.cl"}},
+		{"Separate Include", []string{"-I", "lib", "prog.cl"}, []string{"-I", "lib", "prog.cl"}},
+		{"Value Flags Take The Next Argument", []string{"-o", "-O2", "-clang", "-O3", "prog.cl"}, []string{"-o", "-O2", "-clang", "-O3", "prog.cl"}},
+		{"Value Flag Last", []string{"-clang"}, []string{"-clang"}},
+		{"Stops At Stdin", []string{"-O1", "-", "-O2", "-Ix"}, []string{"-O=1", "-", "-O2", "-Ix"}},
+		{"Stops At Double Dash", []string{"--", "-O2"}, []string{"--", "-O2"}},
+		{"Stops At Input File", []string{"-q", "prog.cl", "-O", "-Ilib"}, []string{"-q", "prog.cl", "-O", "-Ilib"}},
+		{"Run Passes Program Arguments Through", []string{"prog.cl", "-O2", "x"}, []string{"prog.cl", "-O2", "x"}},
+	}
+
+	native := flag.NewFlagSet("build", flag.ContinueOnError)
+	addNativeFlags(native)
+	for _, tt := range tests {
+		if got := normalizeFlags(native, tt.args); !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.expected, got)
+		}
+	}
+
+	// Without -O, -O2 is left for the flag package to reject
+	ir := flag.NewFlagSet("coolz", flag.ContinueOnError)
+	addCommonFlags(ir)
+	args := []string{"-O2", "-Ilib", "prog.cl"}
+	if got, expected := normalizeFlags(ir, args), []string{"-O2", "-I=lib", "prog.cl"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestSplitCommand(t *testing.T) {
+	tests := []struct {
+		name      string
+		args      []string
+		command   string
+		arguments []string
+	}{
+		{"Default Mode", []string{"-v", "prog.cl"}, "", []string{"-v", "prog.cl"}},
+		{"Command First", []string{"build", "-O2", "prog.cl"}, "build", []string{"-O2", "prog.cl"}},
+		{"Options Before Command", []string{"-v", "--color", "never", "build", "prog.cl"}, "build", []string{"-v", "--color", "never", "prog.cl"}},
+		{"Level Before Command", []string{"-O", "2", "run", "prog.cl"}, "run", []string{"-O", "2", "prog.cl"}},
+		{"Value Named Like A Command", []string{"-o", "build", "prog.cl"}, "", []string{"-o", "build", "prog.cl"}},
+		{"Command After Input File", []string{"prog.cl", "run"}, "", []string{"prog.cl", "run"}},
+		{"Command After Double Dash", []string{"--", "run"}, "", []string{"--", "run"}},
+	}
+
+	for _, tt := range tests {
+		command, arguments := splitCommand(tt.args)
+		if command != tt.command || !reflect.DeepEqual(arguments, tt.arguments) {
+			t.Errorf("%s: expected %q %q, got %q %q", tt.name, tt.command, tt.arguments, command, arguments)
+		}
+	}
+}
+
+func TestJSONDiagnosticsSilenceVerbose(t *testing.T) {
+	defer func() { showProgress, traceSemant, jsonDiagnostics = false, false, false }()
+
+	fs := flag.NewFlagSet("coolz", flag.ContinueOnError)
+	cf := addCommonFlags(fs)
+	fs.Parse([]string{"-v", "--diagnostics=json", "prog.cl"})
+	cf.apply()
+
+	// Only JSON lines may reach the console
+	if showProgress || traceSemant {
+		t.Errorf("expected -v to print nothing with json diagnostics, got progress %v, trace %v", showProgress, traceSemant)
+	}
+}
+
+func TestDefaultExecutableName(t *testing.T) {
+	exe := ""
+	if runtime.GOOS == "windows" {
+		exe = ".exe"
+	}
+	stdin := "a.out"
+	if runtime.GOOS == "windows" {
+		stdin = "a.exe"
+	}
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"prog.cl", "prog" + exe},
+		{filepath.Join("dir", "sub", "hello.cool"), "hello" + exe},
+		{"noext", "noext" + exe},
+		{"-", stdin},
+	}
+	for _, tt := range tests {
+		if got := defaultExecutableName(tt.input); got != tt.expected {
+			t.Errorf("%q: expected %q, got %q", tt.input, tt.expected, got)
+		}
+	}
+}
+
+// fakeExecutable creates an empty executable named name in a new directory
+// and returns its path.
+func fakeExecutable(t *testing.T, name string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestFindClang(t *testing.T) {
+	onPath := fakeExecutable(t, "clang")
+	fromEnv := fakeExecutable(t, "clang-env")
+	fromFlag := fakeExecutable(t, "clang-flag")
+	t.Setenv("PATH", filepath.Dir(onPath))
+
+	tests := []struct {
+		name     string
+		env      string
+		override string
+		expected string
+	}{
+		{"PATH", "", "", onPath},
+		{"Environment", fromEnv, "", fromEnv},
+		{"Flag Wins", fromEnv, fromFlag, fromFlag},
+	}
+	for _, tt := range tests {
+		t.Setenv(clangEnv, tt.env)
+		got, err := findClang(tt.override)
+		if err != nil || got != tt.expected {
+			t.Errorf("%s: expected %q, got %q, %v", tt.name, tt.expected, got, err)
+		}
+	}
+
+	t.Setenv(clangEnv, filepath.Join(t.TempDir(), "missing"))
+	if _, err := findClang(""); err == nil {
+		t.Errorf("expected an unusable %s to be an error", clangEnv)
+	}
+	t.Setenv(clangEnv, "")
+	t.Setenv("PATH", t.TempDir())
+	if _, err := findClang(""); err == nil {
+		t.Errorf("expected an error without clang on PATH")
+	}
+}
+
+func TestClangArgs(t *testing.T) {
+	got := clangArgs([]string{"a.ll", "b.ll"}, "prog", "s")
+	expected := []string{"-Os", "-Wno-override-module", "-o", "prog", "a.ll", "b.ll"}
+	if runtime.GOOS == "windows" {
+		expected = append(expected, "-llegacy_stdio_definitions")
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+// TestHelperProcess is not a real test: execute runs it as the compiled
+// program. It exits with status 3 if it got the arguments after "--"
+// that TestExecuteForwardsExitStatus passes. Run with "interrupt", it
+// interrupts itself and exits with status 5 only if it survives.
+func TestHelperProcess(t *testing.T) {
+	switch os.Getenv("COOLZ_HELPER_PROCESS") {
+	case "1":
+	case "interrupt":
+		self, _ := os.FindProcess(os.Getpid())
+		self.Signal(os.Interrupt)
+		time.Sleep(5 * time.Second)
+		os.Exit(5)
+	default:
+		return
+	}
+	args := os.Args
+	for len(args) > 0 && args[0] != "--" {
+		args = args[1:]
+	}
+	if strings.Join(args, " ") != "-- -O2 x" {
+		os.Exit(4)
+	}
+	os.Exit(3)
+}
+
+func TestExecuteForwardsExitStatus(t *testing.T) {
+	t.Setenv("COOLZ_HELPER_PROCESS", "1")
+	status, err := execute(os.Args[0], []string{"-test.run=^TestHelperProcess$", "--", "-O2", "x"})
+	if err != nil || status != 3 {
+		t.Errorf("expected exit status 3, got %d, %v", status, err)
+	}
+
+	if _, err := execute(filepath.Join(t.TempDir(), "missing"), nil); err == nil {
+		t.Errorf("expected a missing program to be an error")
+	}
+}
+
+func TestExecuteLeavesInterruptsToChild(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("interrupts cannot be sent to a process on Windows")
+	}
+	t.Setenv("COOLZ_HELPER_PROCESS", "interrupt")
+	status, err := execute(os.Args[0], []string{"-test.run=^TestHelperProcess$"})
+	if err != nil || status != 1 {
+		t.Errorf("expected the child to die from the interrupt, got exit status %d, %v", status, err)
+	}
+}
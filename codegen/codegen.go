@@ -2,7 +2,9 @@ package codegen
 
 import (
 	"coolz-compiler/ast"
+	"coolz-compiler/lexer"
 	"fmt"
+	"sort"
 	"strings"
 
 	"github.com/llir/llvm/ir"
@@ -24,27 +26,68 @@ type CodeGenerator struct {
 	malloc          *ir.Func
 	memcpy          *ir.Func
 	currentBindings map[string]value.Value
-	currentTypes    map[string]string // Add this map to store variable -> COOL type
+	types           ast.TypeTable // Static types inferred by semant
 	blockCounter    int
 	classParents    map[string]string
 	classLayouts    map[string]*types.StructType
 	classFields     map[string]map[string]int // Maps class->field->index
 	currentClass    string
 	strlen          *ir.Func
-	program         *ast.Program // Add this field
+	strcmp          *ir.Func
+	equal           *ir.Func                     // Object.equal, see objectEquality
+	program         *ast.Program                 // Program being generated, set by Generate
+	constructors    map[string]*ir.Func          // Maps class->allocating constructor (Class_new)
+	initializers    map[string]*ir.Func          // Maps class->attribute initializer (Class.init)
+	vtableSlots     map[string][]string          // Maps class->method names in vtable slot order
+	vtableTypes     map[string]*types.StructType // Maps class->vtable layout
+	vtables         map[string]*ir.Global        // Maps class->vtable stored in the object header
+	vtableHeader    *types.StructType            // Fields every vtable starts with, see vtableName
+	exit            *ir.Func
+	filename        string // Source file named in runtime error messages
+	library         bool   // Generate no entry point, see SetLibrary
 }
 
-// In the New() function, add malloc declaration:
+// Fields of the vtable header, which precede the method slots in every vtable
+const (
+	vtableName        = iota // Class name, returned by type_name()
+	vtableSize               // Instance size, used by copy()
+	vtableConstructor        // Class_new, used by new SELF_TYPE
+	vtableParent             // Parent class vtable, or null for Object
+)
+
+// basicMethods lists the methods each basic class introduces, in vtable slot order.
+// String's own methods take the unboxed string and are always called statically.
+var basicMethods = map[string][]string{
+	"Object": {"abort", "type_name", "copy"},
+	"IO":     {"out_string", "out_int", "in_string", "in_int"},
+}
+
+// isBasicClass reports whether values of a class are passed around unboxed.
+// They are boxed when they flow into a slot whose static type is a class.
+func isBasicClass(className string) bool {
+	switch className {
+	case "Int", "Bool", "String":
+		return true
+	}
+	return false
+}
+
+// New creates a code generator with the C library functions the runtime
+// calls already declared.
 func New() *CodeGenerator {
 	cg := &CodeGenerator{
 		module:          ir.NewModule(),
 		stringConstants: make(map[string]*ir.Global),
 		methods:         make(map[string]map[string]*ir.Func),
 		currentBindings: make(map[string]value.Value),
-		currentTypes:    make(map[string]string),
 		classParents:    make(map[string]string),
 		classLayouts:    make(map[string]*types.StructType),
 		classFields:     make(map[string]map[string]int),
+		constructors:    make(map[string]*ir.Func),
+		initializers:    make(map[string]*ir.Func),
+		vtableSlots:     make(map[string][]string),
+		vtableTypes:     make(map[string]*types.StructType),
+		vtables:         make(map[string]*ir.Global),
 	}
 
 	// Declare external functions
@@ -62,11 +105,10 @@ func New() *CodeGenerator {
 		ir.NewParam("c", types.I32),
 		ir.NewParam("n", types.I64))
 
-	// Add malloc declaration
+	// malloc backs object allocation in Class_new and the string runtime
 	cg.malloc = cg.module.NewFunc("malloc", types.NewPointer(types.I8),
 		ir.NewParam("size", types.I64))
 
-	// Add memcpy declaration
 	cg.memcpy = cg.module.NewFunc("memcpy", types.NewPointer(types.I8),
 		ir.NewParam("dest", types.NewPointer(types.I8)),
 		ir.NewParam("src", types.NewPointer(types.I8)),
@@ -75,11 +117,55 @@ func New() *CodeGenerator {
 	cg.strlen = cg.module.NewFunc("strlen", types.I64,
 		ir.NewParam("str", types.NewPointer(types.I8)))
 
+	cg.strcmp = cg.module.NewFunc("strcmp", types.I32,
+		ir.NewParam("s1", types.NewPointer(types.I8)),
+		ir.NewParam("s2", types.NewPointer(types.I8)))
+
+	// Every vtable starts with a header describing the class, followed by one
+	// function pointer per method slot
+	cg.vtableHeader = types.NewStruct(
+		types.NewPointer(types.I8),
+		types.I64,
+		types.NewPointer(types.NewFunc(types.NewPointer(types.I8))),
+		types.NewPointer(types.I8))
+	cg.module.NewTypeDef("vtable_header", cg.vtableHeader)
+
 	return cg
 }
 
-// Generate generates LLVM IR for the entire program
+// SetTypes gives the generator the static types semant inferred for the
+// program, see semant.SemanticAnalyser.Types.
+func (cg *CodeGenerator) SetTypes(types ast.TypeTable) {
+	cg.types = types
+}
+
+// SetFilename sets the source file name reported by runtime errors for
+// code whose tokens do not carry one
+func (cg *CodeGenerator) SetFilename(filename string) {
+	cg.filename = filename
+}
+
+// SetLibrary makes Generate emit a module without a main function, for a
+// module compiled on its own and linked with the program that imports it.
+func (cg *CodeGenerator) SetLibrary(library bool) {
+	cg.library = library
+}
+
+// VtableSlots returns the method names of className's vtable, in slot
+// order. Modules compiled separately must agree on them.
+func (cg *CodeGenerator) VtableSlots(className string) []string {
+	return cg.vtableSlots[className]
+}
+
+// Generate generates LLVM IR for the entire program. Classes marked
+// External are only declared: their methods, constructors and vtables are
+// defined by the module that was generated from their source. The runtime
+// that every module carries, i.e. the basic classes, is emitted with
+// linkonce_odr linkage so that such modules link together.
 func (cg *CodeGenerator) Generate(program *ast.Program) (*ir.Module, error) {
+	if cg.types == nil {
+		return nil, fmt.Errorf("internal error: no static types, SetTypes must be called before Generate")
+	}
 	cg.program = program
 
 	// Initialize Object class as the root
@@ -94,43 +180,32 @@ func (cg *CodeGenerator) Generate(program *ast.Program) (*ir.Module, error) {
 	// Print "abort\n" and exit
 	abortStr := cg.getStringConstant("Error: the program was aborted by an abort() function\n")
 	block.NewCall(cg.printf, abortStr)
-	exitFunc := cg.module.NewFunc("exit", types.Void,
+	cg.exit = cg.module.NewFunc("exit", types.Void,
 		ir.NewParam("status", types.I32))
-	block.NewCall(exitFunc, constant.NewInt(types.I32, 1))
+	block.NewCall(cg.exit, constant.NewInt(types.I32, 1))
 	block.NewUnreachable()
 	cg.methods["Object"]["abort"] = abortFunc
 
-	// Modify the type_name() method initialization
+	// Add type_name() method, which reads the class name from the vtable
 	typeNameFunc := cg.module.NewFunc("Object_type_name", types.NewPointer(types.I8),
 		ir.NewParam("self", types.NewPointer(types.I8)))
 	block = typeNameFunc.NewBlock("")
-
-	// Now we'll set the return type of type_name to be a String
-	objStr := cg.getStringConstant("Object")
-	block.NewRet(objStr)
+	vtable := cg.loadVtable(block, typeNameFunc.Params[0], cg.vtableHeader)
+	block.NewRet(cg.loadVtableField(block, vtable, vtableName))
 	cg.methods["Object"]["type_name"] = typeNameFunc
 
-	// Important: Add type_name to return String type in our type tracking
-	for className := range cg.methods {
-		if cg.currentTypes == nil {
-			cg.currentTypes = make(map[string]string)
-		}
-		cg.currentTypes[className+"_type_name"] = "String"
-	}
-
 	// Add copy() method
 	copyFunc := cg.module.NewFunc("Object_copy", types.NewPointer(types.I8),
 		ir.NewParam("self", types.NewPointer(types.I8)))
 	block = copyFunc.NewBlock("")
-	// Create a shallow copy
-	layout := cg.classLayouts["Object"] // or any needed layout
-	// Rough size calculation (not strictly correct for all alignments, but illustrative)
+	// Every object starts with a pointer to its vtable
 	cg.classLayouts["Object"] = types.NewStruct(
 		types.NewPointer(types.I8), // vtable pointer
 	)
-	structSize := cg.calculateStructSize(layout)
-	newObj := block.NewCall(cg.malloc, constant.NewInt(types.I64, structSize))
-	block.NewCall(cg.memcpy, newObj, copyFunc.Params[0], constant.NewInt(types.I64, structSize))
+	// Create a shallow copy sized from the dynamic class, not the static one
+	structSize := cg.loadObjectSize(block, copyFunc.Params[0])
+	newObj := block.NewCall(cg.malloc, structSize)
+	block.NewCall(cg.memcpy, newObj, copyFunc.Params[0], structSize)
 	block.NewRet(newObj)
 	cg.methods["Object"]["copy"] = copyFunc
 
@@ -232,14 +307,6 @@ func (cg *CodeGenerator) Generate(program *ast.Program) (*ir.Module, error) {
 	cg.classParents["String"] = "Object" // String inherits from Object
 	cg.methods["String"] = make(map[string]*ir.Func)
 
-	// Add String's type_name method that returns "String"
-	stringTypeNameFunc := cg.module.NewFunc("String_type_name", types.NewPointer(types.I8),
-		ir.NewParam("self", types.NewPointer(types.I8)))
-	block = stringTypeNameFunc.NewBlock("")
-	stringTypeStr := cg.getStringConstant("String")
-	block.NewRet(stringTypeStr)
-	cg.methods["String"]["type_name"] = stringTypeNameFunc
-
 	// Create length() method
 	lengthFunc := cg.module.NewFunc("String_length", types.I64,
 		ir.NewParam("self", types.NewPointer(types.I8)))
@@ -339,35 +406,79 @@ func (cg *CodeGenerator) Generate(program *ast.Program) (*ir.Module, error) {
 	// Return the concatenated string
 	block.NewRet(newStr2)
 
-	// First pass: Register all classes, inheritance, and methods
+	for _, className := range []string{"Object", "IO", "String"} {
+		for _, method := range cg.methods[className] {
+			method.Linkage = enum.LinkageLinkOnceODR
+		}
+	}
+
+	// Int and Bool only have the methods they inherit from Object
+	cg.classParents["Int"] = "Object"
+	cg.classParents["Bool"] = "Object"
+
+	// A box holds the vtable pointer followed by the unboxed value
+	for _, className := range []string{"Int", "Bool", "String"} {
+		cg.classLayouts[className] = types.NewStruct(types.NewPointer(types.I8),
+			cg.getLLVMType(&ast.TypeIdentifier{Value: className}))
+	}
+
+	// Lay out the vtable slots of the basic classes
+	for _, className := range []string{"Object", "IO", "Int", "Bool", "String"} {
+		parentSlots := cg.vtableSlots[cg.classParents[className]]
+		cg.vtableSlots[className] = append(append([]string{}, parentSlots...), basicMethods[className]...)
+	}
+
+	// First pass: Register inheritance so that layouts do not depend on source order
 	for _, class := range program.Classes {
 		className := class.Name.Value
-
-		// Register inheritance
 		if class.Parent != nil {
 			cg.classParents[className] = class.Parent.Value
 		} else if className != "Object" {
 			cg.classParents[className] = "Object"
 		}
+	}
 
-		// Create class layout
-		cg.createClassLayout(className, program)
+	// Register layouts and methods (including inherited ones), parents first
+	for _, class := range cg.sortClasses(program.Classes) {
+		cg.createClassLayout(class.Name.Value, program)
 
-		// Register methods (including inherited ones)
 		err := cg.registerClassMethods(class)
 		if err != nil {
 			return nil, err
 		}
 	}
 
+	// Declare constructors up front since initializers may instantiate any class
+	for _, className := range cg.instantiableClasses() {
+		cg.declareConstructor(className)
+	}
+	for _, className := range cg.instantiableClasses() {
+		cg.createVtable(className, cg.typeName(className))
+	}
+	for _, className := range cg.instantiableClasses() {
+		if class := cg.classByName(className); class != nil && class.External {
+			continue
+		}
+		if err := cg.generateConstructor(className); err != nil {
+			return nil, err
+		}
+	}
+
 	// Second pass: Generate all class methods and bodies
 	for _, class := range program.Classes {
+		if class.External {
+			continue
+		}
 		err := cg.generateClass(class, program)
 		if err != nil {
 			return nil, err
 		}
 	}
 
+	if cg.library {
+		return cg.module, nil
+	}
+
 	// Generate main function
 	mainFunc := cg.module.NewFunc("main", types.I32)
 	block = mainFunc.NewBlock("")
@@ -375,7 +486,7 @@ func (cg *CodeGenerator) Generate(program *ast.Program) (*ir.Module, error) {
 	// Find Main class and main method
 	var mainClass *ast.Class
 	for _, class := range program.Classes {
-		if class.Name.Value == "Main" {
+		if class.Name.Value == "Main" && !class.External {
 			mainClass = class
 			break
 		}
@@ -385,8 +496,8 @@ func (cg *CodeGenerator) Generate(program *ast.Program) (*ir.Module, error) {
 		return nil, fmt.Errorf("no Main class found")
 	}
 
-	// Create new Main object (for now just using null as we haven't implemented object creation)
-	mainObj := constant.NewNull(types.NewPointer(types.I8))
+	// Create the Main object the same way `new Main` would
+	mainObj := block.NewCall(cg.constructors["Main"])
 
 	// Call Main.main()
 	mainMethod := cg.methods["Main"]["main"]
@@ -402,7 +513,8 @@ func (cg *CodeGenerator) Generate(program *ast.Program) (*ir.Module, error) {
 	return cg.module, nil
 }
 
-// Add this helper function
+// registerClassMethods records class's methods, inheriting its parent's
+// first so that overrides replace them.
 func (cg *CodeGenerator) registerClassMethods(class *ast.Class) error {
 	className := class.Name.Value
 
@@ -425,9 +537,16 @@ func (cg *CodeGenerator) registerClassMethods(class *ast.Class) error {
 		}
 	}
 
+	// Overridden methods keep their parent's slot, new ones are appended
+	cg.vtableSlots[className] = append([]string{}, cg.vtableSlots[cg.classParents[className]]...)
+
 	// Register class's own methods
 	for _, feature := range class.Features {
 		if method, ok := feature.(*ast.Method); ok {
+			if cg.slotIndex(className, method.Name.Value) < 0 {
+				cg.vtableSlots[className] = append(cg.vtableSlots[className], method.Name.Value)
+			}
+
 			// Create function parameters
 			params := make([]*ir.Param, 0, len(method.Formals)+1)
 			params = append(params, ir.NewParam("self", types.NewPointer(types.I8)))
@@ -450,40 +569,46 @@ func (cg *CodeGenerator) registerClassMethods(class *ast.Class) error {
 	return nil
 }
 
-func (cg *CodeGenerator) calculateStructSize(layout *types.StructType) int64 {
-	if layout == nil {
-		return 8 // Return minimum size for nil layouts (pointer size)
-	}
-
-	structSize := int64(0)
-	for _, field := range layout.Fields {
-		switch ft := field.(type) {
-		case *types.IntType:
-			structSize += int64(ft.BitSize) / 8
-		case *types.PointerType:
-			structSize += 8
-		case *types.ArrayType:
-			structSize += int64(ft.Len)
-		case *types.StructType:
-			structSize += cg.calculateStructSize(ft)
-		default:
-			structSize += 8
-		}
-	}
-	return ((structSize + 7) / 8) * 8
+// sizeOf computes the allocation size of a type with the usual
+// getelementptr-on-null trick, so that LLVM accounts for field alignment.
+func (cg *CodeGenerator) sizeOf(typ types.Type) constant.Constant {
+	end := constant.NewGetElementPtr(typ, constant.NewNull(types.NewPointer(typ)),
+		constant.NewInt(types.I32, 1))
+	return constant.NewPtrToInt(end, types.I64)
+}
+
+// loadVtable loads the vtable stored in the header of an object, typed as vtableType
+func (cg *CodeGenerator) loadVtable(block *ir.Block, object value.Value, vtableType *types.StructType) value.Value {
+	header := block.NewBitCast(object, types.NewPointer(types.NewPointer(types.I8)))
+	vtable := block.NewLoad(types.NewPointer(types.I8), header)
+	return block.NewBitCast(vtable, types.NewPointer(vtableType))
+}
+
+// loadObjectSize reads the instance size of an object's dynamic class
+func (cg *CodeGenerator) loadObjectSize(block *ir.Block, object value.Value) value.Value {
+	vtable := cg.loadVtable(block, object, cg.vtableHeader)
+	return cg.loadVtableField(block, vtable, vtableSize)
+}
+
+// loadVtableField reads one of the vtable header fields, e.g. vtableParent
+func (cg *CodeGenerator) loadVtableField(block *ir.Block, vtable value.Value, field int) value.Value {
+	fieldPtr := block.NewGetElementPtr(cg.vtableHeader, vtable,
+		constant.NewInt(types.I32, 0),
+		constant.NewInt(types.I32, int64(field)))
+	return block.NewLoad(cg.vtableHeader.Fields[field], fieldPtr)
 }
 
 // getStringConstant creates or retrieves a global string constant
 func (cg *CodeGenerator) getStringConstant(s string) value.Value {
-	if global, exists := cg.stringConstants[s]; exists {
-		return global
+	global, exists := cg.stringConstants[s]
+	if !exists {
+		// Create new global string constant
+		data := constant.NewCharArrayFromString(s + "\x00")
+		global = cg.module.NewGlobalDef("str."+fmt.Sprintf("%d", len(cg.stringConstants)), data)
+		global.Linkage = enum.LinkagePrivate
+		cg.stringConstants[s] = global
 	}
 
-	// Create new global string constant
-	data := constant.NewCharArrayFromString(s + "\x00")
-	global := cg.module.NewGlobalDef("str."+fmt.Sprintf("%d", len(cg.stringConstants)), data)
-	cg.stringConstants[s] = global
-
 	// Get pointer to the first character
 	zero := constant.NewInt(types.I32, 0)
 	return constant.NewGetElementPtr(global.ContentType, global, zero, zero)
@@ -500,16 +625,6 @@ func (cg *CodeGenerator) generateClass(class *ast.Class, program *ast.Program) e
 
 	className := class.Name.Value
 
-	// Override type_name method for this class
-	typeNameFunc := cg.module.NewFunc(fmt.Sprintf("%s_type_name", className),
-		types.NewPointer(types.I8),
-		ir.NewParam("self", types.NewPointer(types.I8)))
-
-	block := typeNameFunc.NewBlock("")
-	classNameStr := cg.getStringConstant(className)
-	block.NewRet(classNameStr)
-	cg.methods[className]["type_name"] = typeNameFunc
-
 	// Second pass: Generate method bodies
 	for _, feature := range class.Features {
 		if method, ok := feature.(*ast.Method); ok {
@@ -531,15 +646,42 @@ func (cg *CodeGenerator) generateClass(class *ast.Class, program *ast.Program) e
 func (cg *CodeGenerator) generateMethodBody(className string, method *ast.Method) error {
 	// Save previous state
 	prevBindings := cg.currentBindings
-	prevTypes := cg.currentTypes
 	cg.currentBindings = make(map[string]value.Value)
-	cg.currentTypes = make(map[string]string)
 
 	fn := cg.methods[className][method.Name.Value]
 	block := fn.NewBlock("")
 
 	// Add class attributes to scope first
-	self := fn.Params[0]
+	cg.bindAttributes(block, className, fn.Params[0])
+
+	// Store parameters in allocas
+	for i, formal := range method.Formals {
+		alloca := block.NewAlloca(fn.Params[i+1].Type())
+		block.NewStore(fn.Params[i+1], alloca)
+		cg.currentBindings[formal.Name.Value] = alloca
+	}
+
+	value, block, err := cg.generateExpression(block, method.Body)
+	if err != nil {
+		return err
+	}
+
+	if block.Term == nil {
+		bodyType, err := cg.staticType(method.Body)
+		if err != nil {
+			return err
+		}
+		block.NewRet(cg.convert(block, value, bodyType, method.Type.Value))
+	}
+
+	// Restore previous state
+	cg.currentBindings = prevBindings
+	return nil
+}
+
+// bindAttributes makes every attribute of className, including inherited
+// ones, addressable through currentBindings for the object self.
+func (cg *CodeGenerator) bindAttributes(block *ir.Block, className string, self value.Value) {
 	structPtr := block.NewBitCast(self, types.NewPointer(cg.classLayouts[className]))
 
 	// Add all attributes from the class hierarchy
@@ -551,41 +693,175 @@ func (cg *CodeGenerator) generateMethodBody(className string, method *ast.Method
 					constant.NewInt(types.I32, 0),
 					constant.NewInt(types.I32, int64(fieldIndex)))
 				cg.currentBindings[fieldName] = fieldPtr
-				// Store the attribute type
-				for _, class := range cg.program.Classes {
-					if class.Name.Value == currentClass {
-						for _, feature := range class.Features {
-							if attr, ok := feature.(*ast.Attribute); ok && attr.Name.Value == fieldName {
-								cg.currentTypes[fieldName] = attr.Type.Value
-							}
-						}
-					}
-				}
 			}
 		}
 		currentClass = cg.classParents[currentClass]
 	}
+}
 
-	// Store parameters in allocas
-	for i, formal := range method.Formals {
-		alloca := block.NewAlloca(fn.Params[i+1].Type())
-		block.NewStore(fn.Params[i+1], alloca)
-		cg.currentBindings[formal.Name.Value] = alloca
-		cg.currentTypes[formal.Name.Value] = formal.Type.Value
+// classByName finds the declaration of a user-defined class
+func (cg *CodeGenerator) classByName(className string) *ast.Class {
+	for _, class := range cg.program.Classes {
+		if class.Name.Value == className {
+			return class
+		}
 	}
+	return nil
+}
 
-	value, block, err := cg.generateExpression(block, method.Body)
-	if err != nil {
-		return err
+// typeName returns the name className was declared with, which type_name()
+// and runtime messages show. className itself is the qualified name used
+// for IR symbols.
+func (cg *CodeGenerator) typeName(className string) string {
+	if class := cg.classByName(className); class != nil {
+		return class.DeclaredName()
 	}
+	return className
+}
 
-	if block.Term == nil {
-		block.NewRet(value)
+// sortClasses orders classes so that every parent precedes its children
+func (cg *CodeGenerator) sortClasses(classes []*ast.Class) []*ast.Class {
+	depth := func(className string) int {
+		d := 0
+		for parent := cg.classParents[className]; parent != ""; parent = cg.classParents[parent] {
+			d++
+			if d > len(cg.classParents) {
+				break // Cyclic hierarchies are rejected by semant
+			}
+		}
+		return d
 	}
 
-	// Restore previous state
-	cg.currentBindings = prevBindings
-	cg.currentTypes = prevTypes
+	sorted := make([]*ast.Class, len(classes))
+	copy(sorted, classes)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return depth(sorted[i].Name.Value) < depth(sorted[j].Name.Value)
+	})
+	return sorted
+}
+
+// instantiableClasses lists every class that is represented as a heap object,
+// parents first. For Int, Bool and String these are the boxes.
+func (cg *CodeGenerator) instantiableClasses() []string {
+	classes := []string{"Object", "IO", "Int", "Bool", "String"}
+	for _, class := range cg.sortClasses(cg.program.Classes) {
+		classes = append(classes, class.Name.Value)
+	}
+	return classes
+}
+
+// defaultValue returns the COOL default for a type: 0, false, "" or void
+func (cg *CodeGenerator) defaultValue(typeName string) value.Value {
+	switch typeName {
+	case "Int":
+		return constant.NewInt(types.I64, 0)
+	case "Bool":
+		return constant.NewBool(false)
+	case "String":
+		return cg.getStringConstant("")
+	default:
+		return constant.NewNull(types.NewPointer(types.I8))
+	}
+}
+
+// declareConstructor declares className_new and className.init. The '.'
+// keeps the initializer apart from a user method named init, which is
+// emitted as className_init.
+func (cg *CodeGenerator) declareConstructor(className string) {
+	cg.createClassLayout(className, cg.program)
+
+	cg.constructors[className] = cg.module.NewFunc(fmt.Sprintf("%s_new", className),
+		types.NewPointer(types.I8))
+	cg.initializers[className] = cg.module.NewFunc(fmt.Sprintf("%s.init", className),
+		types.Void, ir.NewParam("self", types.NewPointer(types.I8)))
+	if cg.classByName(className) == nil {
+		cg.constructors[className].Linkage = enum.LinkageLinkOnceODR
+		cg.initializers[className].Linkage = enum.LinkageLinkOnceODR
+	}
+}
+
+// generateConstructor emits className_new, which allocates an instance,
+// stores its vtable and sets every attribute to its default, and
+// className.init, which runs the parent's initializer and then the class's
+// own attribute initializers in source order. Since all defaults are set
+// before any initializer runs, an initializer reading a later attribute
+// sees its default value.
+func (cg *CodeGenerator) generateConstructor(className string) error {
+	layout := cg.classLayouts[className]
+
+	newFunc := cg.constructors[className]
+	block := newFunc.NewBlock("")
+	object := block.NewCall(cg.malloc, cg.sizeOf(layout))
+	header := block.NewBitCast(object, types.NewPointer(types.NewPointer(types.I8)))
+	block.NewStore(block.NewBitCast(cg.vtables[className], types.NewPointer(types.I8)), header)
+	if isBasicClass(className) {
+		// A new box holds the default value, e.g. 0 for Int
+		block.NewStore(cg.defaultValue(className), cg.boxValuePtr(block, object, className))
+	}
+
+	// Default the attributes of the whole hierarchy
+	structPtr := block.NewBitCast(object, types.NewPointer(layout))
+	for current := className; current != ""; current = cg.classParents[current] {
+		class := cg.classByName(current)
+		if class == nil {
+			continue
+		}
+		for _, feature := range class.Features {
+			if attr, ok := feature.(*ast.Attribute); ok {
+				fieldPtr := block.NewGetElementPtr(layout, structPtr,
+					constant.NewInt(types.I32, 0),
+					constant.NewInt(types.I32, int64(cg.classFields[current][attr.Name.Value])))
+				block.NewStore(cg.defaultValue(attr.Type.Value), fieldPtr)
+			}
+		}
+	}
+	block.NewCall(cg.initializers[className], object)
+	block.NewRet(object)
+
+	prevClass := cg.currentClass
+	prevFunc := cg.currentFunc
+	prevBindings := cg.currentBindings
+	initFunc := cg.initializers[className]
+	cg.currentClass = className
+	cg.currentFunc = initFunc
+	cg.currentBindings = make(map[string]value.Value)
+	defer func() {
+		cg.currentClass = prevClass
+		cg.currentFunc = prevFunc
+		cg.currentBindings = prevBindings
+	}()
+
+	block = initFunc.NewBlock("")
+	if parentInit, exists := cg.initializers[cg.classParents[className]]; exists {
+		block.NewCall(parentInit, initFunc.Params[0])
+	}
+
+	class := cg.classByName(className)
+	if class == nil {
+		block.NewRet(nil)
+		return nil
+	}
+
+	cg.bindAttributes(block, className, initFunc.Params[0])
+	for _, feature := range class.Features {
+		attr, ok := feature.(*ast.Attribute)
+		if !ok || attr.Init == nil {
+			continue
+		}
+		initValue, newBlock, err := cg.generateExpression(block, attr.Init)
+		if err != nil {
+			return err
+		}
+		block = newBlock
+		initType, err := cg.staticType(attr.Init)
+		if err != nil {
+			return err
+		}
+		initValue = cg.convert(block, initValue, initType, attr.Type.Value)
+		block.NewStore(initValue, cg.currentBindings[attr.Name.Value])
+	}
+	block.NewRet(nil)
+
 	return nil
 }
 
@@ -611,30 +887,204 @@ func getMethodNames(methods map[string]*ir.Func) []string {
 	return names
 }
 
+// generateMethodCall dispatches methodName on object, whose static type is
+// className, through the vtable so that overriding methods are honoured.
 func (cg *CodeGenerator) generateMethodCall(block *ir.Block, object value.Value, className string,
-	methodName string, args []ast.Expression) (value.Value, *ir.Block, error) {
+	methodName string, args []ast.Expression, tok lexer.Token) (value.Value, *ir.Block, error) {
+	if className == "SELF_TYPE" {
+		className = cg.currentClass
+	}
+
+	llvmArgs, currentBlock, err := cg.generateArguments(block, object, args, cg.formalTypes(className, methodName))
+	if err != nil {
+		return nil, currentBlock, err
+	}
+
+	// Int, Bool and String are final and unboxed, so they are dispatched statically
+	switch className {
+	case "Int", "Bool", "String":
+		return cg.generateBasicCall(currentBlock, className, methodName, llvmArgs)
+	}
+
+	slot := cg.slotIndex(className, methodName)
+	if slot < 0 {
+		return nil, currentBlock, fmt.Errorf("method %s not found in class %s or its parents", methodName, className)
+	}
+	currentBlock = cg.checkVoid(currentBlock, object, tok)
+
+	// Load the implementation from the receiver's vtable and call it
+	vtableType := cg.vtableTypes[className]
+	fieldIndex := len(cg.vtableHeader.Fields) + slot
+	vtable := cg.loadVtable(currentBlock, object, vtableType)
+	slotPtr := currentBlock.NewGetElementPtr(vtableType, vtable,
+		constant.NewInt(types.I32, 0),
+		constant.NewInt(types.I32, int64(fieldIndex)))
+	method := currentBlock.NewLoad(vtableType.Fields[fieldIndex], slotPtr)
+
+	result := currentBlock.NewCall(method, llvmArgs...)
+	return result, currentBlock, nil
+}
+
+// generateStaticCall calls the implementation of methodName visible in
+// className directly, bypassing the receiver's vtable (expr@Type.method()).
+func (cg *CodeGenerator) generateStaticCall(block *ir.Block, object value.Value, className string,
+	methodName string, args []ast.Expression, tok lexer.Token) (value.Value, *ir.Block, error) {
+	llvmArgs, currentBlock, err := cg.generateArguments(block, object, args, cg.formalTypes(className, methodName))
+	if err != nil {
+		return nil, currentBlock, err
+	}
+
+	switch className {
+	case "Int", "Bool", "String":
+		return cg.generateBasicCall(currentBlock, className, methodName, llvmArgs)
+	}
 
-	// Look up the method in the class hierarchy
 	method, exists := cg.lookupMethod(className, methodName)
 	if !exists {
-		return nil, block, fmt.Errorf("method %s not found in class %s or its parents", methodName, className)
+		return nil, currentBlock, fmt.Errorf("method %s not found in class %s or its parents", methodName, className)
 	}
+	currentBlock = cg.checkVoid(currentBlock, object, tok)
+	return currentBlock.NewCall(method, llvmArgs...), currentBlock, nil
+}
 
-	// Generate code for each argument
+// generateArguments evaluates the arguments of a call in order, prefixed by the
+// receiver, and converts them to the types of the formals when those are known
+func (cg *CodeGenerator) generateArguments(block *ir.Block, object value.Value,
+	args []ast.Expression, formals []string) ([]value.Value, *ir.Block, error) {
 	llvmArgs := []value.Value{object} // First argument is always the object itself
 	currentBlock := block
-	for _, arg := range args {
+	for i, arg := range args {
 		argValue, newBlock, err := cg.generateExpression(currentBlock, arg)
 		if err != nil {
 			return nil, currentBlock, err
 		}
 		currentBlock = newBlock
+		if i < len(formals) {
+			argType, err := cg.staticType(arg)
+			if err != nil {
+				return nil, currentBlock, err
+			}
+			argValue = cg.convert(currentBlock, argValue, argType, formals[i])
+		}
 		llvmArgs = append(llvmArgs, argValue)
 	}
+	return llvmArgs, currentBlock, nil
+}
+
+// formalTypes returns the declared types of the formals of the method visible
+// in className. It returns nil for the basic class methods, whose arguments
+// always have exactly the formal's type.
+func (cg *CodeGenerator) formalTypes(className, methodName string) []string {
+	for current := className; current != ""; current = cg.classParents[current] {
+		class := cg.classByName(current)
+		if class == nil {
+			continue
+		}
+		for _, feature := range class.Features {
+			if method, ok := feature.(*ast.Method); ok && method.Name.Value == methodName {
+				formals := make([]string, len(method.Formals))
+				for i, formal := range method.Formals {
+					formals[i] = formal.Type.Value
+				}
+				return formals
+			}
+		}
+	}
+	return nil
+}
 
-	// Call the method
-	result := currentBlock.NewCall(method, llvmArgs...)
-	return result, currentBlock, nil
+// generateBasicCall calls a method on an unboxed Int, Bool or String value.
+// These classes cannot be inherited from, so their methods are known statically.
+func (cg *CodeGenerator) generateBasicCall(block *ir.Block, className string, methodName string,
+	args []value.Value) (value.Value, *ir.Block, error) {
+	switch methodName {
+	case "type_name":
+		return cg.getStringConstant(cg.typeName(className)), block, nil
+	case "copy":
+		return args[0], block, nil
+	case "abort":
+		args[0] = constant.NewNull(types.NewPointer(types.I8))
+	}
+
+	method, exists := cg.lookupMethod(className, methodName)
+	if !exists {
+		return nil, block, fmt.Errorf("method %s not found in class %s or its parents", methodName, className)
+	}
+	return block.NewCall(method, args...), block, nil
+}
+
+// slotIndex returns the vtable slot of methodName in className, or -1
+func (cg *CodeGenerator) slotIndex(className, methodName string) int {
+	for i, name := range cg.vtableSlots[className] {
+		if name == methodName {
+			return i
+		}
+	}
+	return -1
+}
+
+// createVtable emits the vtable of className, which type_name() reports as
+// typeName. Slots are inherited in the parent's order, so a slot index
+// computed from any ancestor stays valid. The parent's vtable must already
+// exist, see instantiableClasses.
+func (cg *CodeGenerator) createVtable(className, typeName string) {
+	// Methods are named Class_method, so the vtable gets a name no method
+	// can have
+	name := className + ".vtable"
+	fields := append([]types.Type{}, cg.vtableHeader.Fields...)
+	var methods []constant.Constant
+	for _, methodName := range cg.vtableSlots[className] {
+		method, _ := cg.lookupMethod(className, methodName)
+		fields = append(fields, method.Type())
+		methods = append(methods, method)
+	}
+	vtableType := types.NewStruct(fields...)
+	cg.module.NewTypeDef(name, vtableType)
+	cg.vtableTypes[className] = vtableType
+
+	// The vtable of an External class is defined by its own module
+	class := cg.classByName(className)
+	if class != nil && class.External {
+		vtable := cg.module.NewGlobal(name, vtableType)
+		vtable.Linkage = enum.LinkageExternal
+		vtable.Immutable = true
+		cg.vtables[className] = vtable
+		return
+	}
+
+	var parent constant.Constant = constant.NewNull(types.NewPointer(types.I8))
+	if parentVtable, exists := cg.vtables[cg.classParents[className]]; exists {
+		parent = constant.NewBitCast(parentVtable, types.NewPointer(types.I8))
+	}
+	entries := append([]constant.Constant{
+		cg.getStringConstant(typeName).(constant.Constant),
+		cg.sizeOf(cg.classLayouts[className]),
+		cg.constructors[className],
+		parent,
+	}, methods...)
+
+	vtable := cg.module.NewGlobalDef(name, constant.NewStruct(vtableType, entries...))
+	if class == nil {
+		// Every module carries the basic classes
+		vtable.Linkage = enum.LinkageLinkOnceODR
+	}
+	vtable.Immutable = true
+	cg.vtables[className] = vtable
+}
+
+// staticType returns the static COOL type semant inferred for an expression,
+// with SELF_TYPE resolved to the current class. Semant types every
+// expression of a valid program, so a missing entry is a compiler bug.
+func (cg *CodeGenerator) staticType(expr ast.Expression) (string, error) {
+	t, exists := cg.types[expr]
+	if !exists {
+		pos := expr.Pos()
+		return "", fmt.Errorf("internal error: no static type for %T at %d:%d", expr, pos.Line, pos.Column)
+	}
+	if t == "SELF_TYPE" {
+		return cg.currentClass, nil
+	}
+	return t, nil
 }
 
 // generateExpression now returns (value, currentBlock, error)
@@ -660,126 +1110,39 @@ func (cg *CodeGenerator) generateExpression(block *ir.Block, expr ast.Expression
 		}
 		// Return the first parameter (self) of the current function
 		return cg.currentFunc.Params[0], block, nil
-		// In the DynamicDispatch case in generateExpression, modify the type determination section:
 	case *ast.DynamicDispatch:
-		methodName := e.Method.Value
-
-		// First, generate code for the object we're dispatching on
-		var objValue value.Value
-		var objType string
-
-		if e.Object == nil || e.Object.TokenLiteral() == "self" {
-			// Self dispatch handling
-			if cg.currentFunc == nil {
-				return nil, block, fmt.Errorf("dispatch on self outside method context")
-			}
-			objValue = cg.currentFunc.Params[0]
-			// Use the current class type if we're in a method
-			objType = strings.Split(cg.currentFunc.Name(), "_")[0]
-		} else {
-			// Generate code for the object expression
-			var newBlock *ir.Block
-			var err error
-			objValue, newBlock, err = cg.generateExpression(block, e.Object)
-			if err != nil {
-				return nil, block, err
-			}
-			block = newBlock
-
-			// Determine the type of the object
-			switch obj := e.Object.(type) {
-			case *ast.ObjectIdentifier:
-				// Look up the type in our current types map
-				var exists bool
-				objType, exists = cg.currentTypes[obj.Value]
-				if !exists {
-					return nil, block, fmt.Errorf("undefined variable: %s", obj.Value)
-				}
-			case *ast.NewExpression:
-				objType = obj.Type.Value
-			case *ast.DynamicDispatch:
-				// For nested dispatches, first determine the type of the method result
-				if objType == "" {
-					// If objType is not set, we need to determine it from the nested dispatch
-					switch obj.Object.(type) {
-					case *ast.StringLiteral:
-						objType = "String"
-					case *ast.IntegerLiteral:
-						objType = "Int"
-					case *ast.BooleanLiteral:
-						objType = "Bool"
-					default:
-						// For other cases, get the type from current types map
-						if innerObjId, ok := obj.Object.(*ast.ObjectIdentifier); ok {
-							if t, exists := cg.currentTypes[innerObjId.Value]; exists {
-								objType = t
-							}
-						}
-					}
-				}
-
-				// Look up the method in the current objType
-				if method, exists := cg.lookupMethod(objType, obj.Method.Value); exists {
-					// For type_name method, we know it always returns String
-					if obj.Method.Value == "type_name" {
-						objType = "String"
-					} else {
-						// For other methods, extract return type from method name
-						parts := strings.Split(method.Name(), "_")
-						if len(parts) > 0 {
-							objType = parts[0] // The class name is always the first part
-						}
-					}
-				} else {
-					return nil, block, fmt.Errorf("method %s not found in class %s", obj.Method.Value, objType)
-				}
-
-			case *ast.StringLiteral:
-				objType = "String"
-				objValue = cg.getStringConstant(obj.Value)
-				// String literals should use String's methods
-				if method, exists := cg.methods["String"][methodName]; exists {
-					result := block.NewCall(method, objValue)
-					return result, block, nil
-				}
-			case *ast.IntegerLiteral:
-				objType = "Int"
-				// For integer literals, call Int's type_name
-				if methodName == "type_name" {
-					method := cg.methods["Int"]["type_name"]
-					result := block.NewCall(method, objValue)
-					return result, block, nil
-				}
-			case *ast.BooleanLiteral:
-				objType = "Bool"
-				// For boolean literals, call Bool's type_name
-				if methodName == "type_name" {
-					method := cg.methods["Bool"]["type_name"]
-					result := block.NewCall(method, objValue)
-					return result, block, nil
-				}
-			default:
-				return nil, block, fmt.Errorf("unsupported dispatch object type: %T", e.Object)
-			}
+		// The receiver's static type decides which vtable layout to use
+		objType, err := cg.staticType(e.Object)
+		if err != nil {
+			return nil, block, err
 		}
-
-		// Special handling for type_name dispatch
-		if methodName == "type_name" {
-			// First try to use the actual type's type_name method
-			if typeMethods, exists := cg.methods[objType]; exists {
-				if method, exists := typeMethods["type_name"]; exists {
-					result := block.NewCall(method, objValue)
-					return result, block, nil
-				}
-			}
-			// Fallback to Object's type_name if not found
-			method := cg.methods["Object"]["type_name"]
-			result := block.NewCall(method, objValue)
-			return result, block, nil
+		objValue, block, err := cg.generateExpression(block, e.Object)
+		if err != nil {
+			return nil, block, err
 		}
-
-		// Now generate the method call with the correct object and type
-		return cg.generateMethodCall(block, objValue, objType, methodName, e.Arguments)
+		return cg.generateMethodCall(block, objValue, objType, e.Method.Value, e.Arguments, e.Token)
+	case *ast.StaticDispatch:
+		// The receiver is evaluated once and the named ancestor's method is called directly.
+		// A basic value dispatched through Object is boxed like any value flowing into Object.
+		objType, err := cg.staticType(e.Object)
+		if err != nil {
+			return nil, block, err
+		}
+		objValue, block, err := cg.generateExpression(block, e.Object)
+		if err != nil {
+			return nil, block, err
+		}
+		objValue = cg.convert(block, objValue, objType, e.Type.Value)
+		result, block, err := cg.generateStaticCall(block, objValue, e.Type.Value, e.Method.Value, e.Arguments, e.Token)
+		if err != nil {
+			return nil, block, err
+		}
+		// Object is the only ancestor of a basic class, and copy its only
+		// method returning SELF_TYPE: the copy of a box is opened again
+		if isBasicClass(objType) && !isBasicClass(e.Type.Value) && e.Method.Value == "copy" {
+			result = cg.unbox(block, result, objType)
+		}
+		return result, block, nil
 	case *ast.BlockExpression:
 		return cg.generateBlock(block, e)
 	case *ast.LetExpression:
@@ -835,7 +1198,14 @@ func (cg *CodeGenerator) generateExpression(block *ir.Block, expr ast.Expression
 		case "*":
 			return block.NewMul(left, right), block, nil
 		case "/":
-			return block.NewSDiv(left, right), block, nil // Integer division only
+			// Dividing by zero is a runtime error rather than a trap
+			cg.blockCounter++
+			zeroBlock := cg.currentFunc.NewBlock(fmt.Sprintf("div_zero_%d", cg.blockCounter))
+			divBlock := cg.currentFunc.NewBlock(fmt.Sprintf("div_%d", cg.blockCounter))
+			isZero := block.NewICmp(enum.IPredEQ, right, constant.NewInt(types.I64, 0))
+			block.NewCondBr(isZero, zeroBlock, divBlock)
+			cg.runtimeErrorAt(zeroBlock, e.Token, "division by zero")
+			return divBlock.NewSDiv(left, right), divBlock, nil // Integer division only
 
 		// Comparison operations
 		case "<":
@@ -843,7 +1213,15 @@ func (cg *CodeGenerator) generateExpression(block *ir.Block, expr ast.Expression
 		case "<=":
 			return block.NewICmp(enum.IPredSLE, left, right), block, nil // Signed less than or equal
 		case "=":
-			return block.NewICmp(enum.IPredEQ, left, right), block, nil // Equal
+			leftType, err := cg.staticType(e.Left)
+			if err != nil {
+				return nil, block, err
+			}
+			rightType, err := cg.staticType(e.Right)
+			if err != nil {
+				return nil, block, err
+			}
+			return cg.generateEquality(block, left, right, leftType, rightType), block, nil
 		default:
 			return nil, block, fmt.Errorf("unsupported binary operator: %s", e.Operator)
 		}
@@ -886,10 +1264,20 @@ func (cg *CodeGenerator) generateExpression(block *ir.Block, expr ast.Expression
 		block.NewCondBr(condBool, thenBlock, elseBlock)
 
 		// Generate code for then branch.
+		// Both branches are converted to the static type of the whole expression.
+		resultType, err := cg.staticType(e)
+		if err != nil {
+			return nil, block, err
+		}
 		thenValue, thenBlock, err := cg.generateExpression(thenBlock, e.Consequence)
 		if err != nil {
 			return nil, block, err
 		}
+		thenType, err := cg.staticType(e.Consequence)
+		if err != nil {
+			return nil, block, err
+		}
+		thenValue = cg.convert(thenBlock, thenValue, thenType, resultType)
 		thenBlock.NewBr(mergeBlock)
 
 		// Generate code for else branch.
@@ -897,36 +1285,15 @@ func (cg *CodeGenerator) generateExpression(block *ir.Block, expr ast.Expression
 		if err != nil {
 			return nil, block, err
 		}
-		elseBlock.NewBr(mergeBlock)
-
-		// Convert types to match if needed
-		if types.Equal(thenValue.Type(), types.I64) && types.Equal(elseValue.Type(), types.NewPointer(types.I8)) {
-			// Convert integer to pointer
-			thenValue = thenBlock.NewIntToPtr(thenValue, types.NewPointer(types.I8))
-		} else if types.Equal(thenValue.Type(), types.NewPointer(types.I8)) && types.Equal(elseValue.Type(), types.I64) {
-			// Convert integer to pointer
-			elseValue = elseBlock.NewIntToPtr(elseValue, types.NewPointer(types.I8))
-		} else if !types.Equal(thenValue.Type(), elseValue.Type()) {
-			// If types don't match and we can't convert, both should be generic Object pointers
-			if !types.Equal(thenValue.Type(), types.NewPointer(types.I8)) {
-				thenValue = thenBlock.NewBitCast(thenValue, types.NewPointer(types.I8))
-			}
-			if !types.Equal(elseValue.Type(), types.NewPointer(types.I8)) {
-				elseValue = elseBlock.NewBitCast(elseValue, types.NewPointer(types.I8))
-			}
+		elseType, err := cg.staticType(e.Alternative)
+		if err != nil {
+			return nil, block, err
 		}
+		elseValue = cg.convert(elseBlock, elseValue, elseType, resultType)
+		elseBlock.NewBr(mergeBlock)
 
-		// Create PHI node in merge block.
-		inc1 := &ir.Incoming{
-			X:    thenValue,
-			Pred: thenBlock,
-		}
-		inc2 := &ir.Incoming{
-			X:    elseValue,
-			Pred: elseBlock,
-		}
-		phi := mergeBlock.NewPhi(inc1)
-		phi.Incs = append(phi.Incs, inc2)
+		// Create PHI node in merge block
+		phi := mergeBlock.NewPhi(ir.NewIncoming(thenValue, thenBlock), ir.NewIncoming(elseValue, elseBlock))
 
 		// Return the PHI node and update the current block to mergeBlock.
 		return phi, mergeBlock, nil
@@ -940,8 +1307,10 @@ func (cg *CodeGenerator) generateExpression(block *ir.Block, expr ast.Expression
 		// Branch to condition block from current block
 		block.NewBr(condBlock)
 
-		// Generate condition code
-		condValue, condBlock, err := cg.generateExpression(condBlock, e.Condition) // Fixed: Predicate -> Condition
+		// Generate condition code. It may span several blocks (e.g. a
+		// dispatch with its void check), so the loop branches back to
+		// condBlock but tests the condition at the end of condEnd.
+		condValue, condEnd, err := cg.generateExpression(condBlock, e.Condition)
 		if err != nil {
 			return nil, block, err
 		}
@@ -949,13 +1318,13 @@ func (cg *CodeGenerator) generateExpression(block *ir.Block, expr ast.Expression
 		// Convert condition to boolean if necessary
 		var condBool value.Value
 		if !types.Equal(condValue.Type(), types.I1) {
-			condBool = condBlock.NewICmp(enum.IPredNE, condValue, constant.NewInt(types.I64, 0))
+			condBool = condEnd.NewICmp(enum.IPredNE, condValue, constant.NewInt(types.I64, 0))
 		} else {
 			condBool = condValue
 		}
 
 		// Create conditional branch
-		condBlock.NewCondBr(condBool, bodyBlock, exitBlock)
+		condEnd.NewCondBr(condBool, bodyBlock, exitBlock)
 
 		// Generate body code
 		_, bodyBlock, err = cg.generateExpression(bodyBlock, e.Body)
@@ -971,104 +1340,319 @@ func (cg *CodeGenerator) generateExpression(block *ir.Block, expr ast.Expression
 	case *ast.Assignment:
 		return cg.generateAssignment(block, e)
 	case *ast.NewExpression:
-		// Placeholder for new object creation
-		newObj := constant.NewNull(types.NewPointer(types.I8))
-		return newObj, block, nil
-	case *ast.CaseExpression:
-		// First evaluate the test expression
-		testValue, block, err := cg.generateExpression(block, e.Expr) // Changed from e.Test to e.Expr
-		if err != nil {
-			return nil, block, err
+		className := e.Type.Value
+		if className == "SELF_TYPE" {
+			// Instantiate the dynamic class of self through its vtable
+			vtable := cg.loadVtable(block, cg.currentFunc.Params[0], cg.vtableHeader)
+			constructor := cg.loadVtableField(block, vtable, vtableConstructor)
+			return block.NewCall(constructor), block, nil
 		}
+		// Basic values are unboxed, so new just yields their default
+		switch className {
+		case "Int", "Bool", "String":
+			return cg.defaultValue(className), block, nil
+		}
+		constructor, exists := cg.constructors[className]
+		if !exists {
+			return nil, block, fmt.Errorf("cannot instantiate undefined class %s", className)
+		}
+		return block.NewCall(constructor), block, nil
+	case *ast.CaseExpression:
+		return cg.generateCase(block, e)
 
-		// Generate merge block where all branches will converge
-		cg.blockCounter++
-		mergeBlock := cg.currentFunc.NewBlock(fmt.Sprintf("case_merge_%d", cg.blockCounter))
-
-		// Create blocks for each branch
-		var branchBlocks []*ir.Block
-		var branchTypes []string
-		var branchValues []value.Value
-
-		// Create blocks for all branches
-		for range e.Branches { // Changed from e.Cases to e.Branches
-			branchBlock := cg.currentFunc.NewBlock(fmt.Sprintf("case_branch_%d", cg.blockCounter))
-			branchBlocks = append(branchBlocks, branchBlock)
-		}
-
-		// Generate code for each branch
-		for i, branch := range e.Branches { // Changed from e.Cases to e.Branches
-			branchBlock := branchBlocks[i]
-			branchTypes = append(branchTypes, branch.Type.Value)
-
-			// Create binding for the case variable
-			prevBindings := cg.currentBindings
-			prevTypes := cg.currentTypes
-			cg.currentBindings = make(map[string]value.Value)
-			cg.currentTypes = make(map[string]string)
-			for k, v := range prevBindings {
-				cg.currentBindings[k] = v
-			}
-			for k, v := range prevTypes {
-				cg.currentTypes[k] = v
-			}
+	default:
+		return nil, block, fmt.Errorf("unsupported expression type: %T", expr)
+	}
+}
+
+// generateCase selects the branch whose type is the closest ancestor of the
+// scrutinee's dynamic class. The vtables of the dynamic class and of its
+// ancestors, found through the parent links, are compared with the
+// branches' in turn.
+func (cg *CodeGenerator) generateCase(block *ir.Block, e *ast.CaseExpression) (value.Value, *ir.Block, error) {
+	testValue, block, err := cg.generateExpression(block, e.Expr)
+	if err != nil {
+		return nil, block, err
+	}
+	testType, err := cg.staticType(e.Expr)
+	if err != nil {
+		return nil, block, err
+	}
+	resultType, err := cg.staticType(e)
+	if err != nil {
+		return nil, block, err
+	}
 
-			// Bind the case variable
-			varAlloca := branchBlock.NewAlloca(testValue.Type())
-			branchBlock.NewStore(testValue, varAlloca)
-			cg.currentBindings[branch.Identifier.Value] = varAlloca
-			cg.currentTypes[branch.Identifier.Value] = branch.Type.Value
+	cg.blockCounter++
+	id := cg.blockCounter
+	mergeBlock := cg.currentFunc.NewBlock(fmt.Sprintf("case_merge_%d", id))
 
-			// Generate the branch expression
-			branchValue, newBranchBlock, err := cg.generateExpression(branchBlock, branch.Expr) // Changed from branch.Body to branch.Expr
-			if err != nil {
-				return nil, block, err
-			}
+	branchBlocks := make([]*ir.Block, len(e.Branches))
+	for i := range e.Branches {
+		branchBlocks[i] = cg.currentFunc.NewBlock(fmt.Sprintf("case_branch_%d_%d", id, i))
+	}
 
-			// Add branch to merge block
-			newBranchBlock.NewBr(mergeBlock)
-			branchValues = append(branchValues, branchValue)
-
-			// Restore bindings
-			cg.currentBindings = prevBindings
-			cg.currentTypes = prevTypes
-		}
-
-		// Create a series of type checks
-		nextBlock := block
-		for i := 0; i < len(e.Branches); i++ { // Changed from e.Cases to e.Branches
-			// For now, we'll just branch to each case block in order
-			// In a real implementation, you would need to check the actual types
-			// and implement the least-type selection logic
-			if i < len(e.Branches)-1 { // Changed from e.Cases to e.Branches
-				nextCondBlock := cg.currentFunc.NewBlock(fmt.Sprintf("case_cond_%d", cg.blockCounter))
-				nextBlock.NewBr(branchBlocks[i])
-				nextBlock = nextCondBlock
-			} else {
-				// Last case branches directly
-				nextBlock.NewBr(branchBlocks[i])
+	// Branches that can never be selected are left unreachable
+	reachable := make([]bool, len(e.Branches))
+
+	switch testType {
+	case "Int", "Bool", "String":
+		// Unboxed values have no vtable, but their class is known statically
+		target := -1
+		for current := testType; current != "" && target < 0; current = cg.classParents[current] {
+			for i, branch := range e.Branches {
+				if branch.Type.Value == current {
+					target = i
+					break
+				}
 			}
 		}
+		if target < 0 {
+			cg.runtimeErrorAt(block, e.Token, "No match in case statement for Class %s", cg.getStringConstant(cg.typeName(testType)))
+		} else {
+			block.NewBr(branchBlocks[target])
+			reachable[target] = true
+		}
+	default:
+		// Any branch may match, basic values included since they are boxed
+		for i := range e.Branches {
+			reachable[i] = true
+		}
+		cg.generateCaseTest(block, e.Token, testValue, e.Branches, branchBlocks, reachable, id)
+	}
 
-		// Create PHI node in merge block to collect all possible results
-		if len(branchValues) > 0 {
-			incomingVals := make([]*ir.Incoming, len(branchValues))
-			for i := range branchValues {
-				incomingVals[i] = &ir.Incoming{
-					X:    branchValues[i],
-					Pred: branchBlocks[i],
-				}
-			}
-			phi := mergeBlock.NewPhi(incomingVals[0])
-			phi.Incs = incomingVals
-			return phi, mergeBlock, nil
+	// Generate each branch with its identifier bound to the scrutinee
+	var incoming []*ir.Incoming
+	for i, branch := range e.Branches {
+		if !reachable[i] {
+			branchBlocks[i].NewUnreachable()
+			continue
 		}
 
+		prevBindings := cg.currentBindings
+		cg.currentBindings = make(map[string]value.Value)
+		for k, v := range prevBindings {
+			cg.currentBindings[k] = v
+		}
+
+		// The identifier has the branch's type, so boxes are opened for Int, Bool and String
+		branchBlock := branchBlocks[i]
+		branchValue := cg.convert(branchBlock, testValue, testType, branch.Type.Value)
+		varAlloca := branchBlock.NewAlloca(branchValue.Type())
+		branchBlock.NewStore(branchValue, varAlloca)
+		cg.currentBindings[branch.Identifier.Value] = varAlloca
+
+		branchValue, endBlock, err := cg.generateExpression(branchBlock, branch.Expr)
+		cg.currentBindings = prevBindings
+		if err != nil {
+			return nil, endBlock, err
+		}
+		branchType, err := cg.staticType(branch.Expr)
+		if err != nil {
+			return nil, endBlock, err
+		}
+		branchValue = cg.convert(endBlock, branchValue, branchType, resultType)
+
+		// The PHI must name the block the branch ends in, not the one it started in
+		endBlock.NewBr(mergeBlock)
+		incoming = append(incoming, ir.NewIncoming(branchValue, endBlock))
+	}
+
+	if len(incoming) == 0 {
+		mergeBlock.NewUnreachable()
 		return constant.NewNull(types.NewPointer(types.I8)), mergeBlock, nil
+	}
+	return mergeBlock.NewPhi(incoming...), mergeBlock, nil
+}
 
-	default:
-		return nil, block, fmt.Errorf("unsupported expression type: %T", expr)
+// generateCaseTest emits the runtime branch selection for a heap object
+func (cg *CodeGenerator) generateCaseTest(block *ir.Block, tok lexer.Token, testValue value.Value, branches []*ast.CaseBranch,
+	branchBlocks []*ir.Block, reachable []bool, id int) {
+	voidBlock := cg.currentFunc.NewBlock(fmt.Sprintf("case_void_%d", id))
+	dispatchBlock := cg.currentFunc.NewBlock(fmt.Sprintf("case_dispatch_%d", id))
+	loopBlock := cg.currentFunc.NewBlock(fmt.Sprintf("case_loop_%d", id))
+	parentBlock := cg.currentFunc.NewBlock(fmt.Sprintf("case_parent_%d", id))
+	noMatchBlock := cg.currentFunc.NewBlock(fmt.Sprintf("case_nomatch_%d", id))
+
+	isVoid := block.NewICmp(enum.IPredEQ, testValue, constant.NewNull(types.NewPointer(types.I8)))
+	block.NewCondBr(isVoid, voidBlock, dispatchBlock)
+	cg.runtimeErrorAt(voidBlock, tok, "Match on void in case statement.")
+
+	vtable := cg.loadVtable(dispatchBlock, testValue, cg.vtableHeader)
+	dispatchBlock.NewBr(loopBlock)
+
+	// Compare the current class's vtable with each branch's, then retry with
+	// its parent. Vtables identify classes across separately compiled
+	// modules, where no numbering of all classes exists.
+	current := loopBlock.NewPhi(ir.NewIncoming(vtable, dispatchBlock))
+	testBlock := loopBlock
+	seen := make(map[string]bool)
+	for i, branch := range branches {
+		branchVtable, exists := cg.vtables[branch.Type.Value]
+		if !exists || !reachable[i] || seen[branch.Type.Value] {
+			continue
+		}
+		seen[branch.Type.Value] = true
+		nextBlock := cg.currentFunc.NewBlock(fmt.Sprintf("case_test_%d_%d", id, i))
+		isClass := testBlock.NewICmp(enum.IPredEQ, current,
+			constant.NewBitCast(branchVtable, types.NewPointer(cg.vtableHeader)))
+		testBlock.NewCondBr(isClass, branchBlocks[i], nextBlock)
+		testBlock = nextBlock
+	}
+	testBlock.NewBr(parentBlock)
+
+	parent := cg.loadVtableField(parentBlock, current, vtableParent)
+	isRoot := parentBlock.NewICmp(enum.IPredEQ, parent, constant.NewNull(types.NewPointer(types.I8)))
+	parentBlock.NewCondBr(isRoot, noMatchBlock, loopBlock)
+	current.Incs = append(current.Incs, ir.NewIncoming(
+		parentBlock.NewBitCast(parent, types.NewPointer(cg.vtableHeader)), parentBlock))
+
+	typeName := cg.loadVtableField(noMatchBlock, vtable, vtableName)
+	cg.runtimeErrorAt(noMatchBlock, tok, "No match in case statement for Class %s", typeName)
+}
+
+// generateEquality lowers left = right. Int, Bool and String compare by
+// value, other objects by identity. An operand typed Object may hold a box,
+// so unless both operands are basic values of the same class, a comparison
+// involving Object or a basic value is left to Object.equal at runtime.
+func (cg *CodeGenerator) generateEquality(block *ir.Block, left, right value.Value, leftType, rightType string) value.Value {
+	if isBasicClass(leftType) && leftType == rightType {
+		return cg.compareBasic(block, left, right, leftType)
+	}
+	mayBeBox := func(className string) bool { return className == "Object" || isBasicClass(className) }
+	left = cg.convert(block, left, leftType, "Object")
+	right = cg.convert(block, right, rightType, "Object")
+	if !mayBeBox(leftType) && !mayBeBox(rightType) {
+		return block.NewICmp(enum.IPredEQ, left, right)
+	}
+	return block.NewCall(cg.objectEquality(), left, right)
+}
+
+// compareBasic compares two unboxed values of a basic class. Strings are
+// equal when their contents are.
+func (cg *CodeGenerator) compareBasic(block *ir.Block, left, right value.Value, className string) value.Value {
+	if className == "String" {
+		cmp := block.NewCall(cg.strcmp, left, right)
+		return block.NewICmp(enum.IPredEQ, cmp, constant.NewInt(types.I32, 0))
+	}
+	return block.NewICmp(enum.IPredEQ, left, right)
+}
+
+// objectEquality returns Object.equal, which tells whether two objects are
+// equal: the same object, or boxes of the same basic class holding equal
+// values. It is emitted on first use, once the basic vtables exist, and
+// like the rest of the runtime in every module that needs it.
+func (cg *CodeGenerator) objectEquality() *ir.Func {
+	if cg.equal != nil {
+		return cg.equal
 	}
+	ptr := types.NewPointer(types.I8)
+	null := constant.NewNull(ptr)
+	f := cg.module.NewFunc("Object.equal", types.I1, ir.NewParam("a", ptr), ir.NewParam("b", ptr))
+	f.Linkage = enum.LinkageLinkOnceODR
+	a, b := f.Params[0], f.Params[1]
+
+	entry := f.NewBlock("")
+	same := f.NewBlock("same")
+	same.NewRet(constant.NewInt(types.I1, 1))
+	different := f.NewBlock("different")
+	different.NewRet(constant.NewInt(types.I1, 0))
+
+	// Distinct objects can only be equal boxes, and void is never a box
+	checkVoid := f.NewBlock("check_void")
+	entry.NewCondBr(entry.NewICmp(enum.IPredEQ, a, b), same, checkVoid)
+	compareClasses := f.NewBlock("compare_classes")
+	eitherVoid := checkVoid.NewOr(checkVoid.NewICmp(enum.IPredEQ, a, null), checkVoid.NewICmp(enum.IPredEQ, b, null))
+	checkVoid.NewCondBr(eitherVoid, different, compareClasses)
+
+	vtable := cg.loadVtable(compareClasses, a, cg.vtableHeader)
+	next := f.NewBlock("compare_values")
+	compareClasses.NewCondBr(compareClasses.NewICmp(enum.IPredEQ, vtable, cg.loadVtable(compareClasses, b, cg.vtableHeader)), next, different)
+
+	for _, className := range []string{"Int", "Bool", "String"} {
+		box := f.NewBlock("box_" + className)
+		other := f.NewBlock("not_" + className)
+		basicVtable := constant.NewBitCast(cg.vtables[className], types.NewPointer(cg.vtableHeader))
+		next.NewCondBr(next.NewICmp(enum.IPredEQ, vtable, basicVtable), box, other)
+		box.NewRet(cg.compareBasic(box, cg.unbox(box, a, className), cg.unbox(box, b, className), className))
+		next = other
+	}
+	next.NewBr(different)
+
+	cg.equal = f
+	return f
+}
+
+// convert adapts a value of static type fromType to the representation used
+// for toType. Basic values are boxed when they flow into a class type, and
+// unboxed again where the basic type itself is expected.
+func (cg *CodeGenerator) convert(block *ir.Block, val value.Value, fromType, toType string) value.Value {
+	switch {
+	case isBasicClass(fromType) && !isBasicClass(toType):
+		return cg.box(block, val, fromType)
+	case !isBasicClass(fromType) && isBasicClass(toType):
+		return cg.unbox(block, val, toType)
+	}
+	return val
+}
+
+// box allocates a box of className holding val
+func (cg *CodeGenerator) box(block *ir.Block, val value.Value, className string) value.Value {
+	object := block.NewCall(cg.constructors[className])
+	block.NewStore(val, cg.boxValuePtr(block, object, className))
+	return object
+}
+
+// unbox reads the value held by a box of className
+func (cg *CodeGenerator) unbox(block *ir.Block, object value.Value, className string) value.Value {
+	layout := cg.classLayouts[className]
+	return block.NewLoad(layout.Fields[1], cg.boxValuePtr(block, object, className))
+}
+
+// boxValuePtr returns the address of the value held by a box of className
+func (cg *CodeGenerator) boxValuePtr(block *ir.Block, object value.Value, className string) value.Value {
+	layout := cg.classLayouts[className]
+	structPtr := block.NewBitCast(object, types.NewPointer(layout))
+	return block.NewGetElementPtr(layout, structPtr,
+		constant.NewInt(types.I32, 0),
+		constant.NewInt(types.I32, 1))
+}
+
+// runtimeError prints a message, then terminates the program with status 1
+func (cg *CodeGenerator) runtimeError(block *ir.Block, format string, args ...value.Value) {
+	block.NewCall(cg.printf, append([]value.Value{cg.getStringConstant(format)}, args...)...)
+	block.NewCall(cg.exit, constant.NewInt(types.I32, 1))
+	block.NewUnreachable()
+}
+
+// runtimeErrorAt is runtimeError with the message prefixed by the source
+// location of tok, e.g. "example.cl:12: dispatch to void"
+func (cg *CodeGenerator) runtimeErrorAt(block *ir.Block, tok lexer.Token, format string, args ...value.Value) {
+	filename := tok.File
+	if filename == "" {
+		filename = cg.filename
+	}
+	location := fmt.Sprintf("line %d", tok.Line)
+	if filename != "" {
+		location = fmt.Sprintf("%s:%d", strings.ReplaceAll(filename, "%", "%%"), tok.Line)
+	}
+	cg.runtimeError(block, location+": "+format+"\n", args...)
+}
+
+// checkVoid emits a "dispatch to void" error for a void receiver and returns
+// the block in which the dispatch proceeds. self is never void.
+func (cg *CodeGenerator) checkVoid(block *ir.Block, object value.Value, tok lexer.Token) *ir.Block {
+	if object == cg.currentFunc.Params[0] {
+		return block
+	}
+
+	cg.blockCounter++
+	voidBlock := cg.currentFunc.NewBlock(fmt.Sprintf("dispatch_void_%d", cg.blockCounter))
+	okBlock := cg.currentFunc.NewBlock(fmt.Sprintf("dispatch_%d", cg.blockCounter))
+	isVoid := block.NewICmp(enum.IPredEQ, object, constant.NewNull(types.NewPointer(types.I8)))
+	block.NewCondBr(isVoid, voidBlock, okBlock)
+	cg.runtimeErrorAt(voidBlock, tok, "dispatch to void")
+	return okBlock
 }
 
 // generateBlock now threads the current block through each expression.
@@ -1089,15 +1673,11 @@ func (cg *CodeGenerator) generateBlock(block *ir.Block, blockExpr *ast.BlockExpr
 
 func (cg *CodeGenerator) generateLet(block *ir.Block, letExpr *ast.LetExpression) (value.Value, *ir.Block, error) {
 	prevBindings := make(map[string]value.Value)
-	prevTypes := make(map[string]string)
 
-	// Save old bindings and types
+	// Save old bindings
 	for k, v := range cg.currentBindings {
 		prevBindings[k] = v
 	}
-	for k, v := range cg.currentTypes {
-		prevTypes[k] = v
-	}
 
 	currentBlock := block
 	for _, binding := range letExpr.Bindings {
@@ -1111,32 +1691,24 @@ func (cg *CodeGenerator) generateLet(block *ir.Block, letExpr *ast.LetExpression
 				return nil, currentBlock, err
 			}
 			currentBlock = newBlock
+			initType, err := cg.staticType(binding.Init)
+			if err != nil {
+				return nil, currentBlock, err
+			}
+			initValue = cg.convert(currentBlock, initValue, initType, binding.Type.Value)
 			currentBlock.NewStore(initValue, alloca)
 		} else {
-			var defaultValue value.Value
-			switch binding.Type.Value {
-			case "Int":
-				defaultValue = constant.NewInt(types.I64, 0)
-			case "Bool":
-				defaultValue = constant.NewBool(false)
-			case "String":
-				defaultValue = constant.NewNull(types.NewPointer(types.I8))
-			default:
-				defaultValue = constant.NewNull(types.NewPointer(types.I8))
-			}
-			currentBlock.NewStore(defaultValue, alloca)
+			currentBlock.NewStore(cg.defaultValue(binding.Type.Value), alloca)
 		}
 
-		// Store the alloca and the COOL type
+		// Store the alloca
 		cg.currentBindings[binding.Identifier.Value] = alloca
-		cg.currentTypes[binding.Identifier.Value] = binding.Type.Value
 	}
 
 	result, newBlock, err := cg.generateExpression(currentBlock, letExpr.In)
 
-	// Restore old bindings and types
+	// Restore old bindings
 	cg.currentBindings = prevBindings
-	cg.currentTypes = prevTypes
 
 	return result, newBlock, err
 }
@@ -1163,16 +1735,16 @@ func (cg *CodeGenerator) createClassLayout(className string, program *ast.Progra
 		return layout
 	}
 
-	// Get parent class layout first
+	// Get parent class layout first; the root class holds the object header
 	var fields []types.Type
 	if parent, exists := cg.classParents[className]; exists && parent != "" {
 		parentLayout := cg.createClassLayout(parent, program)
 		fields = append(fields, parentLayout.Fields...)
+	} else {
+		// Pointer to the class descriptor
+		fields = append(fields, types.NewPointer(types.I8))
 	}
 
-	// Add vtable pointer (for methods)
-	fields = append(fields, types.NewPointer(types.I8))
-
 	// Create field map if it doesn't exist
 	if cg.classFields[className] == nil {
 		cg.classFields[className] = make(map[string]int)
@@ -1196,39 +1768,44 @@ func (cg *CodeGenerator) createClassLayout(className string, program *ast.Progra
 	return layout
 }
 
-// Now generateAssignment can use cg.currentClass
+// generateAssignment stores the value of assign in the variable or attribute
+// it names, boxed if the variable has a class type, and returns the value.
 func (cg *CodeGenerator) generateAssignment(block *ir.Block, assign *ast.Assignment) (value.Value, *ir.Block, error) {
-	if obj, ok := assign.Left.(*ast.ObjectIdentifier); ok {
-		// First check if this is a field access
-		if fieldIndex, exists := cg.classFields[cg.currentClass][obj.Value]; exists {
-			self := cg.currentFunc.Params[0] // get self parameter
-			// Cast self to struct pointer
-			structPtr := block.NewBitCast(self, types.NewPointer(cg.classLayouts[cg.currentClass]))
-			// Generate field pointer
-			fieldPtr := block.NewGetElementPtr(cg.classLayouts[cg.currentClass], structPtr,
-				constant.NewInt(types.I32, 0),
-				constant.NewInt(types.I32, int64(fieldIndex)))
+	obj, ok := assign.Left.(*ast.ObjectIdentifier)
+	if !ok {
+		return nil, block, fmt.Errorf("undefined variable or field: %v", assign.Left)
+	}
 
-			// Generate value and store it
-			value, newBlock, err := cg.generateExpression(block, assign.Value)
-			if err != nil {
-				return nil, block, err
-			}
-			newBlock.NewStore(value, fieldPtr)
-			return value, newBlock, nil
-		}
+	// Formals and let variables shadow attributes, as they do for reads
+	var target value.Value
+	if alloca, exists := cg.currentBindings[obj.Value]; exists {
+		target = alloca
+	} else if fieldIndex, exists := cg.classFields[cg.currentClass][obj.Value]; exists {
+		self := cg.currentFunc.Params[0] // get self parameter
+		// Cast self to struct pointer
+		structPtr := block.NewBitCast(self, types.NewPointer(cg.classLayouts[cg.currentClass]))
+		// Generate field pointer
+		target = block.NewGetElementPtr(cg.classLayouts[cg.currentClass], structPtr,
+			constant.NewInt(types.I32, 0),
+			constant.NewInt(types.I32, int64(fieldIndex)))
+	} else {
+		return nil, block, fmt.Errorf("undefined variable or field: %v", assign.Left)
+	}
 
-		// If not a field, check local variables
-		if alloca, exists := cg.currentBindings[obj.Value]; exists {
-			// Generate code for the value expression
-			value, newBlock, err := cg.generateExpression(block, assign.Value)
-			if err != nil {
-				return nil, block, err
-			}
-			// Store the new value
-			newBlock.NewStore(value, alloca)
-			return value, newBlock, nil
-		}
+	valueType, err := cg.staticType(assign.Value)
+	if err != nil {
+		return nil, block, err
+	}
+	targetType, err := cg.staticType(obj)
+	if err != nil {
+		return nil, block, err
+	}
+
+	// Generate value and store it
+	value, newBlock, err := cg.generateExpression(block, assign.Value)
+	if err != nil {
+		return nil, block, err
 	}
-	return nil, block, fmt.Errorf("undefined variable or field: %v", assign.Left)
+	newBlock.NewStore(cg.convert(newBlock, value, valueType, targetType), target)
+	return value, newBlock, nil
 }
@@ -0,0 +1,504 @@
+package codegen
+
+import (
+	"coolz-compiler/ast"
+	"coolz-compiler/lexer"
+	"coolz-compiler/parser"
+	"coolz-compiler/preprocessor"
+	"coolz-compiler/semant"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func generate(t *testing.T, input string) string {
+	t.Helper()
+	l := lexer.NewLexer(strings.NewReader(input))
+	p := parser.New(l)
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+	return generateProgram(t, program)
+}
+
+func generateProgram(t *testing.T, program *ast.Program) string {
+	t.Helper()
+	sa := semant.NewSemanticAnalyser()
+	sa.Analyze(program)
+	if len(sa.Errors()) > 0 {
+		t.Fatalf("semantic errors: %v", sa.Errors())
+	}
+
+	cg := New()
+	cg.SetTypes(sa.Types())
+	module, err := cg.Generate(program)
+	if err != nil {
+		t.Fatalf("code generation failed: %v", err)
+	}
+	return module.String()
+}
+
+// run executes the program generated for input with lli and returns its
+// output. It skips the test if lli is not installed.
+func run(t *testing.T, input string) string {
+	t.Helper()
+	return runIR(t, generate(t, input))
+}
+
+func runIR(t *testing.T, ir string) string {
+	t.Helper()
+	lli, err := exec.LookPath("lli")
+	if err != nil {
+		t.Skip("lli not found")
+	}
+	file := filepath.Join(t.TempDir(), "main.ll")
+	if err := os.WriteFile(file, []byte(ir), 0644); err != nil {
+		t.Fatal(err)
+	}
+	output, err := exec.Command(lli, file).CombinedOutput()
+	if err != nil {
+		t.Fatalf("lli failed: %v\n%s", err, output)
+	}
+	return string(output)
+}
+
+func TestConstructorAllocatesAndInitializes(t *testing.T) {
+	input := `
+class A inherits IO {
+    x : Int <- 3;
+    s : String;
+    a : A;
+    make() : SELF_TYPE { new SELF_TYPE };
+    show() : Object { { self.out_int(x); self.out_string(s.concat("!")); } };
+};
+class Main {
+    main() : Object { (new A).show() };
+};
+`
+	ir := generate(t, input)
+
+	start := strings.Index(ir, "define i8* @A_new()")
+	if start < 0 {
+		t.Fatalf("A_new not emitted:\n%s", ir)
+	}
+	body := ir[start:]
+	body = body[:strings.Index(body, "\n}")]
+
+	// A_new allocates the whole layout, stores the vtable in the header,
+	// defaults every attribute and then runs the initializers
+	layout := "{ i8*, i64, i8*, i8* }"
+	for _, want := range []string{
+		"call i8* @malloc(i64 ptrtoint (" + layout + "* getelementptr (" + layout + ", " + layout + "* null, i32 1) to i64))",
+		"bitcast %A.vtable* @A.vtable to i8*",
+		"store i64 0",
+		"store i8* getelementptr ([1 x i8]",
+		"store i8* null",
+		"call void @A.init(",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected A_new to contain %q:\n%s", want, body)
+		}
+	}
+	if strings.Index(body, "store i64 0") > strings.Index(body, "call void @A.init(") {
+		t.Errorf("expected the defaults to be stored before the initializers run:\n%s", body)
+	}
+
+	// The program builds Main through its constructor too
+	if !strings.Contains(ir, "define i32 @main() {\n0:\n\t%1 = call i8* @Main_new()\n\t%2 = call i8* @Main_main(i8* %1)") {
+		t.Errorf("expected main to create Main with Main_new:\n%s", ir)
+	}
+
+	// new SELF_TYPE calls the constructor found in the receiver's vtable
+	start = strings.Index(ir, "define i8* @A_make(")
+	body = ir[start:]
+	body = body[:strings.Index(body, "\n}")]
+	if !strings.Contains(body, "getelementptr %vtable_header, %vtable_header* %") || !strings.Contains(body, "i32 0, i32 2") ||
+		strings.Contains(body, "@A_new") {
+		t.Errorf("expected new SELF_TYPE to load the constructor from the vtable:\n%s", body)
+	}
+
+	if output := run(t, input); output != "3!" {
+		t.Errorf("expected %q, got %q", "3!", output)
+	}
+}
+
+func TestVtableSlots(t *testing.T) {
+	input := `
+class Animal {
+    speak() : String { "animal" };
+    name() : String { "generic" };
+    vtable() : Int { 1 };
+};
+class Dog inherits Animal {
+    speak() : String { "woof" };
+    fetch() : Object { self };
+};
+class Main inherits IO {
+    main() : Object { out_string((new Dog).speak()).out_int((new Dog).vtable()) };
+};
+`
+	ir := generate(t, input)
+
+	// A method named vtable lives alongside the vtable itself
+	tests := []struct {
+		vtable string
+		slots  []string
+	}{
+		{"@Animal.vtable", []string{"@Object_abort", "@Object_type_name", "@Object_copy", "@Animal_speak", "@Animal_name", "@Animal_vtable"}},
+		{"@Dog.vtable", []string{"@Object_abort", "@Object_type_name", "@Object_copy", "@Dog_speak", "@Animal_name", "@Animal_vtable", "@Dog_fetch"}},
+	}
+
+	for _, tt := range tests {
+		var line string
+		for _, l := range strings.Split(ir, "\n") {
+			if strings.HasPrefix(l, tt.vtable+" =") {
+				line = l
+			}
+		}
+		if line == "" {
+			t.Fatalf("vtable %s not emitted", tt.vtable)
+		}
+
+		pos := 0
+		for _, slot := range tt.slots {
+			i := strings.Index(line[pos:], slot)
+			if i < 0 {
+				t.Fatalf("%s: slot %s missing or out of order in %s", tt.vtable, slot, line)
+			}
+			pos += i + len(slot)
+		}
+	}
+
+	if output := run(t, input); output != "woof1" {
+		t.Errorf("expected %q, got %q", "woof1", output)
+	}
+}
+
+func TestDynamicDispatchLoadsSlot(t *testing.T) {
+	ir := generate(t, `
+class Animal {
+    speak() : String { "animal" };
+};
+class Dog inherits Animal {
+    speak() : String { "woof" };
+};
+class Main {
+    main() : Object {
+        let a : Animal <- new Dog in a.speak()
+    };
+};
+`)
+
+	if strings.Contains(ir, "call i8* @Animal_speak") || strings.Contains(ir, "call i8* @Dog_speak") {
+		t.Errorf("expected speak() to be called through the vtable, got a direct call:\n%s", ir)
+	}
+	if !strings.Contains(ir, "getelementptr %Animal.vtable") {
+		t.Errorf("expected a slot load from the static type's vtable:\n%s", ir)
+	}
+}
+
+func TestStaticDispatchCallsAncestor(t *testing.T) {
+	ir := generate(t, `
+class Animal {
+    speak() : String { "animal" };
+};
+class Dog inherits Animal {
+    speak() : String { self@Animal.speak() };
+};
+class Main {
+    main() : Object { (new Dog)@Animal.speak() };
+};
+`)
+
+	if got := strings.Count(ir, "call i8* @Animal_speak("); got != 2 {
+		t.Errorf("expected 2 direct calls to @Animal_speak, got %d:\n%s", got, ir)
+	}
+	if got := strings.Count(ir, "call i8* @Dog_new()"); got != 1 {
+		t.Errorf("expected the receiver to be evaluated once, got %d allocations:\n%s", got, ir)
+	}
+}
+
+func TestCaseComparesVtables(t *testing.T) {
+	ir := generate(t, `
+class A {};
+class B inherits A {};
+class Main {
+    main() : Object {
+        case new B of
+            a : A => a;
+            o : Object => o;
+        esac
+    };
+};
+`)
+
+	for _, want := range []string{
+		"Match on void in case statement.",
+		"No match in case statement for Class %s",
+		"icmp eq %vtable_header* %",
+		"bitcast (%A.vtable* @A.vtable to %vtable_header*)",
+	} {
+		if !strings.Contains(ir, want) {
+			t.Errorf("expected IR to contain %q:\n%s", want, ir)
+		}
+	}
+
+	// B's vtable links to A's, which links to Object's
+	if !strings.Contains(ir, "@B.vtable = constant %B.vtable") ||
+		!strings.Contains(ir, "i8* bitcast (%A.vtable* @A.vtable to i8*)") {
+		t.Errorf("expected B's vtable to point to its parent's:\n%s", ir)
+	}
+}
+
+func TestBasicValuesAreBoxed(t *testing.T) {
+	ir := generate(t, `
+class Main {
+    main() : Object {
+        let o : Object <- 5 in
+            case o of
+                i : Int => i + 1;
+                s : String => s.length();
+            esac
+    };
+};
+`)
+
+	for _, want := range []string{
+		"@Int.vtable = linkonce_odr constant %Int.vtable",
+		"@String.vtable = linkonce_odr constant %String.vtable",
+		"call i8* @Int_new()",
+		"store i64 5",
+		"load i64",
+	} {
+		if !strings.Contains(ir, want) {
+			t.Errorf("expected IR to contain %q:\n%s", want, ir)
+		}
+	}
+	if strings.Contains(ir, "inttoptr") {
+		t.Errorf("expected Int to be boxed rather than cast to a pointer:\n%s", ir)
+	}
+}
+
+func TestRuntimeChecks(t *testing.T) {
+	ir := generate(t, `
+class A { f() : Int { 1 }; };
+class Main {
+    a : A;
+    main() : Object { {
+        a.f();
+        self.f(4 / 2);
+    } };
+    f(x : Int) : Int { x };
+};
+`)
+
+	for _, want := range []string{
+		"line 6: dispatch to void",
+		"line 7: division by zero",
+		"icmp eq i64",
+	} {
+		if !strings.Contains(ir, want) {
+			t.Errorf("expected IR to contain %q:\n%s", want, ir)
+		}
+	}
+	if got := strings.Count(ir, "dispatch to void"); got != 1 {
+		t.Errorf("expected only the dispatch on a to be checked, got %d checks:\n%s", got, ir)
+	}
+}
+
+func TestInitializersRunParentFirst(t *testing.T) {
+	ir := generate(t, `
+class A { a : Int <- 1; };
+class B inherits A { b : Int <- a + 1; };
+class Main {
+    main() : Object { new B };
+};
+`)
+
+	start := strings.Index(ir, "define void @B.init(")
+	if start < 0 {
+		t.Fatalf("B.init not emitted:\n%s", ir)
+	}
+	body := ir[start:]
+	body = body[:strings.Index(body, "\n}")]
+
+	parentCall := strings.Index(body, "call void @A.init(")
+	ownInit := strings.Index(body, "add i64")
+	if parentCall < 0 || ownInit < 0 || parentCall > ownInit {
+		t.Errorf("expected B.init to call A.init before running b's initializer:\n%s", body)
+	}
+	if !strings.Contains(ir, "call void @Object.init(") {
+		t.Errorf("expected A.init to call Object.init:\n%s", ir)
+	}
+}
+
+func TestInitializerDoesNotClashWithInitMethod(t *testing.T) {
+	ir := generate(t, `
+class A {
+    x : Int <- 1;
+    init(y : Int) : A { { x <- y; self; } };
+};
+class Main {
+    main() : Object { (new A).init(2) };
+};
+`)
+
+	for _, want := range []string{"define void @A.init(i8* %self)", "define i8* @A_init(i8* %self, i64 %y)"} {
+		if !strings.Contains(ir, want) {
+			t.Errorf("expected IR to contain %q:\n%s", want, ir)
+		}
+	}
+}
+
+func TestWhileReevaluatesWholeCondition(t *testing.T) {
+	ir := generate(t, `
+class A { done() : Bool { true }; };
+class Main {
+    a : A <- new A;
+    main() : Object { while not a.done() loop a <- new A pool };
+};
+`)
+
+	start := strings.Index(ir, "define i8* @Main_main(")
+	body := ir[start:]
+	body = body[:strings.Index(body, "\n}")]
+
+	// The body ends by jumping back to the start of the condition, where a
+	// is reloaded and checked for void, not into the middle of it.
+	if !strings.Contains(body, "br label %while_cond_") || strings.Contains(body, "br label %dispatch_") {
+		t.Errorf("expected the loop to branch back to its condition block:\n%s", body)
+	}
+}
+
+func TestStaticDispatchBoxesBasicReceivers(t *testing.T) {
+	output := run(t, `
+class Main inherits IO {
+    main() : Object { {
+        out_string(5@Object.type_name()).out_string(" ");
+        out_string(true@Object.copy().type_name()).out_string(" ");
+        out_string("abc"@Object.type_name()).out_string(" ");
+        case 7@Object.copy() of i : Int => out_int(i); esac;
+    } };
+};
+`)
+
+	if output != "Int Bool String 7" {
+		t.Errorf("expected %q, got %q", "Int Bool String 7", output)
+	}
+}
+
+func TestStringEqualityComparesContents(t *testing.T) {
+	ir := generate(t, `
+class Main {
+    main() : Object { "ab".substr(0, 1) = "a" };
+};
+`)
+
+	if !strings.Contains(ir, "call i32 @strcmp(") {
+		t.Errorf("expected strings to be compared with strcmp:\n%s", ir)
+	}
+	if strings.Contains(ir, "@Object.equal") {
+		t.Errorf("expected two Strings to be compared without boxing them:\n%s", ir)
+	}
+}
+
+func TestEqualityComparesBoxesByValue(t *testing.T) {
+	output := run(t, `
+class Main inherits IO {
+    test(b : Bool) : Object { out_string(if b then "1" else "0" fi) };
+    main() : Object {
+        let o : Object <- 5, p : Object <- 5, q : Object <- 6,
+            s : Object <- "x", u : Object <- "y".substr(0, 0).concat("x"),
+            t : Object <- true, m : Object <- self, v : Object in {
+            test(5 = o); test(o = 5); test(o = p); test(o = q);
+            test(s = u); test("x" = s); test(o = s); test(t = true);
+            test(m = self); test(m = new Main); test(v = o); test(v = v);
+            test("ab".substr(0, 1) = "a");
+        }
+    };
+};
+`)
+
+	if expected := "1110110110011"; output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
+
+func TestAssignmentToShadowingLocal(t *testing.T) {
+	output := run(t, `
+class Main inherits IO {
+    x : Object <- 1;
+    set(x : Object) : Object { x <- 2 };
+    main() : Object {
+        {
+            set(3);
+            let x : Object <- 4 in x <- 5;
+            out_int(case x of i : Int => i; esac);
+        }
+    };
+};
+`)
+
+	if output != "1" {
+		t.Errorf("expected the attribute to keep its value, got %q", output)
+	}
+}
+
+func TestTypeNameOfImportedClass(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"util.cl":     "class Point {};",
+		"sub/util.cl": "class Point {};",
+		"main.cl": `import util; import sub.util as S;
+class Main inherits IO {
+    main() : Object { {
+        out_string((new Point).type_name()).out_string(" ");
+        out_string((new S.Point).copy().type_name());
+    } };
+};`,
+	}
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	program, diags := preprocessor.New().ProcessFile(filepath.Join(dir, "main.cl"))
+	if len(diags) > 0 {
+		t.Fatalf("preprocessor errors: %v", diags)
+	}
+
+	// Classes keep their qualified names in IR symbols only
+	ir := generateProgram(t, program)
+	for _, want := range []string{"@util.Point_new", "@sub.util.Point.vtable"} {
+		if !strings.Contains(ir, want) {
+			t.Errorf("expected IR to contain %q", want)
+		}
+	}
+	if output := runIR(t, ir); output != "Point Point" {
+		t.Errorf("expected %q, got %q", "Point Point", output)
+	}
+}
+
+func TestGenerateRequiresTypes(t *testing.T) {
+	p := parser.New(lexer.NewLexer(strings.NewReader("class Main { main() : Object { 1 }; };")))
+	program := p.ParseProgram()
+	if _, err := New().Generate(program); err == nil || !strings.Contains(err.Error(), "SetTypes") {
+		t.Errorf("expected an error about missing static types, got %v", err)
+	}
+}
+
+func TestGenerateReportsUntypedExpression(t *testing.T) {
+	p := parser.New(lexer.NewLexer(strings.NewReader("class Main { main() : Object { 1 }; };")))
+	program := p.ParseProgram()
+	cg := New()
+	cg.SetTypes(ast.TypeTable{})
+	if _, err := cg.Generate(program); err == nil || !strings.Contains(err.Error(), "internal error: no static type") {
+		t.Errorf("expected an internal error about an untyped expression, got %v", err)
+	}
+}
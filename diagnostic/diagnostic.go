@@ -0,0 +1,140 @@
+package diagnostic
+
+import (
+	"coolz-compiler/lexer"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+type Severity int
+
+const (
+	Error Severity = iota
+	Warning
+	Note
+)
+
+func (s Severity) String() string {
+	return [...]string{"error", "warning", "note"}[s]
+}
+
+func (s Severity) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// Codes identify the kind of a diagnostic independently of its message.
+// Lexical, syntax and semantic errors have codes of their own, defined by
+// the phase that reports them, such as lexer.ErrUnterminatedString,
+// parser.ErrUnexpectedToken or semant.ErrTypeMismatch.
+const (
+	CodeIO      = "io"      // reading input or writing output failed
+	CodeImport  = "import"  // an import could not be resolved or loaded
+	CodeCodegen = "codegen" // LLVM IR generation failed
+	CodeLink    = "link"    // clang reported a problem with the IR
+	CodeUsage   = "usage"   // the driver was invoked incorrectly
+)
+
+// Diagnostic is a message from any phase of the compiler about the input.
+// Positions are 1-based; a zero Line means the diagnostic has no position
+// and a zero EndLine that its extent is unknown. The end position is
+// exclusive.
+type Diagnostic struct {
+	Severity  Severity `json:"severity"`
+	Code      string   `json:"code"`
+	File      string   `json:"file,omitempty"`
+	Line      int      `json:"line,omitempty"`
+	Column    int      `json:"column,omitempty"`
+	EndLine   int      `json:"end_line,omitempty"`
+	EndColumn int      `json:"end_column,omitempty"`
+	Message   string   `json:"message"`
+	Notes     []string `json:"notes,omitempty"`
+}
+
+// New returns an error diagnostic without a position.
+func New(code, file, format string, args ...interface{}) *Diagnostic {
+	return &Diagnostic{
+		Severity: Error,
+		Code:     code,
+		File:     file,
+		Message:  fmt.Sprintf(format, args...),
+	}
+}
+
+// At returns an error diagnostic spanning tok. The token's own file, if it
+// has one, takes precedence over file.
+func At(code, file string, tok lexer.Token, format string, args ...interface{}) *Diagnostic {
+	end := tok.End()
+	if end.Line == 0 && tok.Type != lexer.ERROR {
+		// A token made up by a later phase rather than read by the lexer
+		// spans its literal. Error tokens carry a message rather than the
+		// source text, so their extent is unknown.
+		end = lexer.Position{Line: tok.Line, Column: tok.Column + len(tok.Literal)}
+	}
+	return Span(code, file, tok.Pos(), end, format, args...)
+}
+
+// Span returns an error diagnostic covering the source from start up to
+// end, such as the extent of an AST node. The file of start, if it has
+// one, takes precedence over file.
+func Span(code, file string, start, end lexer.Position, format string, args ...interface{}) *Diagnostic {
+	if start.File != "" {
+		file = start.File
+	}
+	d := New(code, file, format, args...)
+	d.Line = start.Line
+	d.Column = start.Column
+	if end.Line > 0 {
+		d.EndLine = end.Line
+		d.EndColumn = end.Column
+	}
+	return d
+}
+
+// Error formats the diagnostic as file:line:col: message, omitting the
+// parts that are unknown. Warnings and notes are labelled as such.
+func (d *Diagnostic) Error() string {
+	pos := d.File
+	if d.Line > 0 {
+		if pos != "" {
+			pos += ":"
+		}
+		pos += fmt.Sprintf("%d:%d", d.Line, d.Column)
+	}
+
+	msg := d.Message
+	if d.Severity != Error {
+		msg = d.Severity.String() + ": " + msg
+	}
+	if pos != "" {
+		msg = pos + ": " + msg
+	}
+	for _, note := range d.Notes {
+		msg += "\n\tnote: " + note
+	}
+	return msg
+}
+
+// WriteJSON writes each diagnostic to w as a single line of JSON.
+func WriteJSON(w io.Writer, diags []*Diagnostic) error {
+	enc := json.NewEncoder(w)
+	for _, d := range diags {
+		if err := enc.Encode(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Lines splits tool output into one diagnostic per non-empty line.
+func Lines(severity Severity, code, output string) []*Diagnostic {
+	var diags []*Diagnostic
+	for _, line := range strings.Split(output, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		diags = append(diags, &Diagnostic{Severity: severity, Code: code, Message: line})
+	}
+	return diags
+}
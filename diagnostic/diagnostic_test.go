@@ -0,0 +1,78 @@
+package diagnostic
+
+import (
+	"bytes"
+	"coolz-compiler/lexer"
+	"testing"
+)
+
+func TestError(t *testing.T) {
+	tok := lexer.Token{Type: lexer.OBJECTID, Literal: "foo", Line: 3, Column: 7}
+
+	tests := []struct {
+		diag     *Diagnostic
+		expected string
+	}{
+		{At("undefined-identifier", "main.cl", tok, "undefined identifier %s", "foo"), "main.cl:3:7: undefined identifier foo"},
+		{At("type-mismatch", "", tok, "oops"), "3:7: oops"},
+		{New(CodeIO, "main.cl", "cannot read"), "main.cl: cannot read"},
+		{New(CodeUsage, "", "no input file provided"), "no input file provided"},
+		{&Diagnostic{Severity: Warning, Code: CodeLink, Message: "unused"}, "warning: unused"},
+		{&Diagnostic{Severity: Error, File: "a.cl", Line: 1, Column: 1, Message: "bad", Notes: []string{"see here"}}, "a.cl:1:1: bad\n\tnote: see here"},
+	}
+
+	for i, tt := range tests {
+		if got := tt.diag.Error(); got != tt.expected {
+			t.Errorf("test[%d]: expected %q, got %q", i, tt.expected, got)
+		}
+	}
+}
+
+func TestAtSpansToken(t *testing.T) {
+	d := At("unexpected-token", "main.cl", lexer.Token{Type: lexer.OBJECTID, Literal: "foo", Line: 3, Column: 7}, "x")
+	if d.EndLine != 3 || d.EndColumn != 10 {
+		t.Errorf("expected the diagnostic to end at 3:10, got %d:%d", d.EndLine, d.EndColumn)
+	}
+
+	d = At(string(lexer.ErrInvalidCharacter), "main.cl", lexer.Token{Type: lexer.ERROR, Code: lexer.ErrInvalidCharacter, Literal: "invalid character '$'", Line: 3, Column: 7}, "x")
+	if d.EndLine != 0 || d.EndColumn != 0 {
+		t.Errorf("expected an error token to have no extent, got %d:%d", d.EndLine, d.EndColumn)
+	}
+
+	// Tokens from the lexer know where they end, even if their literal is
+	// not their source text
+	tok := lexer.Token{Type: lexer.STR_CONST, Literal: "a\n", Line: 3, Column: 7, EndLine: 3, EndColumn: 13}
+	if d = At("type-mismatch", "main.cl", tok, "x"); d.EndLine != 3 || d.EndColumn != 13 {
+		t.Errorf("expected the diagnostic to end at 3:13, got %d:%d", d.EndLine, d.EndColumn)
+	}
+}
+
+func TestSpan(t *testing.T) {
+	start := lexer.Position{File: "lib.cl", Offset: 10, Line: 2, Column: 3}
+	end := lexer.Position{File: "lib.cl", Offset: 30, Line: 4, Column: 1}
+	d := Span("type-mismatch", "main.cl", start, end, "bad %s", "node")
+	if got := d.Error(); got != "lib.cl:2:3: bad node" {
+		t.Errorf("unexpected error %q", got)
+	}
+	if d.EndLine != 4 || d.EndColumn != 1 {
+		t.Errorf("expected the diagnostic to end at 4:1, got %d:%d", d.EndLine, d.EndColumn)
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	var buf bytes.Buffer
+	diags := []*Diagnostic{
+		At("undefined-identifier", "main.cl", lexer.Token{Type: lexer.OBJECTID, Literal: "x", Line: 2, Column: 5}, "undefined identifier x"),
+		{Severity: Warning, Code: CodeLink, Message: "clang says hi", Notes: []string{"a note"}},
+	}
+	if err := WriteJSON(&buf, diags); err != nil {
+		t.Fatalf("WriteJSON failed: %v", err)
+	}
+
+	expected := `{"severity":"error","code":"undefined-identifier","file":"main.cl","line":2,"column":5,"end_line":2,"end_column":6,"message":"undefined identifier x"}
+{"severity":"warning","code":"link","message":"clang says hi","notes":["a note"]}
+`
+	if got := buf.String(); got != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+}
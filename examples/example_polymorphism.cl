@@ -55,6 +55,12 @@ class Main inherits IO{
             out_string(dog.speak());
             out_string(cat.speak());
             out_string(bird.speak());
+
+            -- The static type is Animal, the overriding method still runs
+            animal <- new Parrot;
+            out_string(animal.speak());
+            animal <- new Goldfish;
+            out_string(animal.speak());
         }
     };
 };
\ No newline at end of file
@@ -0,0 +1,296 @@
+// Package incremental compiles a program one module at a time. Each module
+// becomes its own LLVM IR file plus an interface file, and a module whose
+// source and dependencies are unchanged is reused from the cache instead
+// of being compiled again. The IR files are linked into one executable.
+package incremental
+
+import (
+	"coolz-compiler/ast"
+	"coolz-compiler/codegen"
+	"coolz-compiler/diagnostic"
+	"coolz-compiler/preprocessor"
+	"coolz-compiler/semant"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Unit is one module of a build.
+type Unit struct {
+	File   string // The module's source file
+	Module string // Name qualifying its classes, empty for the root file
+	IR     string // The LLVM IR file to link
+	Reused bool   // Whether the cached IR was up to date
+}
+
+// Builder compiles a root file and the modules it imports into a cache
+// directory. Modules are found through the preprocessor and named the same
+// way it names them, so the classes and symbols of a separately compiled
+// program match those of the program the preprocessor merges.
+//
+// A module is reused if its cached interface was written by the same
+// compiler for the same source, its imports still resolve to the same
+// files, and their signatures are those it was compiled against. Otherwise
+// it is parsed and checked against the interfaces of the modules it
+// imports, whose sources are not read again.
+type Builder struct {
+	cacheDir string
+	prep     *preprocessor.Preprocessor
+	compiler string
+	logger   *log.Logger
+	root     string
+	built    map[string]*Interface // Interfaces of the modules built so far, by module key
+	loading  []string              // Files being built, outermost first
+	units    []Unit
+}
+
+// New returns a builder that writes to cacheDir and resolves imports with
+// prep.
+func New(cacheDir string, prep *preprocessor.Preprocessor) *Builder {
+	return &Builder{
+		cacheDir: cacheDir,
+		prep:     prep,
+		built:    make(map[string]*Interface),
+	}
+}
+
+// SetCompiler identifies the build of the compiler. Modules cached by a
+// different one are compiled again.
+func (b *Builder) SetCompiler(id string) {
+	b.compiler = id
+}
+
+// SetLogger enables tracing of semantic analysis. A nil logger disables it.
+func (b *Builder) SetLogger(logger *log.Logger) {
+	b.logger = logger
+}
+
+// Build compiles filename, whose content is given, and the modules it
+// imports. It returns every module in link order, imported modules first.
+func (b *Builder) Build(filename string, content []byte) ([]Unit, []*diagnostic.Diagnostic) {
+	if err := os.MkdirAll(b.cacheDir, 0755); err != nil {
+		return nil, []*diagnostic.Diagnostic{diagnostic.New(diagnostic.CodeIO, b.cacheDir, "%v", err)}
+	}
+	b.root = filename
+	if _, diags := b.build(filename, "", content); len(diags) > 0 {
+		return nil, diags
+	}
+	return b.units, nil
+}
+
+// build compiles one module, or reuses it, after the modules it imports.
+func (b *Builder) build(filename, name string, content []byte) (*Interface, []*diagnostic.Diagnostic) {
+	b.loading = append(b.loading, filename)
+	defer func() { b.loading = b.loading[:len(b.loading)-1] }()
+
+	key := preprocessor.ModuleKey(filename)
+	sum := sha256.Sum256(content)
+	source := hex.EncodeToString(sum[:])
+	irFile, interfaceFile := b.cachePaths(filename, name, key)
+
+	if cached := readInterface(interfaceFile); cached != nil {
+		reused, diags := b.reuse(cached, filename, name, source, irFile)
+		if len(diags) > 0 {
+			return nil, diags
+		}
+		if reused {
+			b.built[key] = cached
+			b.units = append(b.units, Unit{File: filename, Module: name, IR: irFile, Reused: true})
+			return cached, nil
+		}
+	}
+
+	program, diags := preprocessor.Parse(filename, content)
+	if len(diags) > 0 {
+		return nil, diags
+	}
+	root := filename == b.root
+	classes := program.Classes
+	if !root {
+		classes = preprocessor.ModuleClasses(program)
+	}
+	own := preprocessor.NewModule(name, preprocessor.ClassNames(classes))
+
+	iface := &Interface{
+		Version:  formatVersion,
+		Compiler: b.compiler,
+		Module:   name,
+		File:     filename,
+		Source:   source,
+		Main:     root,
+	}
+	var imported []*Interface
+	var modules []*preprocessor.Module
+	for _, imp := range program.Imports {
+		dep, errs := b.buildImport(filename, imp)
+		if len(errs) > 0 {
+			diags = append(diags, errs...)
+			continue
+		}
+		imported = append(imported, dep)
+		modules = append(modules, dep.module())
+		iface.Imports = append(iface.Imports, Import{Module: imp.Module.Value, File: dep.File, Signature: dep.Signature})
+	}
+	if len(diags) > 0 {
+		return nil, diags
+	}
+	if errs := preprocessor.Resolve(filename, own, classes, program.Imports, modules); len(errs) > 0 {
+		return nil, errs
+	}
+
+	// The classes of every module this one depends on, directly or not,
+	// are known from their interfaces, since they may appear in the
+	// signatures of the imported classes.
+	program = &ast.Program{Imports: program.Imports}
+	for _, dep := range b.dependencies(imported) {
+		program.Classes = append(program.Classes, dep.stubs()...)
+	}
+	program.Classes = append(program.Classes, classes...)
+
+	sa := semant.NewSemanticAnalyser()
+	sa.SetFilename(filename)
+	sa.SetLibrary(!root)
+	sa.SetLogger(b.logger)
+	sa.Analyze(program)
+	if len(sa.Errors()) > 0 {
+		return nil, sa.Errors()
+	}
+
+	cg := codegen.New()
+	cg.SetTypes(sa.Types())
+	cg.SetFilename(filename)
+	cg.SetLibrary(!root)
+	module, err := cg.Generate(program)
+	if err != nil {
+		return nil, []*diagnostic.Diagnostic{diagnostic.New(diagnostic.CodeCodegen, filename, "%v", err)}
+	}
+
+	// The vtables of imported classes are laid out again from their
+	// signatures, and dispatch through them relies on the layout their
+	// own module chose.
+	for _, dep := range imported {
+		for _, class := range dep.Classes {
+			if strings.Join(cg.VtableSlots(class.Name), " ") != strings.Join(class.Vtable, " ") {
+				return nil, []*diagnostic.Diagnostic{diagnostic.New(diagnostic.CodeCodegen, filename,
+					"vtable of %s does not match the interface in %s", class.Name, dep.File)}
+			}
+		}
+	}
+
+	for _, class := range classes {
+		iface.Classes = append(iface.Classes, classSignature(class, cg.VtableSlots(class.Name.Value)))
+	}
+	iface.Signature = iface.signature()
+
+	data, err := json.MarshalIndent(iface, "", "  ")
+	if err != nil {
+		return nil, []*diagnostic.Diagnostic{diagnostic.New(diagnostic.CodeIO, interfaceFile, "%v", err)}
+	}
+	// The IR goes first: an interface only ever describes IR that exists.
+	for _, out := range []struct {
+		file string
+		data []byte
+	}{{irFile, []byte(module.String())}, {interfaceFile, append(data, '\n')}} {
+		if err := writeFile(out.file, out.data); err != nil {
+			return nil, []*diagnostic.Diagnostic{diagnostic.New(diagnostic.CodeIO, out.file, "%v", err)}
+		}
+	}
+
+	b.built[key] = iface
+	b.units = append(b.units, Unit{File: filename, Module: name, IR: irFile})
+	return iface, nil
+}
+
+// buildImport builds the module imp of filename refers to, reporting
+// problems at the import declaration.
+func (b *Builder) buildImport(filename string, imp *ast.Import) (*Interface, []*diagnostic.Diagnostic) {
+	moduleFile, content, err := b.prep.Find(filename, imp)
+	if err != nil {
+		return nil, []*diagnostic.Diagnostic{err}
+	}
+	if err := preprocessor.CheckCycle(b.loading, filename, imp, moduleFile); err != nil {
+		return nil, []*diagnostic.Diagnostic{err}
+	}
+	key := preprocessor.ModuleKey(moduleFile)
+	if iface, ok := b.built[key]; ok {
+		return iface, nil
+	}
+	return b.build(moduleFile, b.prep.UniqueName(imp.Module.Value, key), content)
+}
+
+// reuse reports whether the module described by cached can be linked as
+// is. The modules it imports are built first, so that their signatures can
+// be compared with the ones it was compiled against. If they cannot be
+// found any more, the module is compiled again to report why.
+func (b *Builder) reuse(cached *Interface, filename, name, source, irFile string) (bool, []*diagnostic.Diagnostic) {
+	if cached.Compiler != b.compiler || cached.Source != source || cached.Module != name ||
+		cached.Main != (filename == b.root) {
+		return false, nil
+	}
+	if _, err := os.Stat(irFile); err != nil {
+		return false, nil
+	}
+	for _, recorded := range cached.Imports {
+		// The import is only as written, so errors have no position; the
+		// recompiled module reports them at the declaration instead.
+		imp := &ast.Import{Module: &ast.ObjectIdentifier{Value: recorded.Module}}
+		moduleFile, _, err := b.prep.Find(filename, imp)
+		if err != nil || moduleFile != recorded.File || preprocessor.CheckCycle(b.loading, filename, imp, moduleFile) != nil {
+			return false, nil
+		}
+		dep, diags := b.buildImport(filename, imp)
+		if len(diags) > 0 {
+			return false, diags
+		}
+		if dep.Signature != recorded.Signature {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// dependencies returns imported and every module they depend on, each
+// once, with a module's dependencies before it.
+func (b *Builder) dependencies(imported []*Interface) []*Interface {
+	var deps []*Interface
+	seen := make(map[string]bool)
+	var visit func(iface *Interface)
+	visit = func(iface *Interface) {
+		key := preprocessor.ModuleKey(iface.File)
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+		for _, imp := range iface.Imports {
+			visit(b.built[preprocessor.ModuleKey(imp.File)])
+		}
+		deps = append(deps, iface)
+	}
+	for _, iface := range imported {
+		visit(iface)
+	}
+	return deps
+}
+
+// cachePaths returns where the IR and interface of the module at key go.
+// The file names start with the module name, or the root file's name, for
+// the benefit of people looking at the cache.
+func (b *Builder) cachePaths(filename, name, key string) (string, string) {
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+	}
+	name = strings.Map(func(r rune) rune {
+		if r == '.' || r == '-' || r == '_' || r == '#' || 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' {
+			return r
+		}
+		return '_'
+	}, name)
+	sum := sha256.Sum256([]byte(key))
+	base := filepath.Join(b.cacheDir, fmt.Sprintf("%s-%x", name, sum[:4]))
+	return base + ".ll", base + ".coolzi"
+}
@@ -0,0 +1,153 @@
+package incremental
+
+import (
+	"coolz-compiler/preprocessor"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeFiles creates the given files in dir.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// build builds main.cl in dir with a fresh builder, as separate runs of the
+// compiler would, and returns the compiled modules' files.
+func build(t *testing.T, dir, cache string) []string {
+	t.Helper()
+	filename := filepath.Join(dir, "main.cl")
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	units, diags := New(cache, preprocessor.New()).Build(filename, content)
+	if len(diags) > 0 {
+		t.Fatalf("unexpected errors: %v", diags)
+	}
+	var compiled []string
+	for _, unit := range units {
+		if _, err := os.Stat(unit.IR); err != nil {
+			t.Errorf("missing IR for %s: %v", unit.File, err)
+		}
+		if !unit.Reused {
+			compiled = append(compiled, filepath.Base(unit.File))
+		}
+	}
+	return compiled
+}
+
+func TestUnchangedModulesAreReused(t *testing.T) {
+	dir, cache := t.TempDir(), t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"shapes.cl": "class Shape { area() : Int { 0 }; };",
+		"square.cl": "import shapes;\nclass Square inherits Shape { side : Int; area() : Int { side * side }; };",
+		"other.cl":  "class Other {};",
+		"main.cl":   "import square; import other;\nclass Main { main() : Object { (new Square).area() }; };",
+	})
+
+	tests := []struct {
+		name     string
+		files    map[string]string
+		compiled string
+	}{
+		{"First Build", nil, "shapes.cl square.cl other.cl main.cl"},
+		{"No Change", nil, ""},
+		{
+			"Method Body",
+			map[string]string{"shapes.cl": "class Shape { area() : Int { 1 }; };"},
+			"shapes.cl",
+		},
+		{
+			"Method Signature",
+			map[string]string{"shapes.cl": "class Shape { area() : Int { 1 }; name() : String { \"\" }; };"},
+			"shapes.cl square.cl main.cl",
+		},
+		{
+			"Root File",
+			map[string]string{"main.cl": "import square; import other;\nclass Main { main() : Object { 0 }; };"},
+			"main.cl",
+		},
+	}
+	for _, tt := range tests {
+		writeFiles(t, dir, tt.files)
+		if got := strings.Join(build(t, dir, cache), " "); got != tt.compiled {
+			t.Errorf("%s: expected to compile %q, got %q", tt.name, tt.compiled, got)
+		}
+	}
+}
+
+func TestInterface(t *testing.T) {
+	dir, cache := t.TempDir(), t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"util.cl": `class Base { f() : Int { 0 }; };
+class Util inherits Base { n : Int; g(x : Util, y : Int) : Base { self }; f() : Int { 1 }; };
+class Main { main() : Object { 0 }; };`,
+		"main.cl": "from util import Util;\nclass Main { main() : Object { new Util }; };",
+	})
+	build(t, dir, cache)
+
+	_, interfaceFile := New(cache, nil).cachePaths(filepath.Join(dir, "util.cl"), "util", preprocessor.ModuleKey(filepath.Join(dir, "util.cl")))
+	iface := readInterface(interfaceFile)
+	if iface == nil {
+		t.Fatalf("no interface at %s", interfaceFile)
+	}
+	if iface.Module != "util" || iface.Main {
+		t.Errorf("expected module util without an entry point, got %q, %v", iface.Module, iface.Main)
+	}
+
+	// The Main class of an imported module is dropped, and the names are
+	// qualified as they are in the merged program.
+	expected := []Class{
+		{
+			Name:    "util.Base",
+			Methods: []Method{{Name: "f", Type: "Int"}},
+			Vtable:  []string{"abort", "type_name", "copy", "f"},
+		},
+		{
+			Name:       "util.Util",
+			Parent:     "util.Base",
+			Attributes: []Formal{{"n", "Int"}},
+			Methods: []Method{
+				{Name: "g", Formals: []Formal{{"x", "util.Util"}, {"y", "Int"}}, Type: "util.Base"},
+				{Name: "f", Type: "Int"},
+			},
+			Vtable: []string{"abort", "type_name", "copy", "f", "g"},
+		},
+	}
+	if !reflect.DeepEqual(iface.Classes, expected) {
+		t.Errorf("expected classes %+v, got %+v", expected, iface.Classes)
+	}
+
+	// Importing modules see the classes through their stubs
+	stubs := iface.stubs()
+	if len(stubs) != 2 || !stubs[1].External || stubs[1].Parent.Value != "util.Base" || len(stubs[1].Features) != 3 {
+		t.Errorf("unexpected stubs %+v", stubs)
+	}
+}
+
+func TestErrorsInModules(t *testing.T) {
+	dir, cache := t.TempDir(), t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"util.cl": "class Util { f() : Int { \"one\" }; };",
+		"main.cl": "import util;\nclass Main { main() : Object { new Util }; };",
+	})
+
+	filename := filepath.Join(dir, "main.cl")
+	content, _ := os.ReadFile(filename)
+	_, diags := New(cache, preprocessor.New()).Build(filename, content)
+	if len(diags) != 1 {
+		t.Fatalf("expected 1 error, got %v", diags)
+	}
+	expected := filepath.Join(dir, "util.cl") + ":1:14: method f expects return type Int, got String"
+	if got := diags[0].Error(); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
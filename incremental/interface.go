@@ -0,0 +1,177 @@
+package incremental
+
+import (
+	"coolz-compiler/ast"
+	"coolz-compiler/lexer"
+	"coolz-compiler/preprocessor"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// formatVersion changes whenever the layout of interface files does, so
+// that files written by an older compiler are rebuilt.
+const formatVersion = 1
+
+// Interface describes a compiled module to the modules that import it: the
+// signatures of its classes and the layout of their vtables. It is written
+// next to the module's LLVM IR as a .coolzi file.
+type Interface struct {
+	Version   int      `json:"version"`
+	Compiler  string   `json:"compiler,omitempty"` // Build of the compiler that wrote it
+	Module    string   `json:"module"`             // Qualifies the classes, empty for the root file
+	File      string   `json:"file"`
+	Source    string   `json:"source"` // SHA-256 of the file's content
+	Main      bool     `json:"main"`   // Compiled as the root file, with an entry point
+	Imports   []Import `json:"imports"`
+	Classes   []Class  `json:"classes"`
+	Signature string   `json:"signature"` // See signature
+}
+
+// Import records the module an import declaration resolved to and the
+// signature it had, which the importing module was compiled against.
+type Import struct {
+	Module    string `json:"module"` // As written in the import declaration
+	File      string `json:"file"`
+	Signature string `json:"signature"`
+}
+
+// Class is the signature of a class with qualified type names.
+type Class struct {
+	Name       string   `json:"name"`
+	Parent     string   `json:"parent,omitempty"`
+	Attributes []Formal `json:"attributes"`
+	Methods    []Method `json:"methods"`
+	Vtable     []string `json:"vtable"` // Method slots, inherited ones first
+}
+
+type Method struct {
+	Name    string   `json:"name"`
+	Formals []Formal `json:"formals"`
+	Type    string   `json:"type"`
+}
+
+type Formal struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// classSignature returns the signature of class, whose names have been
+// resolved, with the vtable slots the code generator laid out for it.
+func classSignature(class *ast.Class, vtable []string) Class {
+	c := Class{Name: class.Name.Value, Vtable: vtable}
+	if class.Parent != nil {
+		c.Parent = class.Parent.Value
+	}
+	for _, feature := range class.Features {
+		switch f := feature.(type) {
+		case *ast.Attribute:
+			c.Attributes = append(c.Attributes, Formal{f.Name.Value, f.Type.Value})
+		case *ast.Method:
+			m := Method{Name: f.Name.Value, Type: f.Type.Value}
+			for _, formal := range f.Formals {
+				m.Formals = append(m.Formals, Formal{formal.Name.Value, formal.Type.Value})
+			}
+			c.Methods = append(c.Methods, m)
+		}
+	}
+	return c
+}
+
+// signature hashes what importing modules depend on: the module name, the
+// class signatures and, since classes may inherit across modules, the
+// signatures of the imported modules. Changing a method body leaves it
+// unchanged.
+func (i *Interface) signature() string {
+	h := sha256.New()
+	json.NewEncoder(h).Encode(struct {
+		Module  string
+		Classes []Class
+	}{i.Module, i.Classes})
+	for _, imp := range i.Imports {
+		h.Write([]byte(imp.Signature))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// module returns the namespace the interface's classes form for name
+// resolution in importing files.
+func (i *Interface) module() *preprocessor.Module {
+	declared := make([]string, len(i.Classes))
+	for j, class := range i.Classes {
+		declared[j] = strings.TrimPrefix(class.Name, i.Module+".")
+	}
+	return preprocessor.NewModule(i.Module, declared)
+}
+
+// stubs returns the classes of the interface as External classes, which
+// the semantic analyser and code generator accept in place of the source.
+// Their tokens point at the module's file.
+func (i *Interface) stubs() []*ast.Class {
+	tok := lexer.Token{Type: lexer.TYPEID, File: i.File}
+	typeID := func(name string) *ast.TypeIdentifier {
+		t := tok
+		t.Literal = name
+		return &ast.TypeIdentifier{Token: t, Value: name}
+	}
+	objectID := func(name string) *ast.ObjectIdentifier {
+		t := tok
+		t.Type, t.Literal = lexer.OBJECTID, name
+		return &ast.ObjectIdentifier{Token: t, Value: name}
+	}
+
+	classes := make([]*ast.Class, len(i.Classes))
+	for j, c := range i.Classes {
+		class := &ast.Class{Token: tok, Name: typeID(c.Name), External: true}
+		if c.Parent != "" {
+			class.Parent = typeID(c.Parent)
+		}
+		for _, a := range c.Attributes {
+			class.Features = append(class.Features, &ast.Attribute{Name: objectID(a.Name), Type: typeID(a.Type)})
+		}
+		for _, m := range c.Methods {
+			method := &ast.Method{Name: objectID(m.Name), Type: typeID(m.Type)}
+			for _, f := range m.Formals {
+				method.Formals = append(method.Formals, &ast.Formal{Name: objectID(f.Name), Type: typeID(f.Type)})
+			}
+			class.Features = append(class.Features, method)
+		}
+		classes[j] = class
+	}
+	return classes
+}
+
+// readInterface loads the interface at path, returning nil if there is
+// none or it cannot be used.
+func readInterface(path string) *Interface {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var i Interface
+	if err := json.Unmarshal(data, &i); err != nil || i.Version != formatVersion {
+		return nil
+	}
+	return &i
+}
+
+// writeFile replaces path with data. The content is written to a
+// temporary file first so that a concurrent build never reads half of it.
+func writeFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".coolz-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
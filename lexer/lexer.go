@@ -2,6 +2,7 @@ package lexer
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"strconv"
@@ -37,6 +38,7 @@ const (
 	SELF      // Add SELF token type
 	SELF_TYPE // Add SELF_TYPE token type
 	VOID      // Add VOID token type
+	IMPORT
 
 	// Data types
 	STR_CONST
@@ -71,51 +73,186 @@ const (
 
 func (tt TokenType) String() string {
 	return [...]string{"EOF", "ERROR", "CLASS", "INHERITS", "ISVOID", "IF", "ELSE", "FI", "THEN", "LET", "IN", "WHILE", "CASE", "ESAC", "LOOP", "POOL",
-		"NEW", "OF", "NOT", "SELF", "SELF_TYPE", "VOID", // Add VOID to string mapping
+		"NEW", "OF", "NOT", "SELF", "SELF_TYPE", "VOID", "IMPORT",
 		"STR_CONST", "BOOL_CONST", "INT_CONST", "TYPEID", "OBJECTID", "ASSIGN", "DARROW", "LT", "LE", "EQ", "PLUS", "MINUS", "TIMES",
 		"DIVIDE", "LPAREN", "RPAREN", "LBRACE", "RBRACE", "SEMI", "COLON", "COMMA", "DOT", "AT", "NEG"}[tt]
 }
 
-// Token represents a lexical token with its type, value, and position.
+// ErrorCode identifies the lexical error an ERROR token reports. The codes
+// are also those of the diagnostics reporting the errors.
+type ErrorCode string
+
+// The lexical errors of the COOL manual, section 10.
+const (
+	ErrStringTooLong      ErrorCode = "string-too-long"      // a string constant of more than 1024 characters
+	ErrNullInString       ErrorCode = "null-in-string"       // a string constant containing the null character
+	ErrUnterminatedString ErrorCode = "unterminated-string"  // a newline in a string constant
+	ErrEOFInString        ErrorCode = "eof-in-string"        // the input ends in a string constant
+	ErrEOFInComment       ErrorCode = "eof-in-comment"       // the input ends in a (* comment
+	ErrUnmatchedComment   ErrorCode = "unmatched-comment"    // a *) outside of any comment
+	ErrInvalidCharacter   ErrorCode = "invalid-character"    // a character that starts no token
+	ErrIntegerOutOfRange  ErrorCode = "integer-out-of-range" // an integer constant that does not fit an Int
+)
+
+// maxStringLength is the longest a string constant may be, in characters
+// after escapes are replaced.
+const maxStringLength = 1024
+
+// intBits is the width of Int in the generated code.
+const intBits = 64
+
+// Position is a location in a source file. Offset counts bytes from the
+// start of the file; Line and Column are 1-based and Column counts
+// characters. A zero Line means the position is unknown.
+type Position struct {
+	File   string
+	Offset int
+	Line   int
+	Column int
+}
+
+// TriviaKind is the kind of a piece of trivia.
+type TriviaKind int
+
+const (
+	Whitespace   TriviaKind = iota // A run of whitespace other than newlines
+	Newline                        // A single newline
+	LineComment                    // A -- comment, up to the end of its line
+	BlockComment                   // A (* *) comment, including nested ones
+)
+
+func (k TriviaKind) String() string {
+	return [...]string{"Whitespace", "Newline", "LineComment", "BlockComment"}[k]
+}
+
+// Trivia is source text between tokens that has no meaning to the parser.
+type Trivia struct {
+	Kind TriviaKind
+	Text string
+}
+
+// Token represents a lexical token with its type, value, and the span of
+// source it was read from, from its first character up to but excluding
+// the character after it. File names the source file the token was read
+// from, if it is known, so that positions stay meaningful once modules are
+// merged. An ERROR token has a Code, and its Literal is the message.
+//
+// In trivia mode a token also has its source text and the trivia around
+// it. A token's trailing trivia runs up to and including the end of its
+// line, and everything after that up to the next token is the next
+// token's leading trivia, so every byte of the input belongs to exactly
+// one token.
 type Token struct {
-	Type    TokenType
-	Literal string
-	Line    int
-	Column  int
+	Type      TokenType
+	Literal   string
+	Code      ErrorCode
+	File      string
+	Offset    int
+	Line      int
+	Column    int
+	EndOffset int
+	EndLine   int
+	EndColumn int
+	Text      string
+	Leading   []Trivia
+	Trailing  []Trivia
+}
+
+// Pos returns the position of the token's first character.
+func (t Token) Pos() Position {
+	return Position{File: t.File, Offset: t.Offset, Line: t.Line, Column: t.Column}
 }
 
-// Lexer is the lexical analyzer.
+// End returns the position just past the token's last character.
+func (t Token) End() Position {
+	return Position{File: t.File, Offset: t.EndOffset, Line: t.EndLine, Column: t.EndColumn}
+}
+
+// Lexer is the lexical analyzer. The position fields are those of char,
+// the next character to be tokenized.
 type Lexer struct {
-	reader *bufio.Reader
-	line   int
-	column int
-	char   rune
+	input    io.Reader
+	reader   *bufio.Reader
+	filename string
+	offset   int
+	line     int
+	column   int // 0 until the first character is read
+	char     rune
+	size     int // Bytes of char in the input, 0 at the end
+
+	trivia    bool
+	source    bytes.Buffer // The input read so far, in trivia mode
+	collected []Trivia     // Trivia skipped since the last token
+	unclosed  Position     // Start of a comment left open by trailing trivia
 }
 
 // NewLexer creates a new lexer from an io.Reader
 func NewLexer(reader io.Reader) *Lexer {
-	l := &Lexer{
+	return &Lexer{
+		input:  reader,
 		reader: bufio.NewReader(reader),
 		line:   1,
-		column: 0,
-		char:   ' ',
 	}
-	return l
 }
 
-// readChar reads the next character from the input.
-func (l *Lexer) readChar() {
-	var err error
-	l.char, _, err = l.reader.ReadRune()
-	if err != nil {
-		l.char = 0 // EOF
+// SetFilename sets the file name recorded in every token.
+func (l *Lexer) SetFilename(filename string) {
+	l.filename = filename
+}
+
+// SetTrivia turns trivia mode on or off. In trivia mode every token keeps
+// its source text and the whitespace and comments around it, so that the
+// input can be reproduced from the tokens. It must be called before the
+// first token is read.
+func (l *Lexer) SetTrivia(keep bool) {
+	l.trivia = keep
+	if keep {
+		l.reader = bufio.NewReader(io.TeeReader(l.input, &l.source))
+	} else {
+		l.reader = bufio.NewReader(l.input)
 	}
+}
+
+// KeepsTrivia reports whether the lexer is in trivia mode.
+func (l *Lexer) KeepsTrivia() bool {
+	return l.trivia
+}
 
-	l.column++
+// readChar advances to the next character of the input. At the end of the
+// input char is 0 and the position stays put.
+func (l *Lexer) readChar() {
+	if l.size == 0 && l.column > 0 {
+		return
+	}
 	if l.char == '\n' {
 		l.line++
-		l.column = 0
+		l.column = 1
+	} else {
+		l.column++
 	}
+	l.offset += l.size
+
+	var err error
+	l.char, l.size, err = l.reader.ReadRune()
+	if err != nil {
+		l.char, l.size = 0, 0 // EOF
+	}
+}
+
+// atEOF reports whether the input is exhausted. A null character in the
+// input is also read as char 0, but it has a size.
+func (l *Lexer) atEOF() bool {
+	return l.size == 0
+}
+
+// pos returns the position of char.
+func (l *Lexer) pos() Position {
+	return Position{File: l.filename, Offset: l.offset, Line: l.line, Column: l.column}
+}
+
+// text returns the input between two offsets, in trivia mode.
+func (l *Lexer) text(start, end int) string {
+	return string(l.source.Bytes()[start:end])
 }
 
 // peekChar returns the next character without advancing the stream.
@@ -128,43 +265,67 @@ func (l *Lexer) peekChar() rune {
 	return char
 }
 
-// skipWhiteSpace skips whitespace characters and comments.
-func (l *Lexer) skipWhiteSpace() {
+// skipWhiteSpace skips whitespace characters and comments, collecting
+// them in trivia mode. Trailing trivia stops after the first newline. If
+// the input ends in a (* comment, it returns where the comment starts;
+// otherwise the returned position has a zero Line.
+func (l *Lexer) skipWhiteSpace(trailing bool) Position {
 	for unicode.IsSpace(l.char) || l.char == '-' || l.char == '(' {
+		start := l.pos()
+		var kind TriviaKind
 		if l.char == '-' && l.peekChar() == '-' {
 			// Single line comment
-			for l.char != '\n' && l.char != 0 {
+			kind = LineComment
+			for l.char != '\n' && !l.atEOF() {
 				l.readChar()
 			}
 		} else if l.char == '(' && l.peekChar() == '*' {
 			// Multi-line comment
+			kind = BlockComment
 			l.readChar() // consume '('
 			l.readChar() // consume '*'
-			l.skipMultiLineComment()
-		} else if unicode.IsSpace(l.char) {
+			if !l.skipMultiLineComment() {
+				return start
+			}
+		} else if l.char == '\n' {
+			kind = Newline
 			l.readChar()
+		} else if unicode.IsSpace(l.char) {
+			kind = Whitespace
+			for unicode.IsSpace(l.char) && l.char != '\n' {
+				l.readChar()
+			}
 		} else {
 			break
 		}
+		if l.trivia {
+			l.collected = append(l.collected, Trivia{Kind: kind, Text: l.text(start.Offset, l.offset)})
+		}
+		if trailing && kind == Newline {
+			break
+		}
 	}
+	return Position{}
 }
 
-// skipMultiLineComment skips over multi-line comments, handling nested comments.
-func (l *Lexer) skipMultiLineComment() {
+// skipMultiLineComment skips over the rest of a multi-line comment whose
+// opening (* has been consumed, handling nested comments. It reports
+// whether the comment is closed before the end of the input.
+func (l *Lexer) skipMultiLineComment() bool {
 	nesting := 1
 	for nesting > 0 {
-		l.readChar()
-		if l.char == 0 {
-			return // EOF
+		if l.atEOF() {
+			return false
 		} else if l.char == '(' && l.peekChar() == '*' {
 			nesting++
-			l.readChar() // consume '*'
+			l.readChar() // consume '('
 		} else if l.char == '*' && l.peekChar() == ')' {
 			nesting--
-			l.readChar() // consume ')'
+			l.readChar() // consume '*'
 		}
+		l.readChar()
 	}
-	l.readChar() // consume the final ')'
+	return true
 }
 
 func (l *Lexer) readNumber() string {
@@ -194,69 +355,112 @@ func (l *Lexer) readIdentifier() string {
 	return sb.String()
 }
 
-func (l *Lexer) readString() (string, error) {
+// readString reads a string constant. A string that is too long or
+// contains a null character is still read up to its closing quote, while
+// one that is unterminated ends before the newline, so that lexing resumes
+// at the next line.
+func (l *Lexer) readString() Token {
 	var sb strings.Builder
-	l.readChar()
+	var code ErrorCode
+	length := 0
+	l.readChar() // consume the opening quote
 	for l.char != '"' {
-		if l.char == 0 {
-			return "", fmt.Errorf("EOF in string constant")
+		if l.atEOF() {
+			return Token{Type: ERROR, Code: ErrEOFInString, Literal: "EOF in string constant"}
 		}
 		if l.char == '\n' {
-			return "", fmt.Errorf("unterminated string constant")
+			return Token{Type: ERROR, Code: ErrUnterminatedString, Literal: "unterminated string constant"}
 		}
 
-		if l.char == '\\' {
+		char := l.char
+		if char == '\\' {
 			l.readChar()
+			if l.atEOF() {
+				continue
+			}
 			switch l.char {
 			case 'b':
-				sb.WriteRune('\b')
+				char = '\b'
 			case 't':
-				sb.WriteRune('\t')
+				char = '\t'
 			case 'n':
-				sb.WriteRune('\n')
+				char = '\n'
 			case 'f':
-				sb.WriteRune('\f')
-			case '\\':
-				sb.WriteRune('\\')
-			case '"':
-				sb.WriteRune('"')
-			case '0':
-				sb.WriteRune(0)
+				char = '\f'
 			default:
-				sb.WriteRune(l.char)
+				// Any other escaped character, including a newline,
+				// stands for itself.
+				char = l.char
 			}
-		} else {
-			sb.WriteRune(l.char)
 		}
-
+		length++
+		if char == 0 && code == "" {
+			code = ErrNullInString
+		} else if length > maxStringLength && code == "" {
+			code = ErrStringTooLong
+		}
+		sb.WriteRune(char)
 		l.readChar()
 	}
+	l.readChar() // consume the closing quote
 
-	l.readChar()
-	return sb.String(), nil
+	switch code {
+	case ErrNullInString:
+		return Token{Type: ERROR, Code: code, Literal: "string constant contains null character"}
+	case ErrStringTooLong:
+		return Token{Type: ERROR, Code: code, Literal: fmt.Sprintf("string constant longer than %d characters", maxStringLength)}
+	}
+	return Token{Type: STR_CONST, Literal: sb.String()}
 }
 
+// NextToken returns the next token of the input. At the end of the input
+// it keeps returning EOF.
 func (l *Lexer) NextToken() Token {
-	l.skipWhiteSpace()
-
-	tok := Token{
-		Line:   l.line,
-		Column: l.column,
+	if l.column == 0 {
+		l.readChar()
+	}
+	var tok Token
+	start := l.unclosed
+	if start.Line == 0 {
+		start = l.skipWhiteSpace(false)
+	}
+	l.unclosed = Position{}
+	if start.Line != 0 {
+		tok = Token{Type: ERROR, Code: ErrEOFInComment, Literal: "EOF in comment"}
+	} else {
+		start = l.pos()
+		tok = l.readToken()
+	}
+	end := l.pos()
+	tok.File = l.filename
+	tok.Offset, tok.Line, tok.Column = start.Offset, start.Line, start.Column
+	tok.EndOffset, tok.EndLine, tok.EndColumn = end.Offset, end.Line, end.Column
+	if l.trivia {
+		tok.Text = l.text(start.Offset, end.Offset)
+		tok.Leading, l.collected = l.collected, nil
+		l.unclosed = l.skipWhiteSpace(true)
+		tok.Trailing, l.collected = l.collected, nil
 	}
+	return tok
+}
 
+// readToken reads the token starting at char.
+func (l *Lexer) readToken() Token {
+	var tok Token
 	switch {
 	// Handle number literals first
 	case unicode.IsDigit(l.char):
 		num := l.readNumber()
-		if _, err := strconv.Atoi(num); err != nil {
+		if _, err := strconv.ParseInt(num, 10, intBits); err != nil {
 			tok.Type = ERROR
-			tok.Literal = "Number out of range"
+			tok.Code = ErrIntegerOutOfRange
+			tok.Literal = fmt.Sprintf("integer constant %s out of range", num)
 		} else {
 			tok.Type = INT_CONST
 			tok.Literal = num
 		}
 		return tok
-	case l.char == 0:
+	case l.atEOF():
 		tok.Type = EOF
 		tok.Literal = ""
 	case l.char == '(':
@@ -292,8 +496,15 @@ func (l *Lexer) NextToken() Token {
 		tok.Literal = "+"
 		l.readChar()
 	case l.char == '*':
-		tok.Type = TIMES
-		tok.Literal = "*"
+		if l.peekChar() == ')' {
+			tok.Type = ERROR
+			tok.Code = ErrUnmatchedComment
+			tok.Literal = "unmatched *)"
+			l.readChar()
+		} else {
+			tok.Type = TIMES
+			tok.Literal = "*"
+		}
 		l.readChar()
 	case l.char == '-':
 		tok.Type = MINUS
@@ -344,14 +555,7 @@ func (l *Lexer) NextToken() Token {
 			l.readChar()
 		}
 	case l.char == '"':
-		str, err := l.readString()
-		if err != nil {
-			tok.Type = ERROR
-			tok.Literal = err.Error()
-		} else {
-			tok.Type = STR_CONST
-			tok.Literal = str
-		}
+		tok = l.readString()
 	case isIdentifierStart(l.char):
 		identifier := l.readIdentifier()
 		tok.Literal = identifier
@@ -393,18 +597,28 @@ func (l *Lexer) NextToken() Token {
 			tok.Type = NOT
 		case "void":
 			tok.Type = VOID
+		case "import":
+			tok.Type = IMPORT
 		case "true", "false":
 			tok.Type = BOOL_CONST
 		default:
 			if unicode.IsUpper(rune(identifier[0])) {
 				tok.Type = TYPEID
+				// A type qualified by a module alias, such as L.List, is a
+				// single token. Plain COOL never has a type name after a
+				// dot, only a method name.
+				for l.char == '.' && unicode.IsUpper(l.peekChar()) {
+					l.readChar()
+					tok.Literal += "." + l.readIdentifier()
+				}
 			} else {
 				tok.Type = OBJECTID // 'self' falls here
 			}
 		}
 	default:
 		tok.Type = ERROR
-		tok.Literal = fmt.Sprintf("Unexpected character: %c", l.char)
+		tok.Code = ErrInvalidCharacter
+		tok.Literal = fmt.Sprintf("invalid character %q", l.char)
 		l.readChar()
 	}
 
@@ -1,6 +1,7 @@
 package lexer
 
 import (
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -46,6 +47,16 @@ func TestNextToken(t *testing.T) {
 			[]TokenType{CASE, OBJECTID, OF, OBJECTID, COLON, TYPEID, DARROW, BOOL_CONST, ESAC, EOF},
 			[]string{"case", "a", "of", "b", ":", "B", "=>", "false", "esac", ""},
 		},
+		{
+			"import util; import Other;",
+			[]TokenType{IMPORT, OBJECTID, SEMI, IMPORT, TYPEID, SEMI, EOF},
+			[]string{"import", "util", ";", "import", "Other", ";", ""},
+		},
+		{
+			"x : L.List <- new A.init();",
+			[]TokenType{OBJECTID, COLON, TYPEID, ASSIGN, NEW, TYPEID, DOT, OBJECTID, LPAREN, RPAREN, SEMI, EOF},
+			[]string{"x", ":", "L.List", "<-", "new", "A", ".", "init", "(", ")", ";", ""},
+		},
 		{
 			"(* This is a multi-line comment *) class Main {};",
 			[]TokenType{CLASS, TYPEID, LBRACE, RBRACE, SEMI, EOF},
@@ -121,3 +132,155 @@ func TestNextToken(t *testing.T) {
 		}
 	}
 }
+
+func TestTokenSpans(t *testing.T) {
+	input := "class A {\n\tx : L.List <- \"é\\n\"; -- é\n(* (* *) *)y};"
+	tests := []struct {
+		literal string
+		start   Position
+		end     Position
+	}{
+		{"class", Position{Offset: 0, Line: 1, Column: 1}, Position{Offset: 5, Line: 1, Column: 6}},
+		{"A", Position{Offset: 6, Line: 1, Column: 7}, Position{Offset: 7, Line: 1, Column: 8}},
+		{"{", Position{Offset: 8, Line: 1, Column: 9}, Position{Offset: 9, Line: 1, Column: 10}},
+		{"x", Position{Offset: 11, Line: 2, Column: 2}, Position{Offset: 12, Line: 2, Column: 3}},
+		{":", Position{Offset: 13, Line: 2, Column: 4}, Position{Offset: 14, Line: 2, Column: 5}},
+		{"L.List", Position{Offset: 15, Line: 2, Column: 6}, Position{Offset: 21, Line: 2, Column: 12}},
+		{"<-", Position{Offset: 22, Line: 2, Column: 13}, Position{Offset: 24, Line: 2, Column: 15}},
+		// Offsets count bytes and columns characters; the span covers the
+		// quotes and escapes that the literal leaves out
+		{"é\n", Position{Offset: 25, Line: 2, Column: 16}, Position{Offset: 31, Line: 2, Column: 21}},
+		{";", Position{Offset: 31, Line: 2, Column: 21}, Position{Offset: 32, Line: 2, Column: 22}},
+		{"y", Position{Offset: 50, Line: 3, Column: 12}, Position{Offset: 51, Line: 3, Column: 13}},
+		{"}", Position{Offset: 51, Line: 3, Column: 13}, Position{Offset: 52, Line: 3, Column: 14}},
+		{";", Position{Offset: 52, Line: 3, Column: 14}, Position{Offset: 53, Line: 3, Column: 15}},
+		{"", Position{Offset: 53, Line: 3, Column: 15}, Position{Offset: 53, Line: 3, Column: 15}},
+		{"", Position{Offset: 53, Line: 3, Column: 15}, Position{Offset: 53, Line: 3, Column: 15}},
+	}
+
+	l := NewLexer(strings.NewReader(input))
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Literal != tt.literal {
+			t.Fatalf("token %d: expected literal %q, got %q", i, tt.literal, tok.Literal)
+		}
+		if tok.Pos() != tt.start || tok.End() != tt.end {
+			t.Errorf("token %d (%q): expected %+v-%+v, got %+v-%+v", i, tok.Literal, tt.start, tt.end, tok.Pos(), tok.End())
+		}
+		if tt.literal != "" && tt.literal != "é\n" && input[tok.Offset:tok.EndOffset] != tt.literal {
+			t.Errorf("token %d: offsets select %q, expected %q", i, input[tok.Offset:tok.EndOffset], tt.literal)
+		}
+	}
+}
+
+func TestLexicalErrors(t *testing.T) {
+	long := strings.Repeat("a", maxStringLength)
+	tests := []struct {
+		name     string
+		input    string
+		expected []Token // Type, Code and, for tokens that are not errors, Literal
+	}{
+		{"String Of Maximum Length", `"` + long + `"`, []Token{{Type: STR_CONST, Literal: long}}},
+		{"String Too Long", `"` + long + `b" x`, []Token{{Type: ERROR, Code: ErrStringTooLong}, {Type: OBJECTID, Literal: "x"}}},
+		{"Escapes Count Once", `"` + strings.Repeat(`\n`, maxStringLength) + `"`, []Token{{Type: STR_CONST, Literal: strings.Repeat("\n", maxStringLength)}}},
+		{"Null Character", "\"a\x00b\" x", []Token{{Type: ERROR, Code: ErrNullInString}, {Type: OBJECTID, Literal: "x"}}},
+		{"Escaped Null Character", "\"a\\\x00\" x", []Token{{Type: ERROR, Code: ErrNullInString}, {Type: OBJECTID, Literal: "x"}}},
+		{"Escaped Zero", `"\0"`, []Token{{Type: STR_CONST, Literal: "0"}}},
+		{"Escaped Newline", "\"a\\\nb\"", []Token{{Type: STR_CONST, Literal: "a\nb"}}},
+		{"Unterminated String", "\"abc x y\nz", []Token{{Type: ERROR, Code: ErrUnterminatedString}, {Type: OBJECTID, Literal: "z"}}},
+		{"EOF In String", `"abc`, []Token{{Type: ERROR, Code: ErrEOFInString}}},
+		{"EOF After Escape", `"abc\`, []Token{{Type: ERROR, Code: ErrEOFInString}}},
+		{"EOF In Comment", "x (* a (* b *) c", []Token{{Type: OBJECTID, Literal: "x"}, {Type: ERROR, Code: ErrEOFInComment}}},
+		{"Comment Closed Right Away", "(**) x", []Token{{Type: OBJECTID, Literal: "x"}}},
+		{"Unmatched Comment", "x *) y", []Token{{Type: OBJECTID, Literal: "x"}, {Type: ERROR, Code: ErrUnmatchedComment}, {Type: OBJECTID, Literal: "y"}}},
+		{"Line Comment Hides Unmatched", "x -- *)\ny", []Token{{Type: OBJECTID, Literal: "x"}, {Type: OBJECTID, Literal: "y"}}},
+		{"Invalid Characters", "a $ [ \x00 b", []Token{{Type: OBJECTID, Literal: "a"}, {Type: ERROR, Code: ErrInvalidCharacter}, {Type: ERROR, Code: ErrInvalidCharacter}, {Type: ERROR, Code: ErrInvalidCharacter}, {Type: OBJECTID, Literal: "b"}}},
+		{"Largest Int", "9223372036854775807", []Token{{Type: INT_CONST, Literal: "9223372036854775807"}}},
+		{"Int Out Of Range", "9223372036854775808 x", []Token{{Type: ERROR, Code: ErrIntegerOutOfRange}, {Type: OBJECTID, Literal: "x"}}},
+	}
+
+	for _, tt := range tests {
+		l := NewLexer(strings.NewReader(tt.input))
+		for i, expected := range append(tt.expected, Token{Type: EOF}) {
+			tok := l.NextToken()
+			if tok.Type != expected.Type || tok.Code != expected.Code || tok.Type != ERROR && tok.Literal != expected.Literal {
+				t.Errorf("%s: token %d: expected %v %q %q, got %v %q %q", tt.name, i,
+					expected.Type, expected.Code, expected.Literal, tok.Type, tok.Code, tok.Literal)
+				break
+			}
+		}
+	}
+}
+
+func TestErrorTokenSpans(t *testing.T) {
+	input := "x \"abc\ny (* open"
+	l := NewLexer(strings.NewReader(input))
+	l.NextToken()
+	for _, expected := range []string{"\"abc", "y", "(* open"} {
+		tok := l.NextToken()
+		if got := input[tok.Offset:tok.EndOffset]; got != expected {
+			t.Errorf("expected %s token to span %q, got %q", tok.Type, expected, got)
+		}
+	}
+}
+
+func TestTrivia(t *testing.T) {
+	input := "-- header\n\nclass A { -- trailing\n  (* block\n  *) x : Int;\t\n};  "
+	l := NewLexer(strings.NewReader(input))
+	l.SetTrivia(true)
+
+	tests := []struct {
+		text     string
+		leading  []Trivia
+		trailing []Trivia
+	}{
+		{"class", []Trivia{{LineComment, "-- header"}, {Newline, "\n"}, {Newline, "\n"}}, []Trivia{{Whitespace, " "}}},
+		{"A", nil, []Trivia{{Whitespace, " "}}},
+		{"{", nil, []Trivia{{Whitespace, " "}, {LineComment, "-- trailing"}, {Newline, "\n"}}},
+		{"x", []Trivia{{Whitespace, "  "}, {BlockComment, "(* block\n  *)"}, {Whitespace, " "}}, []Trivia{{Whitespace, " "}}},
+		{":", nil, []Trivia{{Whitespace, " "}}},
+		{"Int", nil, nil},
+		{";", nil, []Trivia{{Whitespace, "\t"}, {Newline, "\n"}}},
+		{"}", nil, nil},
+		{";", nil, []Trivia{{Whitespace, "  "}}},
+		{"", nil, nil},
+	}
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Text != tt.text || !reflect.DeepEqual(tok.Leading, tt.leading) || !reflect.DeepEqual(tok.Trailing, tt.trailing) {
+			t.Errorf("token %d: expected %q with %v and %v, got %q with %v and %v",
+				i, tt.text, tt.leading, tt.trailing, tok.Text, tok.Leading, tok.Trailing)
+		}
+	}
+}
+
+func TestTriviaCoversInput(t *testing.T) {
+	inputs := []string{
+		"",
+		"  \n",
+		"class Main { s : String <- \"a\\n\\\"b\"; };\r\n",
+		"x -- no newline at the end",
+		"x (* unclosed on the same line\n",
+		"x\n(* unclosed on the next line",
+		"\"unterminated\nx *) $ \xff 99999999999999999999",
+	}
+	for _, input := range inputs {
+		l := NewLexer(strings.NewReader(input))
+		l.SetTrivia(true)
+		var sb strings.Builder
+		for {
+			tok := l.NextToken()
+			for _, trivia := range [][]Trivia{tok.Leading, {{Text: tok.Text}}, tok.Trailing} {
+				for _, t := range trivia {
+					sb.WriteString(t.Text)
+				}
+			}
+			if tok.Type == EOF {
+				break
+			}
+		}
+		if sb.String() != input {
+			t.Errorf("expected the tokens to reproduce %q, got %q", input, sb.String())
+		}
+	}
+}
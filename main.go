@@ -1,17 +1,28 @@
 package main
 
 import (
+	"bytes"
 	"coolz-compiler/codegen"
+	"coolz-compiler/diagnostic"
+	"coolz-compiler/incremental"
 	"coolz-compiler/lexer"
 	"coolz-compiler/parser"
 	"coolz-compiler/preprocessor"
+	"coolz-compiler/semant"
 	"flag"
 	"fmt"
+	"io"
+	"log"
 	"os"
+	"path/filepath"
 	"strings"
+
+	"github.com/llir/llvm/ir"
 )
 
-const (
+// The colors are cleared by disableColor when output is not going to a
+// terminal or the user asked for plain output.
+var (
 	colorReset  = "\033[0m"
 	colorGreen  = "\033[32m"
 	colorYellow = "\033[33m"
@@ -22,6 +33,11 @@ const (
 	colorOrange = "\033[38;5;208m"
 )
 
+func disableColor() {
+	colorReset, colorGreen, colorYellow, colorBlue = "", "", "", ""
+	colorRed, colorCyan, colorPurple, colorOrange = "", "", "", ""
+}
+
 const coolzBanner = `
   ..|'''.|  ..|''||    ..|''||   '||'      |'''''||  
 .|'     '  .|'    ||  .|'    ||   ||           .|'   
@@ -38,116 +54,549 @@ const coolzBanner = `
                            ''''                               
 `
 
+// console receives everything the driver prints. Like other compilers it
+// is stderr, so stdout is left to --emit dumps and `coolz run` programs.
+var console io.Writer = os.Stderr
+
+// showProgress enables the banner, the per-phase progress messages and the
+// success summary. It is set by -v.
+var showProgress = false
+
+// quiet suppresses everything but errors.
+var quiet = false
+
+// traceSemant sends the semantic analyser's trace to stderr. It is set by
+// -v, unless --diagnostics=json keeps the console to diagnostics.
+var traceSemant = false
+
+// jsonDiagnostics selects --diagnostics=json: diagnostics are written to
+// the console as JSON lines and nothing else is printed there.
+var jsonDiagnostics = false
+
+// pathEnv names the environment variable listing extra module directories,
+// separated like PATH.
+const pathEnv = "COOLZ_PATH"
+
+// includePaths are searched for imported modules after the importing
+// file's directory: the -I directories in order, then those in $COOLZ_PATH.
+var includePaths []string
+
 func printStep(step string, color string) {
-	fmt.Printf("%s╔══════════════════════════════════════════════════╗%s\n", color, colorReset)
-	fmt.Printf("%s║ %s%-48s%s %s\n", color, step, "", colorReset, colorReset)
-	fmt.Printf("%s╚══════════════════════════════════════════════════╝%s\n", color, colorReset)
+	if !showProgress {
+		return
+	}
+	fmt.Fprintf(console, "%s╔══════════════════════════════════════════════════╗%s\n", color, colorReset)
+	fmt.Fprintf(console, "%s║ %s%-48s%s %s\n", color, step, "", colorReset, colorReset)
+	fmt.Fprintf(console, "%s╚══════════════════════════════════════════════════╝%s\n", color, colorReset)
 }
 
 func printSuccess(msg string) {
-	fmt.Printf("%s✓ %s%s\n", colorGreen, msg, colorReset)
+	if !showProgress {
+		return
+	}
+	fmt.Fprintf(console, "%s✓ %s%s\n", colorGreen, msg, colorReset)
 }
 
 func printError(msg string) {
-	fmt.Printf("%s✗ %s%s\n", colorRed, msg, colorReset)
+	fmt.Fprintf(console, "%s✗ %s%s\n", colorRed, msg, colorReset)
+}
+
+func printDetail(msg string) {
+	fmt.Fprintf(console, "%s• %s%s\n", colorYellow, msg, colorReset)
 }
 
 func printBanner() {
+	if !showProgress {
+		return
+	}
 	for _, line := range strings.Split(coolzBanner, "\n") {
-		fmt.Println(line)
+		fmt.Fprintln(console, line)
+	}
+}
+
+// printDone reports the file a successful compile produced.
+func printDone(msg, output string) {
+	if !showProgress {
+		return
+	}
+	fmt.Fprintf(console, "\n%s✨ %s%s\n", colorGreen, msg, colorReset)
+	fmt.Fprintf(console, "Output file: %s%s%s\n", colorCyan, output, colorReset)
+}
+
+// report prints diags under a header line, or as JSON lines when
+// --diagnostics=json is in effect. With --quiet only errors are printed.
+func report(header string, diags []*diagnostic.Diagnostic) {
+	if quiet {
+		var errors []*diagnostic.Diagnostic
+		for _, d := range diags {
+			if d.Severity == diagnostic.Error {
+				errors = append(errors, d)
+			}
+		}
+		if len(errors) == 0 {
+			return
+		}
+		diags = errors
+	}
+	if jsonDiagnostics {
+		diagnostic.WriteJSON(console, diags)
+		return
+	}
+	if header != "" {
+		printError(header)
+	}
+	for _, d := range diags {
+		printDetail(d.Error())
+	}
+}
+
+// cleanup runs before fail exits, e.g. to remove `coolz run`'s temporary
+// build directory.
+var cleanup = func() {}
+
+// fail reports diags and exits with status 1.
+func fail(header string, diags ...*diagnostic.Diagnostic) {
+	report(header, diags)
+	cleanup()
+	os.Exit(1)
+}
+
+// usageError reports a problem with the command line, followed by the
+// usage text when diagnostics are human-readable.
+func usageError(format string, args ...interface{}) {
+	report("", []*diagnostic.Diagnostic{diagnostic.New(diagnostic.CodeUsage, "", format, args...)})
+	if !jsonDiagnostics {
+		fmt.Fprintln(console, usage)
+	}
+	os.Exit(1)
+}
+
+const usage = `Usage: coolz [options] [-o output.ll] [--emit=tokens|ast|typed-ast|ir] <input.cl>
+       coolz build [options] [-O level] [-clang path] [-cache dir] [-o executable] <input.cl>
+       coolz run [options] [-O level] [-clang path] [-cache dir] <input.cl> [args...]
+
+Options: -v, --quiet, --color=auto|always|never, --diagnostics=text|json,
+         -I dir (repeatable; also $COOLZ_PATH)
+
+Use - as the input file to read the COOL source from stdin.`
+
+// commonFlags holds the options every mode accepts.
+type commonFlags struct {
+	verbose     *bool
+	quiet       *bool
+	color       *string
+	diagnostics *string
+	includes    *pathList
+}
+
+// pathList collects the values of a flag that may be repeated, like -I.
+type pathList []string
+
+func (l *pathList) String() string {
+	return strings.Join(*l, string(os.PathListSeparator))
+}
+
+func (l *pathList) Set(dir string) error {
+	*l = append(*l, dir)
+	return nil
+}
+
+func addCommonFlags(fs *flag.FlagSet) commonFlags {
+	cf := commonFlags{
+		verbose:     fs.Bool("v", false, "Show each compilation phase and trace semantic analysis"),
+		quiet:       fs.Bool("quiet", false, "Print errors only"),
+		color:       fs.String("color", "auto", "Colorize output: auto, always or never"),
+		diagnostics: fs.String("diagnostics", "text", "Diagnostics format: text or json"),
+		includes:    &pathList{},
 	}
+	fs.Var(cf.includes, "I", "Add a directory to search for imported modules (repeatable)")
+	return cf
+}
+
+// apply validates the parsed common flags and configures the driver's
+// output accordingly.
+func (cf commonFlags) apply() {
+	switch *cf.color {
+	case "always":
+	case "never":
+		disableColor()
+	case "auto":
+		if !colorTerminal(console) {
+			disableColor()
+		}
+	default:
+		disableColor()
+		usageError("unknown color mode %q (want auto, always or never)", *cf.color)
+	}
+
+	switch *cf.diagnostics {
+	case "text":
+	case "json":
+		jsonDiagnostics = true
+		disableColor()
+	default:
+		usageError("unknown diagnostics format %q (want text or json)", *cf.diagnostics)
+	}
+
+	quiet = *cf.quiet
+	showProgress = *cf.verbose && !quiet && !jsonDiagnostics
+	traceSemant = *cf.verbose && !quiet && !jsonDiagnostics
+	includePaths = append(*cf.includes, filepath.SplitList(os.Getenv(pathEnv))...)
+}
+
+// colorTerminal reports whether w is a terminal that should get colors:
+// NO_COLOR (https://no-color.org) and TERM=dumb turn them off.
+func colorTerminal(w io.Writer) bool {
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
 }
 
 func main() {
+	switch command, arguments := splitCommand(os.Args[1:]); command {
+	case "build":
+		runBuild(arguments)
+		return
+	case "run":
+		runRun(arguments)
+		return
+	}
+
 	// Define flags
 	outputFile := flag.String("o", "output.ll", "Output LLVM IR file name")
-	flag.Parse()
+	emit := flag.String("emit", "", "Stop after a phase and print its result: tokens, ast, typed-ast or ir")
+	cf := addCommonFlags(flag.CommandLine)
+	flag.CommandLine.Parse(normalizeFlags(flag.CommandLine, os.Args[1:]))
+	cf.apply()
 
 	// Check if input file is provided
 	args := flag.Args()
 	if len(args) < 1 {
-		printError("No input file provided")
-		fmt.Println("Usage: coolz [-o output.ll] <input.cl>")
+		usageError("no input file provided")
+	}
+
+	if *emit != "" {
+		runEmit(args[0], *emit, *outputFile)
+		return
+	}
+
+	module := compile(args[0], "", nil)
+
+	// Write LLVM IR to file
+	irString := module.String()
+	if err := os.WriteFile(*outputFile, []byte(irString), 0644); err != nil {
+		fail("Failed to write LLVM IR to file", diagnostic.New(diagnostic.CodeIO, *outputFile, "%v", err))
+	}
+
+	printDone("LLVM IR generated successfully", *outputFile)
+}
+
+// nativeFlags holds the options shared by `coolz build` and `coolz run`.
+type nativeFlags struct {
+	commonFlags
+	optLevel *string
+	clang    *string
+	cache    *string
+}
+
+func addNativeFlags(fs *flag.FlagSet) nativeFlags {
+	return nativeFlags{
+		commonFlags: addCommonFlags(fs),
+		optLevel:    fs.String("O", "0", "Optimization level passed to clang (0, 1, 2, 3, s or z)"),
+		clang:       fs.String("clang", "", "Path to clang (default: $COOLZ_CLANG, then clang on PATH)"),
+		cache:       fs.String("cache", "", "Directory for compiled modules (default: $COOLZ_CACHE, then the user cache directory)"),
+	}
+}
+
+// parseNativeFlags parses arguments into fs and returns the remaining
+// positional arguments, exiting with the usage message when the input file
+// is missing. clang is resolved here so that a missing toolchain is
+// reported before any compilation work.
+func parseNativeFlags(fs *flag.FlagSet, nf nativeFlags, arguments []string) ([]string, string) {
+	fs.Parse(normalizeFlags(fs, arguments))
+	nf.apply()
+
+	args := fs.Args()
+	if len(args) < 1 {
+		usageError("no input file provided")
+	}
+	if !validOptLevel(*nf.optLevel) {
+		usageError("invalid optimization level -O%s", *nf.optLevel)
+	}
+
+	clang, err := findClang(*nf.clang)
+	if err != nil {
+		fail("Cannot build executable", diagnostic.New(diagnostic.CodeLink, "", "%v", err))
+	}
+	return args, clang
+}
+
+// runBuild implements `coolz build`: it compiles the input and each module
+// it imports to LLVM IR and hands the modules to clang to produce a native
+// executable.
+func runBuild(arguments []string) {
+	fs := flag.NewFlagSet("build", flag.ExitOnError)
+	outputFile := fs.String("o", "", "Output executable name (default: input name without .cl)")
+	nf := addNativeFlags(fs)
+	args, clang := parseNativeFlags(fs, nf, arguments)
+	cache, err := cacheDir(*nf.cache)
+	if err != nil {
+		fail("Cannot build executable", diagnostic.New(diagnostic.CodeIO, "", "%v", err))
+	}
+
+	output := *outputFile
+	if output == "" {
+		output = defaultExecutableName(args[0])
+	}
+
+	irFiles := compileModules(args[0], cache)
+	if !link(clang, irFiles, output, *nf.optLevel) {
 		os.Exit(1)
 	}
 
+	printDone("Executable built successfully", output)
+}
+
+// runRun implements `coolz run`: it builds the input into a temporary
+// executable, runs it with the remaining arguments and the driver's
+// stdin/stdout/stderr, and exits with the program's status. The modules are
+// compiled into the same temporary directory unless -cache names one.
+func runRun(arguments []string) {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	nf := addNativeFlags(fs)
+	fs.Lookup("cache").Usage = "Directory for compiled modules (default: a temporary directory removed after the run)"
+	args, clang := parseNativeFlags(fs, nf, arguments)
+
+	dir, err := os.MkdirTemp("", "coolz-run-")
+	if err != nil {
+		fail("Cannot create temporary directory", diagnostic.New(diagnostic.CodeIO, "", "%v", err))
+	}
+	cleanup = func() { os.RemoveAll(dir) }
+	cache := *nf.cache
+	if cache == "" {
+		cache = dir
+	}
+
+	irFiles := compileModules(args[0], cache)
+	output := filepath.Join(dir, defaultExecutableName(args[0]))
+	if !link(clang, irFiles, output, *nf.optLevel) {
+		cleanup()
+		os.Exit(1)
+	}
+
+	status, err := execute(output, args[1:])
+	cleanup()
+	if err != nil {
+		fail("Failed to run program", diagnostic.New(diagnostic.CodeIO, "", "%v", err))
+	}
+	os.Exit(status)
+}
+
+// link builds the LLVM IR files into output with clang, reporting clang's
+// stderr as diagnostics. It returns false if the executable could not be
+// built.
+func link(clang string, irFiles []string, output, optLevel string) bool {
+	printStep("NATIVE CODE GENERATION", colorGreen)
+	warnings, err := buildExecutable(clang, irFiles, output, optLevel)
+	if err != nil {
+		diags := []*diagnostic.Diagnostic{diagnostic.New(diagnostic.CodeLink, "", "%v", err)}
+		if cerr, ok := err.(*clangError); ok {
+			diags = cerr.diagnostics()
+		}
+		report("Native code generation failed", diags)
+		return false
+	}
+	if len(warnings) > 0 {
+		report("", diagnostic.Lines(diagnostic.Warning, diagnostic.CodeLink, warnings))
+	}
+	return true
+}
+
+// Stages that --emit can stop after.
+const (
+	emitTokens   = "tokens"
+	emitAST      = "ast"
+	emitTypedAST = "typed-ast"
+	emitIR       = "ir"
+)
+
+// runEmit implements --emit: it runs the pipeline up to stage and prints
+// that stage's result to stdout, or to the -o file if one was given.
+func runEmit(filename, stage, outputFile string) {
+	switch stage {
+	case emitTokens, emitAST, emitTypedAST, emitIR:
+	default:
+		usageError("unknown --emit stage %q (want tokens, ast, typed-ast or ir)", stage)
+	}
+
+	var dump strings.Builder
+	if module := compile(filename, stage, &dump); module != nil {
+		dump.WriteString(module.String())
+	}
+
+	outputSet := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "o" {
+			outputSet = true
+		}
+	})
+	if !outputSet {
+		fmt.Print(dump.String())
+		return
+	}
+	if err := os.WriteFile(outputFile, []byte(dump.String()), 0644); err != nil {
+		fail("Failed to write output file", diagnostic.New(diagnostic.CodeIO, outputFile, "%v", err))
+	}
+}
+
+// dumpTokens writes one token per line with its span, up to and including
+// EOF.
+func dumpTokens(w io.Writer, l *lexer.Lexer) {
+	for {
+		tok := l.NextToken()
+		fmt.Fprintf(w, "%d:%d-%d:%d\t%s\t%q\n", tok.Line, tok.Column, tok.EndLine, tok.EndColumn, tok.Type, tok.Literal)
+		if tok.Type == lexer.EOF {
+			return
+		}
+	}
+}
+
+// compile runs the front end and code generator on filename, reporting each
+// step as it goes. A filename of "-" reads the source from stdin. Any error
+// is reported and terminates the process.
+//
+// If stop names an --emit stage before ir, compile writes that stage's
+// result to dump and returns nil instead of generating code.
+func compile(filename string, stop string, dump io.Writer) *ir.Module {
 	// Print banner
 	printBanner()
 
 	// Read input file
 	printStep("FILE READ", colorBlue)
-	fmt.Printf("Processing file: %s%s%s\n", colorYellow, args[0], colorReset)
-	file, err := os.Open(args[0])
-	if err != nil {
-		printError("Failed to open input file")
-		fmt.Println(err)
-		os.Exit(1)
+	content, name, err := readSource(filename)
+	if showProgress {
+		fmt.Fprintf(console, "Processing file: %s%s%s\n", colorYellow, name, colorReset)
 	}
-	defer file.Close()
-	printSuccess("Input file loaded successfully")
-
-	// Preprocess imports
-	printStep("PREPROCESSING", colorBlue)
-	prep := preprocessor.New()
-	processedContent, err := prep.ProcessFile(args[0])
 	if err != nil {
-		printError("Preprocessing failed")
-		fmt.Println(err)
-		os.Exit(1)
+		fail("Failed to open input file", diagnostic.New(diagnostic.CodeIO, name, "%v", err))
 	}
-	printSuccess("Imports processed successfully")
+	printSuccess("Input file loaded successfully")
 
 	// Lexing
-	printStep("LEXICAL ANALYSIS", colorPurple)
-	l := lexer.NewLexer(strings.NewReader(processedContent))
-	printSuccess("Tokens generated successfully")
+	if stop == emitTokens {
+		dumpTokens(dump, lexer.NewLexer(bytes.NewReader(content)))
+		return nil
+	}
 
-	// Parsing
+	// Parsing, including the imported modules
 	printStep("SYNTAX ANALYSIS", colorOrange)
-	p := parser.New(l)
-	program := p.ParseProgram()
-
-	// Print parser errors
-	if len(p.Errors()) > 0 {
-		printError("Parser errors detected")
-		for _, err := range p.Errors() {
-			fmt.Printf("%s• %s%s\n", colorYellow, err, colorReset)
-		}
-		os.Exit(1)
+	prep := preprocessor.New()
+	for _, dir := range includePaths {
+		prep.AddIncludePath(dir)
+	}
+	program, diags := prep.ProcessSource(name, content)
+	if len(diags) > 0 {
+		fail("Parsing failed", diags...)
 	}
 	printSuccess("Syntax analysis completed")
+	if stop == emitAST {
+		io.WriteString(dump, parser.SerializeProgram(program))
+		return nil
+	}
 
 	// Semantic Analysis
 	printStep("SEMANTIC ANALYSIS", colorCyan)
-	// sa := semant.NewSemanticAnalyser()
-	// sa.Analyze(program)
-	// if len(sa.Errors()) > 0 {
-	// 	printError("Semantic analysis errors detected")
-	// 	for _, err := range sa.Errors() {
-	// 		fmt.Printf("%s• %s%s\n", colorYellow, err, colorReset)
-	// 	}
-	// 	os.Exit(1)
-	// }
+	sa := semant.NewSemanticAnalyser()
+	sa.SetFilename(name)
+	if traceSemant {
+		sa.SetLogger(log.New(os.Stderr, "semant: ", 0))
+	}
+	sa.Analyze(program)
+	if len(sa.Errors()) > 0 {
+		fail("Semantic analysis errors detected", sa.Errors()...)
+	}
 	printSuccess("Semantic analysis completed")
+	if stop == emitTypedAST {
+		io.WriteString(dump, parser.SerializeTypedProgram(program, sa.Types()))
+		return nil
+	}
 
 	// Generate code
 	printStep("LLVM IR GENERATION", colorCyan)
 	cg := codegen.New()
+	cg.SetTypes(sa.Types())
+	cg.SetFilename(name)
 	module, err := cg.Generate(program)
 	if err != nil {
-		printError("Code generation failed")
-		fmt.Println(err)
-		os.Exit(1)
+		fail("Code generation failed", diagnostic.New(diagnostic.CodeCodegen, name, "%v", err))
 	}
 
-	// Write LLVM IR to file
-	irString := module.String()
-	if err := os.WriteFile(*outputFile, []byte(irString), 0644); err != nil {
-		printError("Failed to write LLVM IR to file")
-		fmt.Println(err)
-		os.Exit(1)
+	return module
+}
+
+// compileModules compiles filename and the modules it imports separately
+// into the cache directory and returns their LLVM IR files in link order.
+// Modules that have not changed since they were cached are not compiled
+// again. Any error is reported and terminates the process.
+func compileModules(filename, cache string) []string {
+	printBanner()
+
+	printStep("FILE READ", colorBlue)
+	content, name, err := readSource(filename)
+	if showProgress {
+		fmt.Fprintf(console, "Processing file: %s%s%s\n", colorYellow, name, colorReset)
+	}
+	if err != nil {
+		fail("Failed to open input file", diagnostic.New(diagnostic.CodeIO, name, "%v", err))
 	}
+	printSuccess("Input file loaded successfully")
 
-	fmt.Printf("\n%s✨ LLVM IR generated successfully%s\n", colorGreen, colorReset)
-	fmt.Printf("Output file: %s%s%s\n", colorCyan, *outputFile, colorReset)
+	printStep("MODULE COMPILATION", colorCyan)
+	prep := preprocessor.New()
+	for _, dir := range includePaths {
+		prep.AddIncludePath(dir)
+	}
+	b := incremental.New(cache, prep)
+	b.SetCompiler(compilerID())
+	if traceSemant {
+		b.SetLogger(log.New(os.Stderr, "semant: ", 0))
+	}
+	units, diags := b.Build(name, content)
+	if len(diags) > 0 {
+		fail("Compilation failed", diags...)
+	}
+
+	irFiles := make([]string, len(units))
+	for i, unit := range units {
+		if unit.Reused {
+			printSuccess(fmt.Sprintf("Up to date: %s", unit.File))
+		} else {
+			printSuccess(fmt.Sprintf("Compiled %s", unit.File))
+		}
+		irFiles[i] = unit.IR
+	}
+	return irFiles
+}
+
+// stdinName is how source read from stdin is named in diagnostics.
+const stdinName = "<stdin>"
+
+// readSource returns the content of filename, or of stdin when filename is
+// "-", along with the name to use for it in diagnostics.
+func readSource(filename string) ([]byte, string, error) {
+	if filename == "-" {
+		content, err := io.ReadAll(os.Stdin)
+		return content, stdinName, err
+	}
+	content, err := os.ReadFile(filename)
+	return content, filename, err
 }
@@ -2,16 +2,20 @@ package parser
 
 import (
 	"coolz-compiler/ast"
+	"coolz-compiler/diagnostic"
 	"coolz-compiler/lexer"
 	"fmt"
 	"strconv"
+	"strings"
 )
 
 type Parser struct {
 	l         *lexer.Lexer
 	curToken  lexer.Token
 	peekToken lexer.Token
-	errors    []string
+	errors    []*diagnostic.Diagnostic
+	filename  string
+	tokens    []lexer.Token // Every token read, if the lexer keeps trivia, see ast.Syntax
 
 	prefixParseFns map[lexer.TokenType]prefixParseFn
 	infixParseFns  map[lexer.TokenType]infixParseFn
@@ -36,7 +40,7 @@ const (
 func New(l *lexer.Lexer) *Parser {
 	p := &Parser{
 		l:      l,
-		errors: []string{},
+		errors: []*diagnostic.Diagnostic{},
 	}
 
 	p.prefixParseFns = make(map[lexer.TokenType]prefixParseFn)
@@ -76,13 +80,37 @@ func New(l *lexer.Lexer) *Parser {
 	return p
 }
 
-func (p *Parser) Errors() []string {
+func (p *Parser) Errors() []*diagnostic.Diagnostic {
 	return p.errors
 }
 
+// SetFilename sets the file name reported in errors whose token does not
+// carry one.
+func (p *Parser) SetFilename(filename string) {
+	p.filename = filename
+}
+
+// nextToken advances to the next token. Lexical errors are reported as
+// they are read and left out of the token stream, so that parsing carries
+// on with the tokens around them.
 func (p *Parser) nextToken() {
 	p.curToken = p.peekToken
-	p.peekToken = p.l.NextToken()
+	p.peekToken = p.readToken()
+	for p.peekToken.Type == lexer.ERROR {
+		p.errors = append(p.errors, diagnostic.At(string(p.peekToken.Code), p.filename, p.peekToken, "%s", p.peekToken.Literal))
+		p.peekToken = p.readToken()
+	}
+}
+
+// readToken reads the next token from the lexer. If the lexer keeps
+// trivia, every token is also kept, up to the first EOF, so that
+// ParseProgram can hand them to the nodes they belong to.
+func (p *Parser) readToken() lexer.Token {
+	tok := p.l.NextToken()
+	if p.l.KeepsTrivia() && (len(p.tokens) == 0 || p.tokens[len(p.tokens)-1].Type != lexer.EOF) {
+		p.tokens = append(p.tokens, tok)
+	}
+	return tok
 }
 
 func (p *Parser) curTokenIs(t lexer.TokenType) bool {
@@ -112,15 +140,53 @@ func (p *Parser) expectCurrent(t lexer.TokenType) bool {
 }
 
 func (p *Parser) peekError(t lexer.TokenType) {
-	p.errors = append(p.errors, fmt.Sprintf("Expected next token to be %v, got %v line %d col %d", t, p.peekToken.Type, p.peekToken.Line, p.peekToken.Column))
+	p.errorf(ErrUnexpectedToken, p.peekToken, "Expected next token to be %v, got %v", t, p.peekToken.Type)
 }
 
 func (p *Parser) currentError(t lexer.TokenType) {
-	p.errors = append(p.errors, fmt.Sprintf("Expected current token to be %v, got %v line %d col %d", t, p.curToken.Type, p.peekToken.Line, p.peekToken.Column))
+	p.errorf(ErrUnexpectedToken, p.curToken, "Expected current token to be %v, got %v", t, p.curToken.Type)
+}
+
+// ErrorCode identifies the kind of a syntax error. The codes are those of
+// the diagnostics reporting the errors.
+type ErrorCode string
+
+const (
+	ErrUnexpectedToken    ErrorCode = "unexpected-token"    // a token the grammar does not allow there
+	ErrExpectedExpression ErrorCode = "expected-expression" // a missing or malformed expression
+	ErrInvalidAssignment  ErrorCode = "invalid-assignment"  // an assignment to a non-identifier
+)
+
+// errorf records a syntax error of kind code located at tok.
+func (p *Parser) errorf(code ErrorCode, tok lexer.Token, format string, args ...interface{}) {
+	p.errors = append(p.errors, diagnostic.At(string(code), p.filename, tok, format, args...))
 }
 
 func (p *Parser) ParseProgram() *ast.Program {
-	prog := &ast.Program{}
+	prog := &ast.Program{Token: p.curToken}
+	defer func() {
+		prog.EOF = p.curToken
+		if p.l.KeepsTrivia() {
+			// The tokens after a syntax error are part of the program's
+			// source all the same.
+			for p.tokens[len(p.tokens)-1].Type != lexer.EOF {
+				p.readToken()
+			}
+			prog.AttachTokens(p.tokens)
+		}
+	}()
+	for p.curTokenIs(lexer.IMPORT) || p.curTokenIsFrom() {
+		var imp *ast.Import
+		if p.curTokenIs(lexer.IMPORT) {
+			imp = p.parseImport()
+		} else {
+			imp = p.parseFromImport()
+		}
+		if imp == nil {
+			return prog
+		}
+		prog.Imports = append(prog.Imports, imp)
+	}
 	for p.curToken.Type == lexer.CLASS {
 		class := p.parseClass()
 		if class != nil {
@@ -132,6 +198,89 @@ func (p *Parser) ParseProgram() *ast.Program {
 	return prog
 }
 
+// curTokenIsFrom reports whether the current token starts a from import.
+// from is only a keyword at the top of a file, before the first class.
+func (p *Parser) curTokenIsFrom() bool {
+	return p.curTokenIs(lexer.OBJECTID) && p.curToken.Literal == "from"
+}
+
+// parseImport parses `import module;` or `import module as Alias;`,
+// leaving the current token after the semicolon.
+func (p *Parser) parseImport() *ast.Import {
+	imp := &ast.Import{Token: p.curToken}
+	if imp.Module = p.parseModuleName(); imp.Module == nil {
+		return nil
+	}
+	if p.peekTokenIs(lexer.OBJECTID) && p.peekToken.Literal == "as" {
+		p.nextToken()
+		if !p.peekTokenIs(lexer.TYPEID) || strings.Contains(p.peekToken.Literal, ".") {
+			p.errorf(ErrUnexpectedToken, p.peekToken, "expected a type identifier as module alias, got %s", p.peekToken.Type)
+			return nil
+		}
+		p.nextToken()
+		imp.Alias = &ast.TypeIdentifier{Token: p.curToken, Value: p.curToken.Literal}
+	}
+	if !p.expectPeek(lexer.SEMI) {
+		return nil
+	}
+	p.nextToken()
+	return imp
+}
+
+// parseFromImport parses `from module import A, B;`, leaving the current
+// token after the semicolon.
+func (p *Parser) parseFromImport() *ast.Import {
+	imp := &ast.Import{Token: p.curToken}
+	if imp.Module = p.parseModuleName(); imp.Module == nil {
+		return nil
+	}
+	if !p.expectPeek(lexer.IMPORT) {
+		return nil
+	}
+	for {
+		if !p.peekTokenIs(lexer.TYPEID) || strings.Contains(p.peekToken.Literal, ".") {
+			p.errorf(ErrUnexpectedToken, p.peekToken, "expected class name in from import, got %s", p.peekToken.Type)
+			return nil
+		}
+		p.nextToken()
+		imp.Names = append(imp.Names, &ast.TypeIdentifier{Token: p.curToken, Value: p.curToken.Literal})
+		if !p.peekTokenIs(lexer.COMMA) {
+			break
+		}
+		p.nextToken()
+	}
+	if !p.expectPeek(lexer.SEMI) {
+		return nil
+	}
+	p.nextToken()
+	return imp
+}
+
+// parseModuleName parses the module name following the current token. A
+// dotted name such as collections.list names a module in a subdirectory.
+// The identifier keeps the position of its first part and spans the whole
+// name.
+func (p *Parser) parseModuleName() *ast.ObjectIdentifier {
+	if !p.peekTokenIs(lexer.OBJECTID) && !p.peekTokenIs(lexer.TYPEID) {
+		p.errorf(ErrUnexpectedToken, p.peekToken, "expected module name after %s, got %s", p.curToken.Literal, p.peekToken.Type)
+		return nil
+	}
+	p.nextToken()
+	name := &ast.ObjectIdentifier{Token: p.curToken, Value: p.curToken.Literal}
+	for p.peekTokenIs(lexer.DOT) {
+		p.nextToken()
+		if !p.peekTokenIs(lexer.OBJECTID) && !p.peekTokenIs(lexer.TYPEID) {
+			p.errorf(ErrUnexpectedToken, p.peekToken, "expected module name after '.', got %s", p.peekToken.Type)
+			return nil
+		}
+		p.nextToken()
+		name.Value += "." + p.curToken.Literal
+	}
+	name.Token.Literal = name.Value
+	name.Token.EndOffset, name.Token.EndLine, name.Token.EndColumn = p.curToken.EndOffset, p.curToken.EndLine, p.curToken.EndColumn
+	return name
+}
+
 func (p *Parser) parseClass() *ast.Class {
 	token := p.curToken
 	p.nextToken()
@@ -153,6 +302,7 @@ func (p *Parser) parseClass() *ast.Class {
 			features = append(features, f)
 		}
 	}
+	rbrace := p.curToken
 	if p.curToken.Type == lexer.RBRACE {
 		p.nextToken()
 	}
@@ -164,6 +314,7 @@ func (p *Parser) parseClass() *ast.Class {
 		Name:     name,
 		Parent:   parent,
 		Features: features,
+		RBrace:   rbrace,
 	}
 }
 
@@ -191,6 +342,7 @@ func (p *Parser) parseMethod(name *ast.ObjectIdentifier) *ast.Method {
 		p.nextToken()
 	}
 	body := p.parseExpression(LOWEST)
+	rbrace := p.curToken
 	if p.curToken.Type == lexer.RBRACE {
 		p.nextToken()
 	}
@@ -198,6 +350,8 @@ func (p *Parser) parseMethod(name *ast.ObjectIdentifier) *ast.Method {
 		p.nextToken()
 	}
 	return &ast.Method{
+		Token:   name.Token,
+		RBrace:  rbrace,
 		Name:    name,
 		Type:    typ,
 		Formals: formals,
@@ -221,9 +375,10 @@ func (p *Parser) parseAttribute(name *ast.ObjectIdentifier) *ast.Attribute {
 		p.nextToken()
 	}
 	return &ast.Attribute{
-		Name: name,
-		Type: typ,
-		Init: init,
+		Token: name.Token,
+		Name:  name,
+		Type:  typ,
+		Init:  init,
 	}
 }
 
@@ -237,7 +392,7 @@ func (p *Parser) parseFormals() []*ast.Formal {
 		}
 		t := &ast.TypeIdentifier{Token: p.curToken, Value: p.curToken.Literal}
 		p.nextToken()
-		formals = append(formals, &ast.Formal{Name: n, Type: t})
+		formals = append(formals, &ast.Formal{Token: n.Token, Name: n, Type: t})
 		if p.curToken.Type == lexer.COMMA {
 			p.nextToken()
 			continue
@@ -260,8 +415,7 @@ func (p *Parser) parseExpression(precedence int) ast.Expression {
 	p.debugToken(fmt.Sprintf("parseExpression with precedence %d", precedence))
 	prefix := p.prefixParseFns[p.curToken.Type]
 	if prefix == nil {
-		p.errors = append(p.errors, fmt.Sprintf("No prefix parse function for %v (literal: %s) found at line %d, column %d",
-			p.curToken.Type, p.curToken.Literal, p.curToken.Line, p.curToken.Column))
+		p.errorf(ErrExpectedExpression, p.curToken, "No prefix parse function for %v (literal: %s)", p.curToken.Type, p.curToken.Literal)
 		return nil
 	}
 	leftExp := prefix()
@@ -302,10 +456,15 @@ func (p *Parser) parseIdentifier() ast.Expression {
 
 	// Check if this is a method call
 	if p.curTokenIs(lexer.LPAREN) {
+		method := exp.(*ast.ObjectIdentifier)
+		// The implicit self is an empty token where the call starts
+		self := method.Token
+		self.Type, self.Literal = lexer.SELF, "self"
+		self.EndOffset, self.EndLine, self.EndColumn = self.Offset, self.Line, self.Column
 		dispatch := &ast.DynamicDispatch{
 			Token:  p.curToken,
-			Object: &ast.Self{Token: lexer.Token{Type: lexer.SELF, Literal: "self"}}, // Implicit self
-			Method: &ast.ObjectIdentifier{Token: exp.(*ast.ObjectIdentifier).Token, Value: exp.(*ast.ObjectIdentifier).Value},
+			Object: &ast.Self{Token: self},
+			Method: &ast.ObjectIdentifier{Token: method.Token, Value: method.Value},
 		}
 
 		p.nextToken() // consume the '('
@@ -330,6 +489,7 @@ func (p *Parser) parseIdentifier() ast.Expression {
 			}
 		}
 
+		dispatch.RParen = p.curToken
 		if !p.expectCurrent(lexer.RPAREN) {
 			return nil
 		}
@@ -345,7 +505,7 @@ func (p *Parser) parseIntegerLiteral() ast.Expression {
 	p.debugToken("Parsing integer literal")
 	num, err := strconv.ParseInt(p.curToken.Literal, 10, 64)
 	if err != nil {
-		p.errors = append(p.errors, fmt.Sprintf("Could not parse %q as integer", p.curToken.Literal))
+		p.errorf(ErrorCode(lexer.ErrIntegerOutOfRange), p.curToken, "Could not parse %q as integer", p.curToken.Literal)
 		return nil
 	}
 	lit := &ast.IntegerLiteral{Token: p.curToken, Value: num}
@@ -384,23 +544,23 @@ func (p *Parser) parseCaseExpression() ast.Expression {
 	p.debugToken("Before parsing case condition")
 	exp.Expr = p.parseExpression(LOWEST)
 	if exp.Expr == nil {
-		p.errors = append(p.errors, "Failed to parse case condition")
+		p.errorf(ErrExpectedExpression, p.curToken, "Failed to parse case condition")
 		return nil
 	}
 	p.debugToken(fmt.Sprintf("After parsing case condition: %T", exp.Expr))
 
 	if !p.expectCurrent(lexer.OF) {
-		p.errors = append(p.errors, fmt.Sprintf("Expected 'of' after case expression, got %s", p.curToken.Type))
+		p.errorf(ErrUnexpectedToken, p.curToken, "Expected 'of' after case expression, got %s", p.curToken.Type)
 		return nil
 	}
 
 	for !p.curTokenIs(lexer.ESAC) && !p.curTokenIs(lexer.EOF) {
 		p.debugToken("Starting case branch")
 
-		branch := &ast.CaseBranch{}
+		branch := &ast.CaseBranch{Token: p.curToken}
 
 		if p.curToken.Type != lexer.OBJECTID {
-			p.errors = append(p.errors, fmt.Sprintf("Expected identifier in case branch, got %s", p.curToken.Type))
+			p.errorf(ErrUnexpectedToken, p.curToken, "Expected identifier in case branch, got %s", p.curToken.Type)
 			return nil
 		}
 
@@ -412,7 +572,7 @@ func (p *Parser) parseCaseExpression() ast.Expression {
 		}
 
 		if p.curToken.Type != lexer.TYPEID {
-			p.errors = append(p.errors, fmt.Sprintf("Expected type in case branch, got %s", p.curToken.Type))
+			p.errorf(ErrUnexpectedToken, p.curToken, "Expected type in case branch, got %s", p.curToken.Type)
 			return nil
 		}
 
@@ -429,7 +589,7 @@ func (p *Parser) parseCaseExpression() ast.Expression {
 		p.debugToken(fmt.Sprintf("After parsing branch expression: %T", branchExpr))
 
 		if branchExpr == nil {
-			p.errors = append(p.errors, "Failed to parse case branch expression")
+			p.errorf(ErrExpectedExpression, p.curToken, "Failed to parse case branch expression")
 			return nil
 		}
 		branch.Expr = branchExpr
@@ -441,13 +601,14 @@ func (p *Parser) parseCaseExpression() ast.Expression {
 			p.nextToken()
 			p.debugToken("After semicolon")
 		} else if !p.curTokenIs(lexer.ESAC) {
-			p.errors = append(p.errors, fmt.Sprintf("Expected semicolon or esac after branch, got %s", p.curToken.Type))
+			p.errorf(ErrUnexpectedToken, p.curToken, "Expected semicolon or esac after branch, got %s", p.curToken.Type)
 			return nil
 		}
 	}
 
+	exp.Esac = p.curToken
 	if !p.expectCurrent(lexer.ESAC) {
-		p.errors = append(p.errors, fmt.Sprintf("Expected 'esac' at end of case expression, got %s", p.curToken.Type))
+		p.errorf(ErrUnexpectedToken, p.curToken, "Expected 'esac' at end of case expression, got %s", p.curToken.Type)
 		return nil
 	}
 
@@ -478,14 +639,14 @@ func (p *Parser) parseInfixExpression(left ast.Expression) ast.Expression {
 	p.nextToken() // Move past the operator
 
 	if p.curToken.Type == lexer.EOF {
-		p.errors = append(p.errors, "Unexpected EOF in infix expression")
+		p.errorf(ErrExpectedExpression, p.curToken, "Unexpected EOF in infix expression")
 		return nil
 	}
 
 	p.debugToken(fmt.Sprintf("Parsing right side of %s with precedence %d", exp.Operator, precedence))
 	exp.Right = p.parseExpression(precedence)
 	if exp.Right == nil {
-		p.errors = append(p.errors, fmt.Sprintf("Failed to parse right side of %s expression", exp.Operator))
+		p.errorf(ErrExpectedExpression, p.curToken, "Failed to parse right side of %s expression", exp.Operator)
 		return nil
 	}
 
@@ -513,6 +674,7 @@ func (p *Parser) parseIfExpression() ast.Expression {
 
 	exp.Alternative = p.parseExpression(LOWEST)
 
+	exp.Fi = p.curToken
 	if !p.expectCurrent(lexer.FI) {
 		return nil
 	}
@@ -539,6 +701,7 @@ func (p *Parser) parseWhileExpression() ast.Expression {
 	}
 	exp.Body = bodyExpr
 
+	exp.Pool = p.curToken
 	if !p.expectCurrent(lexer.POOL) {
 		return nil
 	}
@@ -631,11 +794,11 @@ func (p *Parser) parseLetExpression() ast.Expression {
 
 // Helper function to parse a single let binding
 func (p *Parser) parseLetBinding() *ast.LetBinding {
-	binding := &ast.LetBinding{}
+	binding := &ast.LetBinding{Token: p.curToken}
 
 	// Parse identifier
 	if !p.curTokenIs(lexer.OBJECTID) {
-		p.errors = append(p.errors, fmt.Sprintf("expected identifier in let binding, got %s", p.curToken.Type))
+		p.errorf(ErrUnexpectedToken, p.curToken, "expected identifier in let binding, got %s", p.curToken.Type)
 		return nil
 	}
 	binding.Identifier = &ast.ObjectIdentifier{Token: p.curToken, Value: p.curToken.Literal}
@@ -647,7 +810,7 @@ func (p *Parser) parseLetBinding() *ast.LetBinding {
 	}
 
 	if !p.curTokenIs(lexer.TYPEID) {
-		p.errors = append(p.errors, fmt.Sprintf("expected type in let binding, got %s", p.curToken.Type))
+		p.errorf(ErrUnexpectedToken, p.curToken, "expected type in let binding, got %s", p.curToken.Type)
 		return nil
 	}
 	binding.Type = &ast.TypeIdentifier{Token: p.curToken, Value: p.curToken.Literal}
@@ -666,9 +829,12 @@ func (p *Parser) parseLetBinding() *ast.LetBinding {
 }
 
 func (p *Parser) parseAssignment(left ast.Expression) ast.Expression {
-	// Verify left side is an identifier
-	if _, ok := left.(*ast.ObjectIdentifier); !ok {
-		p.errors = append(p.errors, fmt.Sprintf("left side of assignment must be identifier, got %T", left))
+	// Verify left side is an identifier. Assigning to self is a semantic
+	// error, so it is accepted here and rejected by the analyser.
+	switch left.(type) {
+	case *ast.ObjectIdentifier, *ast.Self:
+	default:
+		p.errorf(ErrInvalidAssignment, p.curToken, "left side of assignment must be identifier, got %T", left)
 		return nil
 	}
 
@@ -748,6 +914,7 @@ func (p *Parser) parseBlockExpression() ast.Expression {
 		}
 	}
 
+	block.RBrace = p.curToken
 	if !p.expectCurrent(lexer.RBRACE) {
 		return nil
 	}
@@ -765,7 +932,7 @@ func (p *Parser) parseDynamicDispatch(left ast.Expression) ast.Expression {
 
 	// Parse method name (must be OBJECTID)
 	if !p.curTokenIs(lexer.OBJECTID) {
-		p.errors = append(p.errors, fmt.Sprintf("expected method name after '.', got %s", p.curToken.Type))
+		p.errorf(ErrUnexpectedToken, p.curToken, "expected method name after '.', got %s", p.curToken.Type)
 		return nil
 	}
 	dd.Method = &ast.ObjectIdentifier{
@@ -784,6 +951,7 @@ func (p *Parser) parseDynamicDispatch(left ast.Expression) ast.Expression {
 
 	// Handle empty argument list
 	if p.curTokenIs(lexer.RPAREN) {
+		dd.RParen = p.curToken
 		p.nextToken() // consume )
 		dd.Arguments = args
 		return dd
@@ -804,6 +972,7 @@ func (p *Parser) parseDynamicDispatch(left ast.Expression) ast.Expression {
 		}
 	}
 
+	dd.RParen = p.curToken
 	if !p.expectCurrent(lexer.RPAREN) {
 		return nil
 	}
@@ -823,7 +992,7 @@ func (p *Parser) parseStaticDispatch(left ast.Expression) ast.Expression {
 
 	// Parse the type identifier
 	if !p.curTokenIs(lexer.TYPEID) {
-		p.errors = append(p.errors, fmt.Sprintf("expected type identifier after '@', got %s", p.curToken.Type))
+		p.errorf(ErrUnexpectedToken, p.curToken, "expected type identifier after '@', got %s", p.curToken.Type)
 		return nil
 	}
 	sd.Type = &ast.TypeIdentifier{
@@ -834,14 +1003,14 @@ func (p *Parser) parseStaticDispatch(left ast.Expression) ast.Expression {
 
 	// Expect and consume DOT after type
 	if !p.curTokenIs(lexer.DOT) {
-		p.errors = append(p.errors, fmt.Sprintf("expected '.' after type, got %s", p.curToken.Type))
+		p.errorf(ErrUnexpectedToken, p.curToken, "expected '.' after type, got %s", p.curToken.Type)
 		return nil
 	}
 	p.nextToken()
 
 	// Parse method name (must be OBJECTID)
 	if !p.curTokenIs(lexer.OBJECTID) {
-		p.errors = append(p.errors, fmt.Sprintf("expected method name after '.', got %s", p.curToken.Type))
+		p.errorf(ErrUnexpectedToken, p.curToken, "expected method name after '.', got %s", p.curToken.Type)
 		return nil
 	}
 	sd.Method = &ast.ObjectIdentifier{
@@ -852,7 +1021,7 @@ func (p *Parser) parseStaticDispatch(left ast.Expression) ast.Expression {
 
 	// Parse arguments inside parentheses
 	if !p.curTokenIs(lexer.LPAREN) {
-		p.errors = append(p.errors, fmt.Sprintf("expected '(' after method name, got %s", p.curToken.Type))
+		p.errorf(ErrUnexpectedToken, p.curToken, "expected '(' after method name, got %s", p.curToken.Type)
 		return nil
 	}
 
@@ -863,6 +1032,7 @@ func (p *Parser) parseStaticDispatch(left ast.Expression) ast.Expression {
 
 	// Handle empty argument list
 	if p.curTokenIs(lexer.RPAREN) {
+		sd.RParen = p.curToken
 		p.nextToken() // consume )
 		sd.Arguments = args
 		return sd
@@ -883,6 +1053,7 @@ func (p *Parser) parseStaticDispatch(left ast.Expression) ast.Expression {
 		}
 	}
 
+	sd.RParen = p.curToken
 	if !p.expectCurrent(lexer.RPAREN) {
 		return nil
 	}
@@ -4,6 +4,8 @@ import (
 	"coolz-compiler/ast"
 	"coolz-compiler/lexer"
 	"fmt"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -720,3 +722,338 @@ func inorderTraversal(node ast.Expression) string {
 		return fmt.Sprintf("unknown(%T)", n)
 	}
 }
+
+func TestSerializeProgram(t *testing.T) {
+	input := `
+import util; import Other;
+import collections.list as L; from geometry import Point, Vector;
+class A {
+    x : Int <- 1 + 2;
+    s : String;
+    l : L.List;
+};
+class Main inherits IO {
+    main() : Object {
+        let a : A <- new A in {
+            out_string("hi\n");
+            a@A.copy();
+            if isvoid a then 0 else not true fi;
+        }
+    };
+    f(x : Int, y : Bool) : Int { case x of i : Int => i; o : Object => 0; esac };
+};
+`
+	expected := `import util;
+import Other;
+import collections.list as L;
+from geometry import Point, Vector;
+class A {
+    x : Int <- (1 + 2);
+    s : String;
+    l : L.List;
+};
+class Main inherits IO {
+    main() : Object { let a : A <- new A in { self.out_string("hi\n"); a@A.copy(); if isvoid a then 0 else (not true) fi } };
+    f(x : Int, y : Bool) : Int { case x of i : Int => i; o : Object => 0 esac };
+};
+`
+
+	l := lexer.NewLexer(strings.NewReader(input))
+	p := New(l)
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		t.Fatalf("parser errors: %v", p.Errors())
+	}
+
+	if got := SerializeProgram(program); got != expected {
+		t.Errorf("wrong serialization.\nexpected:\n%s\ngot:\n%s", expected, got)
+	}
+}
+
+func TestErrorDiagnostics(t *testing.T) {
+	l := lexer.NewLexer(strings.NewReader("class Main { main() : Object { 1 + $ }; };"))
+	p := New(l)
+	p.SetFilename("main.cl")
+	p.ParseProgram()
+
+	errors := p.Errors()
+	if len(errors) == 0 {
+		t.Fatalf("expected errors for an invalid character")
+	}
+	first := errors[0]
+	if first.Code != string(lexer.ErrInvalidCharacter) || first.File != "main.cl" || first.Line != 1 || first.Column != 36 {
+		t.Errorf("expected an invalid character in main.cl at 1:36, got %+v", first)
+	}
+	for _, err := range errors[1:] {
+		if err.Code != string(ErrExpectedExpression) {
+			t.Errorf("expected the follow-on errors to report the missing operand, got %+v", err)
+		}
+	}
+}
+
+func TestSelfAssignment(t *testing.T) {
+	// Assigning to self parses, semantic analysis rejects it
+	input := "class A {\n  test() : Object { self <- new A };\n};"
+	p := New(lexer.NewLexer(strings.NewReader(input)))
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		t.Fatalf("expected no syntax error, got %v", p.Errors())
+	}
+
+	method := program.Classes[0].Features[0].(*ast.Method)
+	assignment, ok := method.Body.(*ast.Assignment)
+	if !ok {
+		t.Fatalf("expected an assignment, got %T", method.Body)
+	}
+	if _, ok := assignment.Left.(*ast.Self); !ok {
+		t.Errorf("expected self on the left, got %T", assignment.Left)
+	}
+}
+
+func TestLexicalErrorsAreSkipped(t *testing.T) {
+	input := "class A {};\n*) class Main { main() : Object { 0 }; };"
+	p := New(lexer.NewLexer(strings.NewReader(input)))
+	program := p.ParseProgram()
+
+	errors := p.Errors()
+	if len(errors) != 1 {
+		t.Fatalf("expected only the lexical error, got %v", errors)
+	}
+	if errors[0].Code != string(lexer.ErrUnmatchedComment) || errors[0].Line != 2 || errors[0].EndColumn != 3 {
+		t.Errorf("expected an unmatched comment at 2:1-2:3, got %+v", errors[0])
+	}
+	if len(program.Classes) != 2 {
+		t.Errorf("expected parsing to carry on past the error, got %d classes", len(program.Classes))
+	}
+}
+
+func TestNodeSpans(t *testing.T) {
+	input := `import util as U;
+class A inherits U.Base {
+    x : Int <- 1 + 2;
+    f(a : Int, b : A) : Object {
+        {
+            if isvoid b then g(a) else b@A.f(a, self) fi;
+            while false loop (new A).f(1, b) pool;
+            let y : Int <- a * 2, z : Bool in case z of w : Bool => not w; esac;
+        }
+    };
+};
+`
+	l := lexer.NewLexer(strings.NewReader(input))
+	p := New(l)
+	program := p.ParseProgram()
+	if len(p.Errors()) > 0 {
+		t.Fatalf("unexpected errors: %v", p.Errors())
+	}
+
+	class := program.Classes[0]
+	method := class.Features[1].(*ast.Method)
+	block := method.Body.(*ast.BlockExpression)
+	ifExp := block.Expressions[0].(*ast.IfExpression)
+	whileExp := block.Expressions[1].(*ast.WhileExpression)
+	let := block.Expressions[2].(*ast.LetExpression)
+	caseExp := let.In.(*ast.CaseExpression)
+
+	tests := []struct {
+		node     ast.Node
+		expected string
+	}{
+		{program.Imports[0], "import util as U"},
+		{class, input[strings.Index(input, "class") : strings.LastIndex(input, "};")+1]},
+		{class.Features[0], "x : Int <- 1 + 2"},
+		{method.Formals[1], "b : A"},
+		{ifExp, "if isvoid b then g(a) else b@A.f(a, self) fi"},
+		{ifExp.Condition, "isvoid b"},
+		{ifExp.Consequence, "g(a)"},
+		{ifExp.Alternative, "b@A.f(a, self)"},
+		{whileExp, "while false loop (new A).f(1, b) pool"},
+		// Parentheses are not part of the expression they enclose
+		{whileExp.Body, "new A).f(1, b)"},
+		{let, "let y : Int <- a * 2, z : Bool in case z of w : Bool => not w; esac"},
+		{let.Bindings[0], "y : Int <- a * 2"},
+		{let.Bindings[1], "z : Bool"},
+		{caseExp.Branches[0], "w : Bool => not w"},
+	}
+	for i, tt := range tests {
+		start, end := tt.node.Pos(), tt.node.End()
+		if start.Line == 0 || end.Line == 0 {
+			t.Errorf("test[%d]: %T has no position", i, tt.node)
+			continue
+		}
+		if got := input[start.Offset:end.Offset]; got != tt.expected {
+			t.Errorf("test[%d]: expected %T to span %q, got %q", i, tt.node, tt.expected, got)
+		}
+	}
+
+	if method.Pos().Line != 4 || method.Pos().Column != 5 || method.End().Line != 10 || method.End().Column != 6 {
+		t.Errorf("expected method f at 4:5-10:6, got %+v-%+v", method.Pos(), method.End())
+	}
+	if end := program.End(); end.Offset != len(input) {
+		t.Errorf("expected the program to end at offset %d, got %d", len(input), end.Offset)
+	}
+}
+
+func TestExpectCurrentReportsTheCurrentToken(t *testing.T) {
+	l := lexer.NewLexer(strings.NewReader("class A { f() : Int { if true then 1 else 2 esac }; };"))
+	p := New(l)
+	p.ParseProgram()
+
+	if len(p.Errors()) == 0 {
+		t.Fatalf("expected an error for the missing fi")
+	}
+	if err := p.Errors()[0]; err.Line != 1 || err.Column != 45 || err.EndColumn != 49 {
+		t.Errorf("expected the error at esac, 1:45-1:49, got %s (to column %d)", err.Error(), err.EndColumn)
+	}
+}
+
+// parseWithTrivia parses input from a lexer in trivia mode.
+func parseWithTrivia(input string) (*ast.Program, *Parser) {
+	l := lexer.NewLexer(strings.NewReader(input))
+	l.SetTrivia(true)
+	p := New(l)
+	return p.ParseProgram(), p
+}
+
+func TestPrintReproducesInput(t *testing.T) {
+	inputs := []string{
+		"",
+		"-- only a comment",
+		"(* doc *)\nimport util as U; from other import A, B;\n\nclass Main inherits IO {\n\tmain() : Object { out_string(\"hi\\n\") }; -- entry point\n};\n",
+		"class Main { main() : Object { \"abc\n }; x : Int <- 99999999999999999999; };",
+		"class Main { main() : Object { if then }; }; class B {}; $ trailing (* open",
+	}
+	files, _ := filepath.Glob("../examples/*.cl")
+	more, _ := filepath.Glob("../stdlib/*/*.cl")
+	for _, file := range append(files, more...) {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		inputs = append(inputs, string(content))
+	}
+	if len(inputs) < 10 {
+		t.Fatalf("expected the examples to be found, got %d inputs", len(inputs))
+	}
+
+	for _, input := range inputs {
+		program, _ := parseWithTrivia(input)
+		var sb strings.Builder
+		if err := program.Print(&sb); err != nil {
+			t.Fatal(err)
+		}
+		if sb.String() != input {
+			t.Errorf("expected to print %q, got %q", input, sb.String())
+		}
+	}
+}
+
+func TestTriviaInTree(t *testing.T) {
+	input := `-- A counter.
+class Counter {
+    (* The current count *)
+    n : Int <- 0;
+
+    -- Adds one.
+    inc() : Counter { { n <- n + (* by *) 1; self; } }; -- returns self
+};`
+	program, p := parseWithTrivia(input)
+	if len(p.Errors()) > 0 {
+		t.Fatalf("unexpected errors: %v", p.Errors())
+	}
+
+	class := program.Classes[0]
+	if got := class.Token.Leading; len(got) != 2 || got[0].Text != "-- A counter." {
+		t.Errorf("expected the class comment before the class token, got %v", got)
+	}
+	attribute := class.Features[0].(*ast.Attribute)
+	method := class.Features[1].(*ast.Method)
+	if got := attribute.Token.Leading; len(got) != 4 || got[1].Text != "(* The current count *)" {
+		t.Errorf("expected the attribute comment before its name, got %v", got)
+	}
+	if got := method.Token.Leading; len(got) != 5 || got[2].Text != "-- Adds one." {
+		t.Errorf("expected the method comment before its name, got %v", got)
+	}
+	if got := method.RBrace.Trailing; len(got) != 0 {
+		t.Errorf("expected no trivia after the method's brace, got %v", got)
+	}
+
+	expected := "inc() : Counter { { n <- n + (* by *) 1; self; } }"
+	if got := program.Source(method); got != expected {
+		t.Errorf("expected the method's source %q, got %q", expected, got)
+	}
+	body := method.Body.(*ast.BlockExpression).Expressions[0]
+	if got := program.Source(body); got != "n <- n + (* by *) 1" {
+		t.Errorf("expected the assignment's source, got %q", got)
+	}
+}
+
+// gaps returns the text of node's own tokens, with the gaps between its
+// children separated by |.
+func gaps(node ast.Node) string {
+	var texts []string
+	for _, gap := range ast.Tokens(node) {
+		var gapTexts []string
+		for _, tok := range gap {
+			gapTexts = append(gapTexts, tok.Text)
+		}
+		texts = append(texts, strings.Join(gapTexts, " "))
+	}
+	return strings.Join(texts, "|")
+}
+
+func TestTokensOnNodes(t *testing.T) {
+	input := "class Main {\n  f(x : Int) : Int { 2 * (x + 1) }; -- double\n};\n"
+	program, _ := parseWithTrivia(input)
+
+	class := program.Classes[0]
+	method := class.Features[0].(*ast.Method)
+	product := method.Body.(*ast.BinaryExpression)
+	tests := []struct {
+		node     ast.Node
+		expected string
+	}{
+		{class, "class|{|; }"},
+		{method, "|(|) :|{|) }"},
+		{method.Formals[0], "|:|"},
+		{product, "|* (|"},
+		{product.Left, "2"},
+	}
+	for _, tt := range tests {
+		if got := gaps(tt.node); got != tt.expected {
+			t.Errorf("expected %T to hold %q, got %q", tt.node, tt.expected, got)
+		}
+	}
+
+	semi := class.Tokens[2][0]
+	if len(semi.Trailing) != 3 || semi.Trailing[1].Text != "-- double" {
+		t.Errorf("expected the comment after the method's semicolon, got %+v", semi)
+	}
+}
+
+func TestPrintWalksTree(t *testing.T) {
+	input := "class Main {\n  a() : Int { 1 };\n  b() : Int { 2 }; -- unused\n  c() : Int { 3 };\n};\n"
+	program, _ := parseWithTrivia(input)
+
+	class := program.Classes[0]
+	a, c := class.Features[0].(*ast.Method), class.Features[2].(*ast.Method)
+	a.Body, c.Body = c.Body, a.Body
+	a.Name.Tokens[0][0].Text = "first"
+
+	var sb strings.Builder
+	if err := program.Print(&sb); err != nil {
+		t.Fatal(err)
+	}
+	expected := "class Main {\n  first() : Int { 3 };\n  b() : Int { 2 }; -- unused\n  c() : Int { 1 };\n};\n"
+	if sb.String() != expected {
+		t.Errorf("expected the edited tree %q, got %q", expected, sb.String())
+	}
+}
+
+func TestPrintRequiresTrivia(t *testing.T) {
+	p := New(lexer.NewLexer(strings.NewReader("class Main {};")))
+	program := p.ParseProgram()
+	if err := program.Print(&strings.Builder{}); err == nil {
+		t.Errorf("expected an error printing a program parsed without trivia")
+	}
+}
@@ -6,7 +6,109 @@ import (
 	"strings"
 )
 
+// serializer renders the AST back to COOL-like source. When types is set,
+// every expression is followed by its static type in brackets, e.g.
+// (1[Int] + 2[Int])[Int].
+type serializer struct {
+	types ast.TypeTable
+}
+
 func SerializeExpression(exp ast.Expression) string {
+	return serializer{}.expression(exp)
+}
+
+// SerializeTypedExpression is SerializeExpression with each subexpression
+// annotated with the type recorded for it in types.
+func SerializeTypedExpression(exp ast.Expression, types ast.TypeTable) string {
+	return serializer{types: types}.expression(exp)
+}
+
+// SerializeProgram renders a whole program, one feature per line, so that
+// dumps of it are stable and diffable.
+func SerializeProgram(program *ast.Program) string {
+	return serializer{}.program(program)
+}
+
+// SerializeTypedProgram is SerializeProgram with expressions annotated with
+// the types recorded for them in types.
+func SerializeTypedProgram(program *ast.Program, types ast.TypeTable) string {
+	return serializer{types: types}.program(program)
+}
+
+func (s serializer) program(program *ast.Program) string {
+	var sb strings.Builder
+	for _, imp := range program.Imports {
+		if len(imp.Names) > 0 {
+			names := make([]string, len(imp.Names))
+			for i, name := range imp.Names {
+				names[i] = name.Value
+			}
+			fmt.Fprintf(&sb, "from %s import %s;\n", imp.Module.Value, strings.Join(names, ", "))
+			continue
+		}
+		sb.WriteString("import ")
+		sb.WriteString(imp.Module.Value)
+		if imp.Alias != nil {
+			sb.WriteString(" as ")
+			sb.WriteString(imp.Alias.Value)
+		}
+		sb.WriteString(";\n")
+	}
+	for _, class := range program.Classes {
+		sb.WriteString("class ")
+		sb.WriteString(class.Name.Value)
+		if class.Parent != nil {
+			sb.WriteString(" inherits ")
+			sb.WriteString(class.Parent.Value)
+		}
+		sb.WriteString(" {\n")
+		for _, feature := range class.Features {
+			sb.WriteString("    ")
+			sb.WriteString(s.feature(feature))
+			sb.WriteString(";\n")
+		}
+		sb.WriteString("};\n")
+	}
+	return sb.String()
+}
+
+func (s serializer) feature(feature ast.Feature) string {
+	switch f := feature.(type) {
+	case *ast.Method:
+		formals := make([]string, len(f.Formals))
+		for i, formal := range f.Formals {
+			formals[i] = fmt.Sprintf("%s : %s", formal.Name.Value, formal.Type.Value)
+		}
+		return fmt.Sprintf("%s(%s) : %s { %s }", f.Name.Value, strings.Join(formals, ", "), f.Type.Value, s.expression(f.Body))
+	case *ast.Attribute:
+		if f.Init == nil {
+			return fmt.Sprintf("%s : %s", f.Name.Value, f.Type.Value)
+		}
+		return fmt.Sprintf("%s : %s <- %s", f.Name.Value, f.Type.Value, s.expression(f.Init))
+	default:
+		return fmt.Sprintf("Unknown feature: %T", feature)
+	}
+}
+
+func (s serializer) expression(exp ast.Expression) string {
+	str := s.untyped(exp)
+	if s.types == nil {
+		return str
+	}
+	t, ok := s.types[exp]
+	if !ok {
+		return str
+	}
+	// These end in a subexpression, whose own annotation would otherwise
+	// run into theirs.
+	switch exp.(type) {
+	case *ast.Assignment, *ast.LetExpression, *ast.IsVoidExpression:
+		str = "(" + str + ")"
+	}
+	return str + "[" + t + "]"
+}
+
+func (s serializer) untyped(exp ast.Expression) string {
 	switch node := exp.(type) {
 	case *ast.IntegerLiteral:
 		return fmt.Sprintf("%d", node.Value)
@@ -17,18 +119,18 @@ func SerializeExpression(exp ast.Expression) string {
 	case *ast.ObjectIdentifier:
 		return node.Value
 	case *ast.UnaryExpression:
-		return fmt.Sprintf("(%s %s)", node.Operator, SerializeExpression(node.Right))
+		return fmt.Sprintf("(%s %s)", node.Operator, s.expression(node.Right))
 	case *ast.BinaryExpression:
-		return fmt.Sprintf("(%s %s %s)", SerializeExpression(node.Left), node.Operator, SerializeExpression(node.Right))
+		return fmt.Sprintf("(%s %s %s)", s.expression(node.Left), node.Operator, s.expression(node.Right))
 	case *ast.IfExpression:
-		return fmt.Sprintf("if %s then %s else %s fi", SerializeExpression(node.Condition), SerializeExpression(node.Consequence), SerializeExpression(node.Alternative))
+		return fmt.Sprintf("if %s then %s else %s fi", s.expression(node.Condition), s.expression(node.Consequence), s.expression(node.Alternative))
 	case *ast.WhileExpression:
-		return fmt.Sprintf("while %s loop %s pool", SerializeExpression(node.Condition), SerializeExpression(node.Body))
+		return fmt.Sprintf("while %s loop %s pool", s.expression(node.Condition), s.expression(node.Body))
 	case *ast.BlockExpression:
 		var sb strings.Builder
 		sb.WriteString("{ ")
 		for i, expr := range node.Expressions {
-			sb.WriteString(SerializeExpression(expr))
+			sb.WriteString(s.expression(expr))
 			if i < len(node.Expressions)-1 {
 				sb.WriteString("; ")
 			}
@@ -44,41 +146,41 @@ func SerializeExpression(exp ast.Expression) string {
 			sb.WriteString(binding.Type.Value)
 			if binding.Init != nil {
 				sb.WriteString(" <- ")
-				sb.WriteString(SerializeExpression(binding.Init))
+				sb.WriteString(s.expression(binding.Init))
 			}
 			if i < len(node.Bindings)-1 {
 				sb.WriteString(", ")
 			}
 		}
 		sb.WriteString(" in ")
-		sb.WriteString(SerializeExpression(node.In))
+		sb.WriteString(s.expression(node.In))
 		return sb.String()
 	case *ast.NewExpression:
 		return fmt.Sprintf("new %s", node.Type.Value)
 	case *ast.IsVoidExpression:
-		return fmt.Sprintf("isvoid %s", SerializeExpression(node.Expression))
+		return fmt.Sprintf("isvoid %s", s.expression(node.Expression))
 	case *ast.Assignment:
-		return fmt.Sprintf("%s <- %s", SerializeExpression(node.Left), SerializeExpression(node.Value))
+		return fmt.Sprintf("%s <- %s", s.expression(node.Left), s.expression(node.Value))
 
 	case *ast.DynamicDispatch:
 		args := make([]string, len(node.Arguments))
 		for i, arg := range node.Arguments {
-			args[i] = SerializeExpression(arg)
+			args[i] = s.expression(arg)
 		}
-		return fmt.Sprintf("%s.%s(%s)", SerializeExpression(node.Object), node.Method.Value, strings.Join(args, ", "))
+		return fmt.Sprintf("%s.%s(%s)", s.expression(node.Object), node.Method.Value, strings.Join(args, ", "))
 
 	case *ast.StaticDispatch:
 		args := make([]string, len(node.Arguments))
 		for i, arg := range node.Arguments {
-			args[i] = SerializeExpression(arg)
+			args[i] = s.expression(arg)
 		}
-		return fmt.Sprintf("%s@%s.%s(%s)", SerializeExpression(node.Object), node.Type.Value, node.Method.Value, strings.Join(args, ", "))
+		return fmt.Sprintf("%s@%s.%s(%s)", s.expression(node.Object), node.Type.Value, node.Method.Value, strings.Join(args, ", "))
 
 	case *ast.CaseExpression:
 		var sb strings.Builder
-		sb.WriteString(fmt.Sprintf("case %s of ", SerializeExpression(node.Expr)))
+		sb.WriteString(fmt.Sprintf("case %s of ", s.expression(node.Expr)))
 		for i, branch := range node.Branches {
-			sb.WriteString(fmt.Sprintf("%s : %s => %s", branch.Identifier.Value, branch.Type.Value, SerializeExpression(branch.Expr)))
+			sb.WriteString(fmt.Sprintf("%s : %s => %s", branch.Identifier.Value, branch.Type.Value, s.expression(branch.Expr)))
 			if i < len(node.Branches)-1 {
 				sb.WriteString("; ")
 			}
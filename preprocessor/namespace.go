@@ -0,0 +1,220 @@
+package preprocessor
+
+import (
+	"coolz-compiler/ast"
+	"coolz-compiler/diagnostic"
+	"coolz-compiler/lexer"
+	"sort"
+	"strings"
+)
+
+// Module records the classes a loaded file declares.
+type Module struct {
+	name    string            // Qualifies the module's classes, empty for the root file
+	classes map[string]string // Declared name -> qualified name
+}
+
+// NewModule returns the module called name that declares the given
+// classes. An empty name is the root file's module, whose classes are not
+// qualified.
+func NewModule(name string, declared []string) *Module {
+	m := &Module{name: name, classes: make(map[string]string)}
+	for _, class := range declared {
+		m.classes[class] = m.qualify(class)
+	}
+	return m
+}
+
+// Resolve rewrites the class names used in classes, which filename
+// declares as module own, to their qualified names. modules holds the
+// module each of imports refers to.
+func Resolve(filename string, own *Module, classes []*ast.Class, imports []*ast.Import, modules []*Module) []*diagnostic.Diagnostic {
+	scope := newScope(filename, own)
+	for i, imp := range imports {
+		scope.add(imp, modules[i])
+	}
+	for _, class := range classes {
+		scope.resolveClass(class)
+	}
+	return scope.errors
+}
+
+// qualify returns the name class is known by in the merged program. The
+// classes of an imported module are prefixed with its name, e.g.
+// collections.list.List, so that modules may reuse each other's class
+// names. The basic classes are never qualified.
+func (m *Module) qualify(class string) string {
+	if m.name == "" || basicClasses[class] {
+		return class
+	}
+	return m.name + "." + class
+}
+
+var basicClasses = map[string]bool{
+	"Object": true, "IO": true, "Int": true, "String": true, "Bool": true, "SELF_TYPE": true,
+}
+
+// scope resolves the class names used in one file to qualified names. A
+// file sees its own classes, the classes of the modules it imports plainly
+// or with from, and through an alias the classes of aliased modules.
+type scope struct {
+	file     string
+	own      *Module
+	imported map[string][]string // Unqualified name -> candidate qualified names
+	aliases  map[string]*Module
+	errors   []*diagnostic.Diagnostic
+}
+
+func newScope(file string, own *Module) *scope {
+	return &scope{
+		file:     file,
+		own:      own,
+		imported: make(map[string][]string),
+		aliases:  make(map[string]*Module),
+	}
+}
+
+// add makes the classes of m that imp names visible in the scope.
+func (s *scope) add(imp *ast.Import, m *Module) {
+	switch {
+	case imp.Alias != nil:
+		if _, ok := s.aliases[imp.Alias.Value]; ok {
+			s.errorf(imp.Alias.Token, "module alias %s is already in use", imp.Alias.Value)
+			return
+		}
+		s.aliases[imp.Alias.Value] = m
+	case len(imp.Names) > 0:
+		for _, name := range imp.Names {
+			qualified, ok := m.classes[name.Value]
+			if !ok {
+				s.errorf(name.Token, "module %s has no class %s", imp.Module.Value, name.Value)
+				continue
+			}
+			s.addImported(name.Value, qualified)
+		}
+	default:
+		for name, qualified := range m.classes {
+			s.addImported(name, qualified)
+		}
+	}
+}
+
+func (s *scope) addImported(name, qualified string) {
+	for _, candidate := range s.imported[name] {
+		if candidate == qualified {
+			return
+		}
+	}
+	s.imported[name] = append(s.imported[name], qualified)
+}
+
+// resolve rewrites t to the qualified name it refers to. Names that do not
+// resolve are left for semantic analysis to report as undefined.
+func (s *scope) resolve(t *ast.TypeIdentifier) {
+	if t == nil || basicClasses[t.Value] {
+		return
+	}
+	if i := strings.LastIndex(t.Value, "."); i >= 0 {
+		alias, class := t.Value[:i], t.Value[i+1:]
+		m, ok := s.aliases[alias]
+		if !ok {
+			s.errorf(t.Token, "unknown module alias %s", alias)
+			return
+		}
+		qualified, ok := m.classes[class]
+		if !ok {
+			s.errorf(t.Token, "module %s has no class %s", m.name, class)
+			return
+		}
+		t.Value = qualified
+		return
+	}
+	if qualified, ok := s.own.classes[t.Value]; ok {
+		t.Value = qualified
+		return
+	}
+	switch candidates := s.imported[t.Value]; len(candidates) {
+	case 0:
+	case 1:
+		t.Value = candidates[0]
+	default:
+		sorted := append([]string{}, candidates...)
+		sort.Strings(sorted)
+		s.errorf(t.Token, "ambiguous class name %s: could be %s", t.Value, strings.Join(sorted, " or "))
+	}
+}
+
+func (s *scope) errorf(tok lexer.Token, format string, args ...interface{}) {
+	s.errors = append(s.errors, diagnostic.At(diagnostic.CodeImport, s.file, tok, format, args...))
+}
+
+// resolveClass rewrites every type name in class. The name the class was
+// declared with is kept for type_name and runtime messages.
+func (s *scope) resolveClass(class *ast.Class) {
+	class.Declared = class.Name.Value
+	s.resolve(class.Name)
+	s.resolve(class.Parent)
+	for _, feature := range class.Features {
+		switch f := feature.(type) {
+		case *ast.Method:
+			for _, formal := range f.Formals {
+				s.resolve(formal.Type)
+			}
+			s.resolve(f.Type)
+			s.resolveExpression(f.Body)
+		case *ast.Attribute:
+			s.resolve(f.Type)
+			s.resolveExpression(f.Init)
+		}
+	}
+}
+
+func (s *scope) resolveExpression(exp ast.Expression) {
+	switch e := exp.(type) {
+	case *ast.UnaryExpression:
+		s.resolveExpression(e.Right)
+	case *ast.BinaryExpression:
+		s.resolveExpression(e.Left)
+		s.resolveExpression(e.Right)
+	case *ast.IfExpression:
+		s.resolveExpression(e.Condition)
+		s.resolveExpression(e.Consequence)
+		s.resolveExpression(e.Alternative)
+	case *ast.WhileExpression:
+		s.resolveExpression(e.Condition)
+		s.resolveExpression(e.Body)
+	case *ast.BlockExpression:
+		for _, expr := range e.Expressions {
+			s.resolveExpression(expr)
+		}
+	case *ast.LetExpression:
+		for _, binding := range e.Bindings {
+			s.resolve(binding.Type)
+			s.resolveExpression(binding.Init)
+		}
+		s.resolveExpression(e.In)
+	case *ast.NewExpression:
+		s.resolve(e.Type)
+	case *ast.IsVoidExpression:
+		s.resolveExpression(e.Expression)
+	case *ast.Assignment:
+		s.resolveExpression(e.Value)
+	case *ast.DynamicDispatch:
+		s.resolveExpression(e.Object)
+		for _, arg := range e.Arguments {
+			s.resolveExpression(arg)
+		}
+	case *ast.StaticDispatch:
+		s.resolveExpression(e.Object)
+		s.resolve(e.Type)
+		for _, arg := range e.Arguments {
+			s.resolveExpression(arg)
+		}
+	case *ast.CaseExpression:
+		s.resolveExpression(e.Expr)
+		for _, branch := range e.Branches {
+			s.resolve(branch.Type)
+			s.resolveExpression(branch.Expr)
+		}
+	}
+}
@@ -1,102 +1,275 @@
 package preprocessor
 
 import (
-	"bufio"
+	"coolz-compiler/ast"
+	"coolz-compiler/diagnostic"
+	"coolz-compiler/lexer"
+	"coolz-compiler/parser"
+	"coolz-compiler/stdlib"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 )
 
+// stdlibPrefix names the files of the standard library in diagnostics and
+// runtime errors, e.g. <stdlib>/collections/list.cl.
+const stdlibPrefix = "<stdlib>/"
+
+// Preprocessor loads a program together with the modules it imports. Each
+// file is parsed into its own ast.Program and the classes are merged into
+// one program, imported modules first. A module imported from several
+// places is included once. The Main class of an imported module is dropped
+// so that only the root file provides the entry point.
+//
+// Each module has its own namespace. Its classes are qualified with the
+// module name in the merged program, and the names a file uses are resolved
+// against what it imports: import m; makes every class of m visible,
+// from m import A, B; only A and B, and import m as M; makes them visible
+// as M.A and M.B. Classes of the root file keep their names.
+//
+// An import names a module relative to a search root, with dots separating
+// directories: import collections.list; looks for collections/list.cl in
+// the importing file's directory, then in each include path, then in the
+// standard library. Modules of the standard library only import each other.
 type Preprocessor struct {
-	processedFiles map[string]bool
-	originalFile   string // Track the original file being compiled
+	modules      map[string]*Module // Modules already merged, by absolute path
+	names        map[string]string  // Module names in use -> the module's path
+	loading      []string           // Files being loaded, outermost first
+	originalFile string             // Track the original file being compiled
+	includePaths []string           // Directories searched after the importing file's
+	stdlib       fs.FS              // Searched last, nil if there is none
 }
 
 func New() *Preprocessor {
 	return &Preprocessor{
-		processedFiles: make(map[string]bool),
-		originalFile:   "",
+		modules:      make(map[string]*Module),
+		names:        make(map[string]string),
+		originalFile: "",
+		stdlib:       stdlib.FS,
+	}
+}
+
+// AddIncludePath appends dir to the directories searched for imported
+// modules.
+func (p *Preprocessor) AddIncludePath(dir string) {
+	p.includePaths = append(p.includePaths, dir)
+}
+
+// SetStdlib replaces the embedded standard library. A nil fsys leaves
+// imports to the file system.
+func (p *Preprocessor) SetStdlib(fsys fs.FS) {
+	p.stdlib = fsys
+}
+
+// ProcessFile loads filename and everything it imports.
+func (p *Preprocessor) ProcessFile(filename string) (*ast.Program, []*diagnostic.Diagnostic) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, []*diagnostic.Diagnostic{diagnostic.New(diagnostic.CodeIO, filename, "%v", err)}
 	}
+	return p.ProcessSource(filename, content)
 }
 
-func (p *Preprocessor) ProcessFile(filename string) (string, error) {
+// ProcessSource is like ProcessFile but takes the content of the root file
+// directly, e.g. when it is read from stdin. Imports are resolved relative
+// to the directory of filename.
+func (p *Preprocessor) ProcessSource(filename string, content []byte) (*ast.Program, []*diagnostic.Diagnostic) {
 	if p.originalFile == "" {
 		p.originalFile = filename
 	}
+	return p.load(filename, "", content)
+}
 
-	if p.processedFiles[filename] {
-		return "", fmt.Errorf("circular import detected: %s", filename)
+// load parses one file and, recursively, the modules it imports. name
+// qualifies the file's classes.
+func (p *Preprocessor) load(filename, name string, content []byte) (*ast.Program, []*diagnostic.Diagnostic) {
+	p.loading = append(p.loading, filename)
+	defer func() { p.loading = p.loading[:len(p.loading)-1] }()
+
+	program, errs := Parse(filename, content)
+	if len(errs) > 0 {
+		return nil, errs
 	}
 
-	p.processedFiles[filename] = true
+	classes := program.Classes
+	if filename != p.originalFile {
+		classes = ModuleClasses(program)
+	}
+	own := NewModule(name, ClassNames(classes))
+	p.modules[ModuleKey(filename)] = own
 
-	content, err := os.ReadFile(filename)
+	merged := &ast.Program{}
+	if filename == p.originalFile {
+		merged.Imports = program.Imports
+	}
+
+	var diags []*diagnostic.Diagnostic
+	var modules []*Module
+	for _, imp := range program.Imports {
+		imported, m, errs := p.loadImport(filename, imp)
+		if len(errs) > 0 {
+			diags = append(diags, errs...)
+			continue
+		}
+		if imported != nil {
+			merged.Classes = append(merged.Classes, imported.Classes...)
+		}
+		modules = append(modules, m)
+	}
+	if len(diags) > 0 {
+		return nil, diags
+	}
+
+	if errs := Resolve(filename, own, classes, program.Imports, modules); len(errs) > 0 {
+		return nil, errs
+	}
+	merged.Classes = append(merged.Classes, classes...)
+	return merged, nil
+}
+
+// loadImport loads the module imp of filename refers to, reporting
+// problems at the import declaration. It returns the module's classes
+// together with those it imports, or a nil program if the module has
+// already been loaded.
+func (p *Preprocessor) loadImport(filename string, imp *ast.Import) (*ast.Program, *Module, []*diagnostic.Diagnostic) {
+	moduleFile, content, err := p.Find(filename, imp)
 	if err != nil {
-		return "", err
+		return nil, nil, []*diagnostic.Diagnostic{err}
+	}
+
+	key := ModuleKey(moduleFile)
+	if err := CheckCycle(p.loading, filename, imp, moduleFile); err != nil {
+		return nil, nil, []*diagnostic.Diagnostic{err}
+	}
+	if m, ok := p.modules[key]; ok {
+		return nil, m, nil
 	}
+	program, errs := p.load(moduleFile, p.UniqueName(imp.Module.Value, key), content)
+	return program, p.modules[key], errs
+}
 
-	processed := ""
-	scanner := bufio.NewScanner(strings.NewReader(string(content)))
+// CheckCycle reports an import cycle if moduleFile, which filename imports
+// through imp, is among the files being loaded, outermost first.
+func CheckCycle(loading []string, filename string, imp *ast.Import, moduleFile string) *diagnostic.Diagnostic {
+	key := ModuleKey(moduleFile)
+	for i, file := range loading {
+		if ModuleKey(file) == key {
+			chain := append(append([]string{}, loading[i:]...), moduleFile)
+			return diagnostic.At(diagnostic.CodeImport, filename, imp.Module.Token,
+				"circular import detected: %s", strings.Join(chain, " -> "))
+		}
+	}
+	return nil
+}
 
-	inMainClass := false
-	mainClassDepth := 0
+// Parse parses the content of one file without loading its imports.
+func Parse(filename string, content []byte) (*ast.Program, []*diagnostic.Diagnostic) {
+	l := lexer.NewLexer(strings.NewReader(string(content)))
+	l.SetFilename(filename)
+	ps := parser.New(l)
+	ps.SetFilename(filename)
+	program := ps.ParseProgram()
+	if len(ps.Errors()) > 0 {
+		return nil, ps.Errors()
+	}
+	return program, nil
+}
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		trimmedLine := strings.TrimSpace(line)
+// ModuleClasses returns the classes program contributes when it is
+// imported: all but its Main class.
+func ModuleClasses(program *ast.Program) []*ast.Class {
+	var classes []*ast.Class
+	for _, class := range program.Classes {
+		if !isMainClass(class) {
+			classes = append(classes, class)
+		}
+	}
+	return classes
+}
 
-		if strings.HasPrefix(trimmedLine, "import") {
-			// Extract module name from import statement
-			parts := strings.Split(strings.TrimSpace(line), " ")
-			if len(parts) != 2 {
-				return "", fmt.Errorf("invalid import statement: %s", line)
-			}
+// ClassNames returns the declared names of classes.
+func ClassNames(classes []*ast.Class) []string {
+	names := make([]string, len(classes))
+	for i, class := range classes {
+		names[i] = class.Name.Value
+	}
+	return names
+}
 
-			moduleName := strings.TrimSuffix(parts[1], ";")
-			moduleFile := filepath.Join(filepath.Dir(filename), moduleName+".cl")
+// UniqueName returns the name to qualify the module at key with. Two files
+// imported under the same name, such as util.cl in different directories,
+// are told apart by a numeric suffix on the second.
+func (p *Preprocessor) UniqueName(name, key string) string {
+	unique := name
+	for i := 2; ; i++ {
+		if owner, ok := p.names[unique]; !ok || owner == key {
+			p.names[unique] = key
+			return unique
+		}
+		unique = fmt.Sprintf("%s#%d", name, i)
+	}
+}
 
-			// Process the imported file
-			importedContent, err := p.ProcessFile(moduleFile)
-			if err != nil {
-				return "", fmt.Errorf("error processing import %s: %v", moduleFile, err)
-			}
+// Find searches for the module imp of filename names and returns its file
+// name and content. If no search root has it, the diagnostic lists every
+// path that was tried.
+func (p *Preprocessor) Find(filename string, imp *ast.Import) (string, []byte, *diagnostic.Diagnostic) {
+	parts := strings.Split(imp.Module.Value, ".")
+	var tried []string
 
-			processed += importedContent + "\n"
-		} else {
-			// Check for main class start
-			if strings.HasPrefix(trimmedLine, "class Main") {
-				inMainClass = true
-				mainClassDepth = 0
-				// Skip this line if we're processing an imported file
-				if filename != p.originalFile {
-					continue
-				}
+	if !strings.HasPrefix(filename, stdlibPrefix) {
+		dirs := append([]string{filepath.Dir(filename)}, p.includePaths...)
+		for _, dir := range dirs {
+			moduleFile := filepath.Join(append([]string{dir}, parts...)...) + ".cl"
+			content, err := os.ReadFile(moduleFile)
+			if err == nil {
+				return moduleFile, content, nil
 			}
-
-			// Count braces to track class scope
-			if inMainClass {
-				mainClassDepth += strings.Count(line, "{")
-				mainClassDepth -= strings.Count(line, "}")
-
-				// If we've reached the end of main class
-				if mainClassDepth < 0 {
-					inMainClass = false
-					// Skip this line if we're processing an imported file
-					if filename != p.originalFile {
-						continue
-					}
-				}
-
-				// Skip all lines within main class for imported files
-				if filename != p.originalFile {
-					continue
-				}
+			if !errors.Is(err, fs.ErrNotExist) {
+				return "", nil, diagnostic.At(diagnostic.CodeImport, filename, imp.Module.Token,
+					"cannot import %s: %v", imp.Module.Value, err)
 			}
+			tried = append(tried, moduleFile)
+		}
+	}
 
-			processed += line + "\n"
+	if p.stdlib != nil {
+		name := path.Join(parts...) + ".cl"
+		content, err := fs.ReadFile(p.stdlib, name)
+		if err == nil {
+			return stdlibPrefix + name, content, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", nil, diagnostic.At(diagnostic.CodeImport, filename, imp.Module.Token,
+				"cannot import %s: %v", imp.Module.Value, err)
 		}
+		tried = append(tried, stdlibPrefix+name)
 	}
 
-	return processed, nil
+	d := diagnostic.At(diagnostic.CodeImport, filename, imp.Module.Token,
+		"cannot import %s: module not found", imp.Module.Value)
+	for _, moduleFile := range tried {
+		d.Notes = append(d.Notes, "tried "+moduleFile)
+	}
+	return "", nil, d
+}
+
+// ModuleKey identifies a module file independently of how its path was
+// spelled in the import chain.
+func ModuleKey(filename string) string {
+	if strings.HasPrefix(filename, stdlibPrefix) {
+		return filename
+	}
+	if abs, err := filepath.Abs(filename); err == nil {
+		return abs
+	}
+	return filepath.Clean(filename)
+}
+
+func isMainClass(class *ast.Class) bool {
+	return class.Name != nil && class.Name.Value == "Main"
 }
@@ -0,0 +1,339 @@
+package preprocessor
+
+import (
+	"coolz-compiler/parser"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// writeFiles creates the given files in a fresh directory and returns it.
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func classNames(t *testing.T, dir, root string) []string {
+	t.Helper()
+	program, diags := New().ProcessFile(filepath.Join(dir, root))
+	if len(diags) > 0 {
+		t.Fatalf("unexpected errors: %v", diags)
+	}
+	var names []string
+	for _, class := range program.Classes {
+		names = append(names, class.Name.Value)
+	}
+	return names
+}
+
+func TestImportsMergeClasses(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"util.cl": `
+-- class Main { main() : Object { 0 }; };
+class Util {
+    brace() : String { "}}{" };
+};
+(* class Main *)
+class Main { main() : Object { 0 }; };
+`,
+		"other.cl": `class Other { s : String <- "{"; };`,
+		"main.cl": `import util; import other;
+class Main { main() : Object { new Util }; };
+`,
+	})
+
+	got := strings.Join(classNames(t, dir, "main.cl"), " ")
+	if got != "util.Util other.Other Main" {
+		t.Errorf("expected classes util.Util other.Other Main, got %s", got)
+	}
+}
+
+func TestDiamondImports(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"util.cl": "class Util {};",
+		"a.cl":    "import util;\nclass A inherits Util {};",
+		"b.cl":    "import util;\nclass B inherits Util {};",
+		"main.cl": "import a; import b; import util;\nclass Main {};",
+	})
+
+	got := strings.Join(classNames(t, dir, "main.cl"), " ")
+	if got != "util.Util a.A b.B Main" {
+		t.Errorf("expected classes util.Util a.A b.B Main, got %s", got)
+	}
+}
+
+func TestImportErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    map[string]string
+		expected string
+	}{
+		{
+			"Missing Module",
+			map[string]string{"main.cl": "import nothere;\nclass Main {};"},
+			"main.cl:1:8: cannot import nothere",
+		},
+		{
+			"Self Import",
+			map[string]string{"main.cl": "import main;\nclass Main {};"},
+			"main.cl:1:8: circular import detected",
+		},
+		{
+			"Import Cycle",
+			map[string]string{
+				"main.cl": "import a;\nclass Main {};",
+				"a.cl":    "import b;\nclass A {};",
+				"b.cl":    "\nimport a;\nclass B {};",
+			},
+			"b.cl:2:8: circular import detected: ",
+		},
+		{
+			"Syntax Error In Module",
+			map[string]string{
+				"main.cl": "import util;\nclass Main {};",
+				"util.cl": "import ;",
+			},
+			"util.cl:1:8: expected module name after import, got SEMI",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeFiles(t, tt.files)
+			_, diags := New().ProcessFile(filepath.Join(dir, "main.cl"))
+			if len(diags) != 1 {
+				t.Fatalf("expected 1 error, got %v", diags)
+			}
+			if got := diags[0].Error(); !strings.HasPrefix(got, filepath.Join(dir, tt.expected)) {
+				t.Errorf("expected an error starting with %q, got %q", filepath.Join(dir, tt.expected), got)
+			}
+		})
+	}
+}
+
+func TestImportCycleChain(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.cl": "import a;\nclass Main {};",
+		"a.cl":    "import b;\nclass A {};",
+		"b.cl":    "import a;\nclass B {};",
+	})
+
+	_, diags := New().ProcessFile(filepath.Join(dir, "main.cl"))
+	if len(diags) != 1 {
+		t.Fatalf("expected 1 error, got %v", diags)
+	}
+	a, b := filepath.Join(dir, "a.cl"), filepath.Join(dir, "b.cl")
+	if !strings.HasSuffix(diags[0].Message, a+" -> "+b+" -> "+a) {
+		t.Errorf("expected the cycle a -> b -> a in %q", diags[0].Message)
+	}
+}
+
+func TestTokensRecordTheirFile(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"util.cl": "\n\nclass Util { f() : Int { 1 }; };",
+		"main.cl": "import util;\nclass Main { main() : Object { new Util }; };",
+	})
+
+	program, diags := New().ProcessFile(filepath.Join(dir, "main.cl"))
+	if len(diags) > 0 {
+		t.Fatalf("unexpected errors: %v", diags)
+	}
+
+	tests := []struct {
+		file string
+		line int
+	}{
+		{"util.cl", 3},
+		{"main.cl", 2},
+	}
+	for i, tt := range tests {
+		tok := program.Classes[i].Name.Token
+		if tok.File != filepath.Join(dir, tt.file) || tok.Line != tt.line {
+			t.Errorf("class %s: expected %s:%d, got %s:%d", program.Classes[i].Name.Value, tt.file, tt.line, tok.File, tok.Line)
+		}
+	}
+}
+
+func TestSearchPaths(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main/main.cl":          "import util; import shapes.circle; import collections.list;\nclass Main {};",
+		"main/util.cl":          "class LocalUtil {};",
+		"lib/util.cl":           "class LibUtil {};",
+		"lib/shapes/circle.cl":  "class Circle {};",
+		"more/shapes/circle.cl": "class OtherCircle {};",
+	})
+	stdlib := fstest.MapFS{
+		"collections/list.cl": {Data: []byte("import util;\nclass List {};")},
+		"util.cl":             {Data: []byte("class StdUtil {};")},
+	}
+
+	p := New()
+	p.AddIncludePath(filepath.Join(dir, "lib"))
+	p.AddIncludePath(filepath.Join(dir, "more"))
+	p.SetStdlib(stdlib)
+	program, diags := p.ProcessFile(filepath.Join(dir, "main", "main.cl"))
+	if len(diags) > 0 {
+		t.Fatalf("unexpected errors: %v", diags)
+	}
+
+	// The importing file's directory wins over the include paths, which are
+	// searched in order, and the standard library only sees itself.
+	var names []string
+	for _, class := range program.Classes {
+		names = append(names, class.Name.Value)
+	}
+	expected := "util.LocalUtil shapes.circle.Circle util#2.StdUtil collections.list.List Main"
+	if got := strings.Join(names, " "); got != expected {
+		t.Errorf("expected classes %s, got %s", expected, got)
+	}
+	if file := program.Classes[3].Name.Token.File; file != "<stdlib>/collections/list.cl" {
+		t.Errorf("expected List to come from <stdlib>/collections/list.cl, got %s", file)
+	}
+}
+
+func TestUnresolvedImportListsTriedPaths(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"main.cl": "import shapes.square;\nclass Main {};"})
+	lib := filepath.Join(dir, "lib")
+
+	p := New()
+	p.AddIncludePath(lib)
+	_, diags := p.ProcessFile(filepath.Join(dir, "main.cl"))
+	if len(diags) != 1 {
+		t.Fatalf("expected 1 error, got %v", diags)
+	}
+
+	d := diags[0]
+	if d.Message != "cannot import shapes.square: module not found" {
+		t.Errorf("unexpected message %q", d.Message)
+	}
+	if d.EndColumn-d.Column != len("shapes.square") {
+		t.Errorf("expected the error to span the module name, got columns %d-%d", d.Column, d.EndColumn)
+	}
+	expected := []string{
+		"tried " + filepath.Join(dir, "shapes", "square.cl"),
+		"tried " + filepath.Join(lib, "shapes", "square.cl"),
+		"tried <stdlib>/shapes/square.cl",
+	}
+	if strings.Join(d.Notes, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected notes %q, got %q", expected, d.Notes)
+	}
+}
+
+func TestStandardLibrary(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.cl": "import collections.list; import convert;\nclass Main {};",
+	})
+
+	got := strings.Join(classNames(t, dir, "main.cl"), " ")
+	if got != "collections.list.List collections.list.Cons convert.Convert Main" {
+		t.Errorf("expected classes collections.list.List collections.list.Cons convert.Convert Main, got %s", got)
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"shapes.cl":   "class Point {}; class List {};",
+		"geometry.cl": "class Point {}; class Vector inherits Point { p : Point; };",
+		"main.cl": `import collections.list as L; import shapes as S;
+from geometry import Vector, Point;
+class List inherits L.List {};
+class Main {
+    a : L.List <- new L.Cons;
+    b : List;
+    c : Point <- case a of p : S.Point => p; v : Vector => v@Point.copy(); esac;
+};`,
+	})
+
+	program, diags := New().ProcessFile(filepath.Join(dir, "main.cl"))
+	if len(diags) > 0 {
+		t.Fatalf("unexpected errors: %v", diags)
+	}
+	expected := `import collections.list as L;
+import shapes as S;
+from geometry import Vector, Point;
+class collections.list.List {
+    isNil() : Bool { true };
+`
+	if got := parser.SerializeProgram(program); !strings.HasPrefix(got, expected) {
+		t.Errorf("expected the program to start with\n%s\ngot:\n%s", expected, got)
+	}
+
+	// A module's own classes are qualified wherever they are referred to,
+	// and the root file's classes keep their names.
+	expected = `class geometry.Vector inherits geometry.Point {
+    p : geometry.Point;
+};
+class List inherits collections.list.List {
+};
+class Main {
+    a : collections.list.List <- new collections.list.Cons;
+    b : List;
+    c : geometry.Point <- case a of p : shapes.Point => p; v : geometry.Vector => v@geometry.Point.copy() esac;
+};
+`
+	if got := parser.SerializeProgram(program); !strings.HasSuffix(got, expected) {
+		t.Errorf("expected the program to end with\n%s\ngot:\n%s", expected, got)
+	}
+}
+
+func TestNamespaceErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		main     string
+		expected string
+	}{
+		{
+			"Ambiguous Name",
+			"import a; import b;\nclass Main { x : Util; };",
+			"main.cl:2:18: ambiguous class name Util: could be a.Util or b.Util",
+		},
+		{
+			"Unknown Alias",
+			"import a as A;\nclass Main { x : B.Util; };",
+			"main.cl:2:18: unknown module alias B",
+		},
+		{
+			"Missing Class Through Alias",
+			"import a as A;\nclass Main { x : A.Other; };",
+			"main.cl:2:18: module a has no class Other",
+		},
+		{
+			"Missing Class In From Import",
+			"from a import Util, Other;\nclass Main {};",
+			"main.cl:1:21: module a has no class Other",
+		},
+		{
+			"Duplicate Alias",
+			"import a as M; import b as M;\nclass Main {};",
+			"main.cl:1:28: module alias M is already in use",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeFiles(t, map[string]string{
+				"a.cl":    "class Util {};",
+				"b.cl":    "class Util {};",
+				"main.cl": tt.main,
+			})
+			_, diags := New().ProcessFile(filepath.Join(dir, "main.cl"))
+			if len(diags) != 1 {
+				t.Fatalf("expected 1 error, got %v", diags)
+			}
+			if got := diags[0].Error(); got != filepath.Join(dir, tt.expected) {
+				t.Errorf("expected %q, got %q", filepath.Join(dir, tt.expected), got)
+			}
+		})
+	}
+}
@@ -2,8 +2,33 @@ package semant
 
 import (
 	"coolz-compiler/ast"
+	"coolz-compiler/diagnostic"
 	"coolz-compiler/lexer"
 	"fmt"
+	"log"
+	"sort"
+)
+
+// Error is a semantic error located at the token that caused it.
+type Error = diagnostic.Diagnostic
+
+// ErrorCode identifies the kind of a semantic error. The codes are those of
+// the diagnostics reporting the errors.
+type ErrorCode string
+
+const (
+	ErrMissingMain         ErrorCode = "missing-main"         // no Main class, or no main() : Object in it
+	ErrUndefinedClass      ErrorCode = "undefined-class"      // a type name that names no class
+	ErrRedefinition        ErrorCode = "redefinition"         // a class, attribute or parameter defined twice
+	ErrBasicInheritance    ErrorCode = "basic-inheritance"    // a class inheriting from Int, String or Bool
+	ErrCyclicInheritance   ErrorCode = "cyclic-inheritance"   // a class among its own ancestors
+	ErrInvalidOverride     ErrorCode = "invalid-override"     // an override with a different signature
+	ErrUndefinedMethod     ErrorCode = "undefined-method"     // a dispatch to a method the class lacks
+	ErrArity               ErrorCode = "arity"                // a dispatch with the wrong number of arguments
+	ErrUndefinedIdentifier ErrorCode = "undefined-identifier" // a name that is not in scope
+	ErrInvalidAssignment   ErrorCode = "invalid-assignment"   // an assignment to self
+	ErrTypeMismatch        ErrorCode = "type-mismatch"        // an expression whose type does not fit its use
+	ErrUnknownOperator     ErrorCode = "unknown-operator"     // an operator semantic analysis does not know
 )
 
 type SymbolTable struct {
@@ -41,59 +66,94 @@ func (st *SymbolTable) Lookup(name string) (*SymbolEntry, bool) {
 
 type SemanticAnalyser struct {
 	globalSymbolTable *SymbolTable
-	errors            []string
+	errors            []*Error
 	currentClass      string // Track current class during type checking
+	filename          string
+	logger            *log.Logger
+	types             ast.TypeTable
+	library           bool // Analyse a module without requiring a Main class, see SetLibrary
 }
 
 func NewSemanticAnalyser() *SemanticAnalyser {
 	return &SemanticAnalyser{
 		globalSymbolTable: NewSymbolTable(nil),
-		errors:            []string{},
+		errors:            []*Error{},
+		types:             make(ast.TypeTable),
 	}
 }
 
-func (sa *SemanticAnalyser) Errors() []string {
+func (sa *SemanticAnalyser) Errors() []*Error {
 	return sa.errors
 }
 
+// Types returns the static type inferred for each expression of the analysed
+// program. SELF_TYPE is left unresolved.
+func (sa *SemanticAnalyser) Types() ast.TypeTable {
+	return sa.types
+}
+
+// SetFilename sets the file name reported in errors whose token does not
+// carry one.
+func (sa *SemanticAnalyser) SetFilename(filename string) {
+	sa.filename = filename
+}
+
+// SetLogger enables tracing of the analysis. A nil logger disables it.
+func (sa *SemanticAnalyser) SetLogger(logger *log.Logger) {
+	sa.logger = logger
+}
+
+// SetLibrary analyses the program as a module compiled on its own and linked
+// with the program that imports it, which need not define Main.
+func (sa *SemanticAnalyser) SetLibrary(library bool) {
+	sa.library = library
+}
+
+func (sa *SemanticAnalyser) logf(format string, args ...interface{}) {
+	if sa.logger != nil {
+		sa.logger.Printf(format, args...)
+	}
+}
+
+// errorf records an error of kind code at the position of tok.
+func (sa *SemanticAnalyser) errorf(code ErrorCode, tok lexer.Token, format string, args ...interface{}) {
+	sa.errors = append(sa.errors, diagnostic.At(string(code), sa.filename, tok, format, args...))
+}
+
 func (sa *SemanticAnalyser) Analyze(program *ast.Program) {
-	fmt.Println("Starting semantic analysis...")
-	fmt.Printf("Number of classes: %d\n", len(program.Classes))
+	sa.logf("Starting semantic analysis...")
+	sa.logf("Number of classes: %d", len(program.Classes))
 	sa.buildClassesSymboltables(program)
-	fmt.Printf("Built class symbol tables. Errors so far: %d\n", len(sa.errors))
+	sa.logf("Built class symbol tables. Errors so far: %d", len(sa.errors))
+	if len(sa.errors) > 0 {
+		// Type checking walks the inheritance graph, which must be sound
+		return
+	}
 	sa.buildSymboltables(program)
-	fmt.Printf("Built all symbol tables. Errors so far: %d\n", len(sa.errors))
+	sa.logf("Built all symbol tables. Errors so far: %d", len(sa.errors))
 	sa.typeCheck(program)
-	fmt.Printf("Completed type checking. Errors so far: %d\n", len(sa.errors))
-	sa.checkMainClass()
-	fmt.Printf("Final error count: %d\n", len(sa.errors))
+	sa.logf("Completed type checking. Errors so far: %d", len(sa.errors))
 
-	foundMain := false
-	for _, class := range program.Classes {
-		if class.Name.Value == "Main" {
-			foundMain = true
-			break
-		}
-	}
-	if foundMain {
-		sa.checkMainClass() // Only check if Main exists
+	if !sa.library {
+		sa.checkMainClass(program)
 	}
+	sa.logf("Final error count: %d", len(sa.errors))
 }
 
-func (sa *SemanticAnalyser) checkMainClass() {
+func (sa *SemanticAnalyser) checkMainClass(program *ast.Program) {
 	mainEntry, ok := sa.globalSymbolTable.Lookup("Main")
 	if !ok {
-		sa.errors = append(sa.errors, "Main class not defined")
+		sa.errorf(ErrMissingMain, program.Token, "Main class not defined")
 		return
 	}
 	methodEntry, ok := mainEntry.Scope.Lookup("main")
-	if !ok {
-		sa.errors = append(sa.errors, "Main class must have method main() : Object")
+	if !ok || methodEntry.Method == nil {
+		sa.errorf(ErrMissingMain, mainEntry.Token, "Main class must have method main() : Object")
 		return
 	}
 	method := methodEntry.Method
 	if len(method.Formals) != 0 {
-		sa.errors = append(sa.errors, "Main class main method must have no parameters")
+		sa.errorf(ErrMissingMain, methodEntry.Token, "Main class main method must have no parameters")
 	}
 	// Ensure return type is Object or SELF_TYPE
 	expectedType := method.Type.Value
@@ -101,29 +161,35 @@ func (sa *SemanticAnalyser) checkMainClass() {
 		expectedType = "Main"
 	}
 	if expectedType != "Object" {
-		sa.errors = append(sa.errors, "Main class main method must return Object")
+		sa.errorf(ErrMissingMain, method.Type.Token, "Main class main method must return Object")
 	}
 }
 
+// typeCheck checks the features of every class. External classes come from
+// a module interface, which has no bodies, and were checked when their
+// module was compiled.
 func (sa *SemanticAnalyser) typeCheck(program *ast.Program) {
 	for _, class := range program.Classes {
+		if class.External {
+			continue
+		}
 		classEntry, _ := sa.globalSymbolTable.Lookup(class.Name.Value)
 		sa.typeCheckClass(class, classEntry.Scope)
 	}
 }
 
 func (sa *SemanticAnalyser) typeCheckClass(cls *ast.Class, st *SymbolTable) {
-	fmt.Printf("Type checking class: %s\n", cls.Name.Value)
+	sa.logf("Type checking class: %s", cls.Name.Value)
 	sa.currentClass = cls.Name.Value
 	defer func() { sa.currentClass = "" }()
 
 	for _, feature := range cls.Features {
 		switch f := feature.(type) {
 		case *ast.Attribute:
-			fmt.Printf("Checking attribute: %s\n", f.Name.Value)
+			sa.logf("Checking attribute: %s", f.Name.Value)
 			sa.typeCheckAttribute(f, st)
 		case *ast.Method:
-			fmt.Printf("Checking method: %s\n", f.Name.Value)
+			sa.logf("Checking method: %s", f.Name.Value)
 			sa.typeCheckMethod(f, st)
 		}
 	}
@@ -131,14 +197,16 @@ func (sa *SemanticAnalyser) typeCheckClass(cls *ast.Class, st *SymbolTable) {
 
 func (sa *SemanticAnalyser) typeCheckAttribute(attr *ast.Attribute, st *SymbolTable) {
 	if attr.Init != nil {
-		exprType := sa.getExpressionType(attr.Init, st)
+		// Every attribute of the class is in scope, including the ones
+		// initialized later, which still hold their default values
+		exprType := sa.getExpressionType(attr.Init, NewSymbolTable(st))
 		expectedType := attr.Type.Value
 		if expectedType == "SELF_TYPE" {
 			expectedType = sa.currentClass
 		}
 		if !sa.isTypeConformant(exprType, expectedType) {
-			sa.errors = append(sa.errors, fmt.Sprintf("attribute %s cannot be of type %s, expected %s",
-				attr.Name.Value, exprType, expectedType))
+			sa.errorf(ErrTypeMismatch, attr.Name.Token, "attribute %s cannot be of type %s, expected %s",
+				attr.Name.Value, exprType, expectedType)
 		}
 	}
 }
@@ -154,8 +222,8 @@ func (sa *SemanticAnalyser) typeCheckMethod(method *ast.Method, st *SymbolTable)
 		expectedType = sa.currentClass
 	}
 	if !sa.isTypeConformant(exprType, expectedType) {
-		sa.errors = append(sa.errors, fmt.Sprintf("method %s expects return type %s, got %s",
-			method.Name.Value, expectedType, exprType))
+		sa.errorf(ErrTypeMismatch, method.Name.Token, "method %s expects return type %s, got %s",
+			method.Name.Value, expectedType, exprType)
 	}
 
 	// Check method override
@@ -170,16 +238,16 @@ func (sa *SemanticAnalyser) typeCheckMethod(method *ast.Method, st *SymbolTable)
 		if ok && parentMethodEntry.Method != nil {
 			parentMethod := parentMethodEntry.Method
 			if len(method.Formals) != len(parentMethod.Formals) {
-				sa.errors = append(sa.errors, fmt.Sprintf("method %s has different number of parameters", method.Name.Value))
+				sa.errorf(ErrInvalidOverride, method.Name.Token, "method %s has different number of parameters", method.Name.Value)
 			} else {
 				for i, f := range method.Formals {
 					if f.Type.Value != parentMethod.Formals[i].Type.Value {
-						sa.errors = append(sa.errors, fmt.Sprintf("method %s parameter %d type mismatch", method.Name.Value, i+1))
+						sa.errorf(ErrInvalidOverride, f.Type.Token, "method %s parameter %d type mismatch", method.Name.Value, i+1)
 					}
 				}
 			}
 			if method.Type.Value != parentMethod.Type.Value {
-				sa.errors = append(sa.errors, fmt.Sprintf("method %s has incompatible return type", method.Name.Value))
+				sa.errorf(ErrInvalidOverride, method.Type.Token, "method %s has incompatible return type", method.Name.Value)
 			}
 			break
 		}
@@ -188,7 +256,7 @@ func (sa *SemanticAnalyser) typeCheckMethod(method *ast.Method, st *SymbolTable)
 }
 
 func (sa *SemanticAnalyser) isTypeConformant(subType, superType string) bool {
-	if subType == superType {
+	if subType == superType || subType == noType {
 		return true
 	}
 	if subType == "SELF_TYPE" {
@@ -215,13 +283,20 @@ func (sa *SemanticAnalyser) isTypeConformant(subType, superType string) bool {
 	return false
 }
 
+// getExpressionType infers the static type of expr and records it in the
+// type table.
 func (sa *SemanticAnalyser) getExpressionType(expr ast.Expression, st *SymbolTable) string {
 	if expr == nil {
-		fmt.Println("Warning: nil expression in getExpressionType")
+		sa.logf("Warning: nil expression in getExpressionType")
 		return "Object"
 	}
-	typ := fmt.Sprintf("%T", expr)
-	fmt.Printf("Getting type for expression: %s\n", typ)
+	sa.logf("Getting type for expression: %T", expr)
+	typ := sa.inferExpressionType(expr, st)
+	sa.types[expr] = typ
+	return typ
+}
+
+func (sa *SemanticAnalyser) inferExpressionType(expr ast.Expression, st *SymbolTable) string {
 	switch e := expr.(type) {
 	case *ast.IntegerLiteral:
 		return "Int"
@@ -248,6 +323,7 @@ func (sa *SemanticAnalyser) getExpressionType(expr ast.Expression, st *SymbolTab
 	case *ast.CaseExpression:
 		return sa.GetCaseExpressionType(e, st)
 	case *ast.IsVoidExpression:
+		sa.getExpressionType(e.Expression, st)
 		return "Bool"
 	case *ast.ObjectIdentifier:
 		return sa.getObjectIdentifierType(e, st)
@@ -255,6 +331,8 @@ func (sa *SemanticAnalyser) getExpressionType(expr ast.Expression, st *SymbolTab
 		return "SELF_TYPE"
 	case *ast.StaticDispatch:
 		return sa.handleStaticDispatch(e, st)
+	case *ast.DynamicDispatch:
+		return sa.handleDynamicDispatch(e, st)
 	default:
 		return "Object"
 	}
@@ -264,69 +342,214 @@ func (sa *SemanticAnalyser) handleStaticDispatch(sd *ast.StaticDispatch, st *Sym
 	exprType := sa.getExpressionType(sd.Object, st) // Use sd.Object instead of sd.Expr
 	staticType := sd.Type.Value
 
+	if _, ok := sa.globalSymbolTable.Lookup(staticType); !ok {
+		sa.errorf(ErrUndefinedClass, sd.Type.Token, "undefined type %s", staticType)
+		sa.typeArguments(sd.Arguments, st)
+		return noType
+	}
 	if !sa.isTypeConformant(exprType, staticType) {
-		sa.errors = append(sa.errors, fmt.Sprintf("type %s does not conform to %s", exprType, staticType))
+		sa.errorf(ErrTypeMismatch, sd.Type.Token, "type %s does not conform to %s", exprType, staticType)
+		sa.typeArguments(sd.Arguments, st)
+		return noType
 	}
 
-	// Check method exists in staticType
-	entry, ok := sa.globalSymbolTable.Lookup(staticType)
+	// Check method exists in staticType or one of its ancestors
+	methodEntry, ok := sa.lookupMethod(staticType, sd.Method.Value)
 	if !ok {
-		sa.errors = append(sa.errors, fmt.Sprintf("undefined type %s", staticType))
-		return "Object"
+		sa.errorf(ErrUndefinedMethod, sd.Method.Token, "method %s not defined in type %s", sd.Method.Value, staticType)
+		sa.typeArguments(sd.Arguments, st)
+		return noType
 	}
-	methodEntry, ok := entry.Scope.Lookup(sd.Method.Value)
-	if !ok {
-		sa.errors = append(sa.errors, fmt.Sprintf("method %s not defined in type %s", sd.Method.Value, staticType))
-		return "Object"
+	sa.checkArguments(sd.Method, methodEntry.Method, sd.Arguments, st)
+
+	// The receiver keeps its own type when the method returns SELF_TYPE
+	if methodEntry.Type == "SELF_TYPE" {
+		return exprType
 	}
+	return methodEntry.Type
+}
 
-	// Check parameters
-	if len(sd.Arguments) != len(methodEntry.Method.Formals) { // Use sd.Arguments instead of sd.Args
-		sa.errors = append(sa.errors, fmt.Sprintf("method %s expects %d parameters, got %d", sd.Method.Value, len(methodEntry.Method.Formals), len(sd.Arguments)))
-	} else {
-		for i, arg := range sd.Arguments { // Use sd.Arguments instead of sd.Args
-			argType := sa.getExpressionType(arg, st)
-			formalType := methodEntry.Method.Formals[i].Type.Value
-			if !sa.isTypeConformant(argType, formalType) {
-				sa.errors = append(sa.errors, fmt.Sprintf("argument %d type %s does not conform to %s", i+1, argType, formalType))
-			}
-		}
+func (sa *SemanticAnalyser) handleDynamicDispatch(dd *ast.DynamicDispatch, st *SymbolTable) string {
+	exprType := sa.getExpressionType(dd.Object, st)
+	if exprType == noType {
+		sa.typeArguments(dd.Arguments, st)
+		return noType
+	}
+
+	receiverType := exprType
+	if receiverType == "SELF_TYPE" {
+		receiverType = sa.currentClass
 	}
 
-	// Return type handling
+	methodEntry, ok := sa.lookupMethod(receiverType, dd.Method.Value)
+	if !ok {
+		sa.errorf(ErrUndefinedMethod, dd.Method.Token, "method %s not defined in type %s", dd.Method.Value, receiverType)
+		sa.typeArguments(dd.Arguments, st)
+		return noType
+	}
+	sa.checkArguments(dd.Method, methodEntry.Method, dd.Arguments, st)
+
 	if methodEntry.Type == "SELF_TYPE" {
-		return staticType
+		return exprType
 	}
 	return methodEntry.Type
 }
 
+// sortClasses orders classes so that every parent precedes its children. The
+// hierarchy must be free of cycles.
+func (sa *SemanticAnalyser) sortClasses(classes []*ast.Class) []*ast.Class {
+	depth := func(className string) int {
+		d := 0
+		for entry, ok := sa.globalSymbolTable.Lookup(className); ok && entry.Parent != ""; entry, ok = sa.globalSymbolTable.Lookup(entry.Parent) {
+			d++
+		}
+		return d
+	}
+
+	sorted := make([]*ast.Class, len(classes))
+	copy(sorted, classes)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return depth(sorted[i].Name.Value) < depth(sorted[j].Name.Value)
+	})
+	return sorted
+}
+
+// lookupMethod finds the method named methodName in className or the nearest
+// ancestor that defines it.
+func (sa *SemanticAnalyser) lookupMethod(className, methodName string) (*SymbolEntry, bool) {
+	visited := map[string]bool{}
+	for className != "" && !visited[className] {
+		visited[className] = true
+		classEntry, ok := sa.globalSymbolTable.Lookup(className)
+		if !ok || classEntry.Scope == nil {
+			return nil, false
+		}
+		if entry, ok := classEntry.Scope.symbols[methodName]; ok && entry.Method != nil {
+			return entry, true
+		}
+		className = classEntry.Parent
+	}
+	return nil, false
+}
+
+// checkArguments checks the arguments of a call to method against its formals.
+func (sa *SemanticAnalyser) checkArguments(name *ast.ObjectIdentifier, method *ast.Method, args []ast.Expression, st *SymbolTable) {
+	if len(args) != len(method.Formals) {
+		sa.errorf(ErrArity, name.Token, "method %s expects %d parameters, got %d", name.Value, len(method.Formals), len(args))
+		sa.typeArguments(args, st)
+		return
+	}
+	for i, arg := range args {
+		argType := sa.getExpressionType(arg, st)
+		formalType := method.Formals[i].Type.Value
+		if !sa.isTypeConformant(argType, formalType) {
+			sa.errorf(ErrTypeMismatch, name.Token, "argument %d of %s: type %s does not conform to %s", i+1, name.Value, argType, formalType)
+		}
+	}
+}
+
+// typeArguments type checks the arguments of a call that could not be resolved.
+func (sa *SemanticAnalyser) typeArguments(args []ast.Expression, st *SymbolTable) {
+	for _, arg := range args {
+		sa.getExpressionType(arg, st)
+	}
+}
+
 func (sa *SemanticAnalyser) getObjectIdentifierType(oi *ast.ObjectIdentifier, st *SymbolTable) string {
 	entry, ok := st.Lookup(oi.Value)
 	if !ok {
-		sa.errors = append(sa.errors, fmt.Sprintf("undefined identifier %s", oi.Value))
-		return "Object"
+		sa.errorf(ErrUndefinedIdentifier, oi.Token, "undefined identifier %s", oi.Value)
+		return noType
 	}
 	return entry.Type
 }
 
-func (sa *SemanticAnalyser) buildClassesSymboltables(program *ast.Program) {
-	fmt.Println("Building class symbol tables...")
-	// Predefine basic classes
-	sa.globalSymbolTable.AddEntry("Object", &SymbolEntry{Type: "Class", Parent: "", Scope: NewSymbolTable(nil)})
-	sa.globalSymbolTable.AddEntry("Int", &SymbolEntry{Type: "Class", Parent: "Object", Scope: NewSymbolTable(sa.globalSymbolTable)})
-	sa.globalSymbolTable.AddEntry("String", &SymbolEntry{Type: "Class", Parent: "Object", Scope: NewSymbolTable(sa.globalSymbolTable)})
-	sa.globalSymbolTable.AddEntry("Bool", &SymbolEntry{Type: "Class", Parent: "Object", Scope: NewSymbolTable(sa.globalSymbolTable)})
-
-	// Initialize scopes for basic classes
-	for _, name := range []string{"Object", "Int", "String", "Bool"} {
-		entry, _ := sa.globalSymbolTable.Lookup(name)
-		entry.Scope = NewSymbolTable(sa.globalSymbolTable)
+// basicMethod is the signature of a method of a basic class.
+type basicMethod struct {
+	name    string
+	formals []string // formal parameter types, in order
+	typ     string
+}
+
+// basicClasses describes the COOL basic classes with the signatures codegen
+// implements for them. Parents are listed before their children.
+var basicClasses = []struct {
+	name    string
+	parent  string
+	methods []basicMethod
+}{
+	{"Object", "", []basicMethod{
+		{"abort", nil, "Object"},
+		{"type_name", nil, "String"},
+		{"copy", nil, "SELF_TYPE"},
+	}},
+	{"IO", "Object", []basicMethod{
+		{"out_string", []string{"String"}, "SELF_TYPE"},
+		{"out_int", []string{"Int"}, "SELF_TYPE"},
+		{"in_string", nil, "String"},
+		{"in_int", nil, "Int"},
+	}},
+	{"Int", "Object", nil},
+	{"String", "Object", []basicMethod{
+		{"length", nil, "Int"},
+		{"concat", []string{"String"}, "String"},
+		{"substr", []string{"Int", "Int"}, "String"},
+	}},
+	{"Bool", "Object", nil},
+}
+
+// noType is the type of an expression whose type could not be determined
+// because of an error already reported. It conforms to every type, so the
+// error does not cascade.
+const noType = "_no_type"
+
+// uninheritableClasses are the basic classes the spec forbids inheriting from.
+var uninheritableClasses = map[string]bool{"Int": true, "String": true, "Bool": true}
+
+// addBasicClasses registers the basic classes and their methods. The methods
+// get synthetic ast.Method nodes so they are checked like user methods.
+func (sa *SemanticAnalyser) addBasicClasses() {
+	for _, class := range basicClasses {
+		scope := NewSymbolTable(sa.globalSymbolTable)
+		for _, m := range class.methods {
+			method := &ast.Method{
+				Name: &ast.ObjectIdentifier{Value: m.name},
+				Type: &ast.TypeIdentifier{Value: m.typ},
+			}
+			methodSt := NewSymbolTable(scope)
+			for i, formalType := range m.formals {
+				formal := &ast.Formal{
+					Name: &ast.ObjectIdentifier{Value: fmt.Sprintf("arg%d", i+1)},
+					Type: &ast.TypeIdentifier{Value: formalType},
+				}
+				method.Formals = append(method.Formals, formal)
+				methodSt.AddEntry(formal.Name.Value, &SymbolEntry{Type: formalType})
+			}
+			scope.AddEntry(m.name, &SymbolEntry{
+				Method: method,
+				Scope:  methodSt,
+				Type:   m.typ,
+			})
+		}
+		sa.globalSymbolTable.AddEntry(class.name, &SymbolEntry{
+			Type:   "Class",
+			Parent: class.parent,
+			Scope:  scope,
+		})
 	}
+}
 
+func (sa *SemanticAnalyser) buildClassesSymboltables(program *ast.Program) {
+	sa.logf("Building class symbol tables...")
+	sa.addBasicClasses()
+
+	// Register every class before resolving parents so that a class may
+	// inherit from one defined later in the file
+	var classes []*ast.Class
 	for _, class := range program.Classes {
-		fmt.Printf("Processing class: %s\n", class.Name.Value)
+		sa.logf("Processing class: %s", class.Name.Value)
 		if _, ok := sa.globalSymbolTable.Lookup(class.Name.Value); ok {
-			sa.errors = append(sa.errors, fmt.Sprintf("class %s redefined", class.Name.Value))
+			sa.errorf(ErrRedefinition, class.Name.Token, "class %s redefined", class.Name.Value)
 			continue
 		}
 
@@ -337,50 +560,66 @@ func (sa *SemanticAnalyser) buildClassesSymboltables(program *ast.Program) {
 			parent = ""
 		}
 
-		// Check if parent exists
-		if parent != "" {
-			if _, ok := sa.globalSymbolTable.Lookup(parent); !ok {
-				sa.errors = append(sa.errors, fmt.Sprintf("class %s is not defined", parent))
-			}
+		sa.globalSymbolTable.AddEntry(class.Name.Value, &SymbolEntry{
+			Type:   "Class",
+			Token:  class.Name.Token,
+			Parent: parent,
+		})
+		classes = append(classes, class)
+	}
+
+	// Check that parents exist
+	for _, class := range classes {
+		if class.Parent == nil {
+			continue
+		}
+		if _, ok := sa.globalSymbolTable.Lookup(class.Parent.Value); !ok {
+			sa.errorf(ErrUndefinedClass, class.Parent.Token, "class %s is not defined", class.Parent.Value)
+		} else if uninheritableClasses[class.Parent.Value] {
+			sa.errorf(ErrBasicInheritance, class.Parent.Token, "class %s cannot inherit from basic class %s",
+				class.Name.Value, class.Parent.Value)
 		}
+	}
 
-		// Check for cyclic inheritance
+	// Check for cyclic inheritance, reporting each cycle once
+	inCycle := map[string]bool{}
+	for _, class := range classes {
 		currentClass := class.Name.Value
-		currentParent := parent
+		if inCycle[currentClass] {
+			continue
+		}
+		path := []string{}
 		visited := map[string]bool{}
-		for currentParent != "" {
-			if currentParent == currentClass {
-				sa.errors = append(sa.errors, "cyclic inheritance detected")
-				break
-			}
-			if visited[currentParent] {
-				break // Prevent infinite loops
-			}
-			visited[currentParent] = true
-			entry, ok := sa.globalSymbolTable.Lookup(currentParent)
+		current := currentClass
+		for current != "" && !visited[current] {
+			visited[current] = true
+			path = append(path, current)
+			entry, ok := sa.globalSymbolTable.Lookup(current)
 			if !ok {
 				break
 			}
-			currentParent = entry.Parent
+			current = entry.Parent
 		}
-
-		sa.globalSymbolTable.AddEntry(class.Name.Value, &SymbolEntry{
-			Type:   "Class",
-			Token:  class.Name.Token,
-			Parent: parent,
-		})
+		if current != currentClass {
+			continue
+		}
+		for _, name := range path {
+			inCycle[name] = true
+		}
+		sa.errorf(ErrCyclicInheritance, class.Name.Token, "cyclic inheritance detected involving class %s", currentClass)
 	}
 }
 
 func (sa *SemanticAnalyser) buildSymboltables(program *ast.Program) {
-	for _, class := range program.Classes {
-		// classEntry, _ := sa.globalSymbolTable.Lookup(class.Name.Value)
+	for _, class := range sa.sortClasses(program.Classes) {
 		classEntry, ok := sa.globalSymbolTable.Lookup(class.Name.Value)
 		if !ok {
 			// Class was not added (e.g., due to redefinition), skip
 			continue
 		}
-		classEntry.Scope = NewSymbolTable(sa.globalSymbolTable)
+		// Inherited attributes are visible through the parent's scope
+		parentEntry, _ := sa.globalSymbolTable.Lookup(classEntry.Parent)
+		classEntry.Scope = NewSymbolTable(parentEntry.Scope)
 
 		// Add attributes and methods
 		for _, feature := range class.Features {
@@ -389,11 +628,15 @@ func (sa *SemanticAnalyser) buildSymboltables(program *ast.Program) {
 				// Check attribute type
 				if f.Type.Value != "SELF_TYPE" {
 					if _, ok := sa.globalSymbolTable.Lookup(f.Type.Value); !ok {
-						sa.errors = append(sa.errors, fmt.Sprintf("undefined type %s", f.Type.Value))
+						sa.errorf(ErrUndefinedClass, f.Type.Token, "undefined type %s", f.Type.Value)
 					}
 				}
-				if _, ok := classEntry.Scope.Lookup(f.Name.Value); ok {
-					sa.errors = append(sa.errors, fmt.Sprintf("attribute %s redefined", f.Name.Value))
+				if _, ok := classEntry.Scope.symbols[f.Name.Value]; ok {
+					sa.errorf(ErrRedefinition, f.Name.Token, "attribute %s redefined", f.Name.Value)
+					continue
+				}
+				if inherited, ok := classEntry.Scope.Lookup(f.Name.Value); ok && inherited.AttrType != nil {
+					sa.errorf(ErrRedefinition, f.Name.Token, "attribute %s is already defined in an inherited class", f.Name.Value)
 					continue
 				}
 				classEntry.Scope.AddEntry(f.Name.Value, &SymbolEntry{
@@ -406,19 +649,19 @@ func (sa *SemanticAnalyser) buildSymboltables(program *ast.Program) {
 				// Check return type
 				if f.Type.Value != "SELF_TYPE" {
 					if _, ok := sa.globalSymbolTable.Lookup(f.Type.Value); !ok {
-						sa.errors = append(sa.errors, fmt.Sprintf("undefined type %s", f.Type.Value))
+						sa.errorf(ErrUndefinedClass, f.Type.Token, "undefined type %s", f.Type.Value)
 					}
 				}
 				// Check formals
 				seenFormals := make(map[string]bool)
 				for _, formal := range f.Formals {
 					if seenFormals[formal.Name.Value] {
-						sa.errors = append(sa.errors, fmt.Sprintf("duplicate parameter %s", formal.Name.Value))
+						sa.errorf(ErrRedefinition, formal.Name.Token, "duplicate parameter %s", formal.Name.Value)
 					}
 					seenFormals[formal.Name.Value] = true
 					// Check formal type
 					if _, ok := sa.globalSymbolTable.Lookup(formal.Type.Value); !ok {
-						sa.errors = append(sa.errors, fmt.Sprintf("undefined type %s", formal.Type.Value))
+						sa.errorf(ErrUndefinedClass, formal.Type.Token, "undefined type %s", formal.Type.Value)
 					}
 				}
 				methodSt := NewSymbolTable(classEntry.Scope)
@@ -443,50 +686,54 @@ func (sa *SemanticAnalyser) buildSymboltables(program *ast.Program) {
 func (sa *SemanticAnalyser) GetNewExpressionType(ne *ast.NewExpression, st *SymbolTable) string {
 	if ne.Type.Value == "SELF_TYPE" {
 		if sa.currentClass == "" {
-			sa.errors = append(sa.errors, "SELF_TYPE used outside class")
+			sa.errorf(ErrUndefinedClass, ne.Type.Token, "SELF_TYPE used outside class")
 			return "Object"
 		}
 		return sa.currentClass
 	}
 
 	if _, ok := sa.globalSymbolTable.Lookup(ne.Type.Value); !ok {
-		sa.errors = append(sa.errors, fmt.Sprintf("undefined type %s", ne.Type.Value))
+		sa.errorf(ErrUndefinedClass, ne.Type.Token, "undefined type %s", ne.Type.Value)
 		return "Object"
 	}
 	return ne.Type.Value
 }
 
 func (sa *SemanticAnalyser) GetAssignmentExpressionType(a *ast.Assignment, st *SymbolTable) string {
-	left, ok := a.Left.(*ast.ObjectIdentifier)
-	if !ok {
-		sa.errors = append(sa.errors, "assignment to non-identifier")
+	valueType := sa.getExpressionType(a.Value, st)
+
+	if self, ok := a.Left.(*ast.Self); ok {
+		sa.errorf(ErrInvalidAssignment, self.Token, "cannot assign to self")
 		return "Object"
 	}
 
-	if left.Value == "self" {
-		sa.errors = append(sa.errors, "cannot assign to self")
+	left, ok := a.Left.(*ast.ObjectIdentifier)
+	if !ok {
+		sa.errorf(ErrInvalidAssignment, a.Token, "assignment to non-identifier")
 		return "Object"
 	}
 
 	entry, exists := st.Lookup(left.Value)
 	if !exists {
-		sa.errors = append(sa.errors, fmt.Sprintf("undefined variable %s", left.Value))
+		sa.errorf(ErrUndefinedIdentifier, left.Token, "undefined variable %s", left.Value)
 		return "Object"
 	}
+	sa.types[left] = entry.Type
 
-	valueType := sa.getExpressionType(a.Value, st)
 	if !sa.isTypeConformant(valueType, entry.Type) {
-		sa.errors = append(sa.errors, fmt.Sprintf("type %s does not conform to %s", valueType, entry.Type))
+		sa.errorf(ErrTypeMismatch, a.Token, "type %s does not conform to %s", valueType, entry.Type)
 	}
 	return valueType
 }
 
 func (sa *SemanticAnalyser) GetCaseExpressionType(ce *ast.CaseExpression, st *SymbolTable) string {
+	sa.getExpressionType(ce.Expr, st)
+
 	var branchTypes []string
 	for _, branch := range ce.Branches {
 		// Check branch type validity
 		if _, ok := sa.globalSymbolTable.Lookup(branch.Type.Value); !ok {
-			sa.errors = append(sa.errors, fmt.Sprintf("undefined type %s", branch.Type.Value))
+			sa.errorf(ErrUndefinedClass, branch.Type.Token, "undefined type %s", branch.Type.Value)
 			continue
 		}
 
@@ -521,6 +768,23 @@ func (sa *SemanticAnalyser) joinTypes(types []string) string {
 }
 
 func (sa *SemanticAnalyser) findCommonAncestor(a, b string) string {
+	if a == noType {
+		return b
+	}
+	if b == noType {
+		return a
+	}
+	// The join of SELF_TYPE with itself stays SELF_TYPE, with any other type
+	// SELF_TYPE stands for the class it occurs in
+	if a == "SELF_TYPE" && b == "SELF_TYPE" {
+		return a
+	}
+	if a == "SELF_TYPE" {
+		a = sa.currentClass
+	}
+	if b == "SELF_TYPE" {
+		b = sa.currentClass
+	}
 	ancestorsA := sa.getAncestors(a)
 	ancestorsB := sa.getAncestors(b)
 
@@ -552,13 +816,15 @@ func (sa *SemanticAnalyser) getAncestors(typ string) []string {
 // ... (Other existing functions like GetLetExpressionType, GetUnaryExpressionType, etc. remain with similar updates)
 
 func (sa *SemanticAnalyser) GetLetExpressionType(le *ast.LetExpression, st *SymbolTable) string {
+	// Each binding is visible in the following ones and in the body only
+	st = NewSymbolTable(st)
 	for _, binding := range le.Bindings {
 		// Check initialization expression type
 		if binding.Init != nil {
 			initType := sa.getExpressionType(binding.Init, st)
 			if !sa.isTypeConformant(initType, binding.Type.Value) {
-				sa.errors = append(sa.errors, fmt.Sprintf("let binding %s: type %s does not conform to %s",
-					binding.Identifier.Value, initType, binding.Type.Value))
+				sa.errorf(ErrTypeMismatch, binding.Identifier.Token, "let binding %s: type %s does not conform to %s",
+					binding.Identifier.Value, initType, binding.Type.Value)
 			}
 		}
 
@@ -578,17 +844,17 @@ func (sa *SemanticAnalyser) GetUnaryExpressionType(ue *ast.UnaryExpression, st *
 
 	switch ue.Operator {
 	case "~":
-		if rightType != "Int" {
-			sa.errors = append(sa.errors, fmt.Sprintf("bitwise negation (~) requires Int, got %s", rightType))
+		if !sa.isTypeConformant(rightType, "Int") {
+			sa.errorf(ErrTypeMismatch, ue.Token, "bitwise negation (~) requires Int, got %s", rightType)
 		}
 		return "Int"
 	case "not":
-		if rightType != "Bool" {
-			sa.errors = append(sa.errors, fmt.Sprintf("logical negation (not) requires Bool, got %s", rightType))
+		if !sa.isTypeConformant(rightType, "Bool") {
+			sa.errorf(ErrTypeMismatch, ue.Token, "logical negation (not) requires Bool, got %s", rightType)
 		}
 		return "Bool"
 	default:
-		sa.errors = append(sa.errors, fmt.Sprintf("unknown unary operator %s", ue.Operator))
+		sa.errorf(ErrUnknownOperator, ue.Token, "unknown unary operator %s", ue.Operator)
 		return "Object"
 	}
 }
@@ -599,25 +865,25 @@ func (sa *SemanticAnalyser) GetBinaryExpressionType(be *ast.BinaryExpression, st
 
 	switch be.Operator {
 	case "+", "-", "*", "/":
-		if leftType != "Int" || rightType != "Int" {
-			sa.errors = append(sa.errors, fmt.Sprintf("arithmetic operator %s requires Int, got %s and %s",
-				be.Operator, leftType, rightType))
+		if !sa.isTypeConformant(leftType, "Int") || !sa.isTypeConformant(rightType, "Int") {
+			sa.errorf(ErrTypeMismatch, be.Token, "arithmetic operation on non-Int types: %s %s %s",
+				leftType, be.Operator, rightType)
 		}
 		return "Int"
 	case "<", "<=":
-		if leftType != "Int" || rightType != "Int" {
-			sa.errors = append(sa.errors, fmt.Sprintf("comparison operator %s requires Int, got %s and %s",
-				be.Operator, leftType, rightType))
+		if !sa.isTypeConformant(leftType, "Int") || !sa.isTypeConformant(rightType, "Int") {
+			sa.errorf(ErrTypeMismatch, be.Token, "comparison operator %s requires Int, got %s and %s",
+				be.Operator, leftType, rightType)
 		}
 		return "Bool"
 	case "=":
 		if !sa.isTypeConformant(leftType, rightType) && !sa.isTypeConformant(rightType, leftType) {
-			sa.errors = append(sa.errors, fmt.Sprintf("equality operator = requires conforming types, got %s and %s",
-				leftType, rightType))
+			sa.errorf(ErrTypeMismatch, be.Token, "equality operator = requires conforming types, got %s and %s",
+				leftType, rightType)
 		}
 		return "Bool"
 	default:
-		sa.errors = append(sa.errors, fmt.Sprintf("unknown binary operator %s", be.Operator))
+		sa.errorf(ErrUnknownOperator, be.Token, "unknown binary operator %s", be.Operator)
 		return "Object"
 	}
 }
@@ -632,8 +898,8 @@ func (sa *SemanticAnalyser) getBlockExpressionType(be *ast.BlockExpression, st *
 
 func (sa *SemanticAnalyser) getIfExpressionType(ie *ast.IfExpression, st *SymbolTable) string {
 	condType := sa.getExpressionType(ie.Condition, st)
-	if condType != "Bool" {
-		sa.errors = append(sa.errors, fmt.Sprintf("if condition must be Bool, got %s", condType))
+	if !sa.isTypeConformant(condType, "Bool") {
+		sa.errorf(ErrTypeMismatch, ie.Token, "if condition must be Bool, got %s", condType)
 	}
 
 	thenType := sa.getExpressionType(ie.Consequence, st)
@@ -644,9 +910,10 @@ func (sa *SemanticAnalyser) getIfExpressionType(ie *ast.IfExpression, st *Symbol
 
 func (sa *SemanticAnalyser) getWhileExpressionType(we *ast.WhileExpression, st *SymbolTable) string {
 	condType := sa.getExpressionType(we.Condition, st)
-	if condType != "Bool" {
-		sa.errors = append(sa.errors, fmt.Sprintf("while condition must be Bool, got %s", condType))
+	if !sa.isTypeConformant(condType, "Bool") {
+		sa.errorf(ErrTypeMismatch, we.Token, "while condition must be Bool, got %s", condType)
 	}
+	sa.getExpressionType(we.Body, st)
 
 	// While expressions always return Object (void)
 	return "Object"
@@ -56,6 +56,13 @@ func TestSemanticAnalysis(t *testing.T) {
 			`,
 			expected: []string{"cyclic inheritance detected"},
 		},
+		{
+			name: "Missing Main Class",
+			program: `
+				class A {};
+			`,
+			expected: []string{"Main class not defined"},
+		},
 		{
 			name: "Main Class Requirements",
 			program: `
@@ -72,6 +79,7 @@ func TestSemanticAnalysis(t *testing.T) {
 					a : Int;
 					a : String;  -- Redefinition
 				};
+				class Main { main() : Object { 0 }; };
 			`,
 			expected: []string{"attribute a redefined"},
 		},
@@ -80,6 +88,7 @@ func TestSemanticAnalysis(t *testing.T) {
 			program: `
 				class A { m() : Int { 0 } };
 				class B inherits A { m() : Int { 1 } };  -- Valid override
+				class Main { main() : Object { 0 }; };
 			`,
 			expected: []string{},
 		},
@@ -88,6 +97,7 @@ func TestSemanticAnalysis(t *testing.T) {
 			program: `
 				class A { m() : Int { 0 } };
 				class B inherits A { m() : String { "0" } };
+				class Main { main() : Object { 0 }; };
 			`,
 			expected: []string{"method m has incompatible return type"},
 		},
@@ -100,6 +110,7 @@ func TestSemanticAnalysis(t *testing.T) {
 						new B  -- B conforms to A
 					};
 				};
+				class Main { main() : Object { 0 }; };
 			`,
 			expected: []string{},
 		},
@@ -115,8 +126,8 @@ func TestSemanticAnalysis(t *testing.T) {
 					};
 				};
 			`,
-			expected: []string{"case expression type join: Object"},
-			notes:    "TODO: Implement type join calculation",
+			expected: []string{},
+			notes:    "The join is recorded in the type table, see TestTypeTable",
 		},
 		{
 			name: "SELF_TYPE Handling",
@@ -124,6 +135,7 @@ func TestSemanticAnalysis(t *testing.T) {
 				class A {
 					copy() : SELF_TYPE { self };
 				};
+				class Main { main() : Object { 0 }; };
 			`,
 			expected: []string{},
 		},
@@ -149,6 +161,7 @@ func TestSemanticAnalysis(t *testing.T) {
 						(new A)@B.m()  -- Invalid static dispatch
 					};
 				};
+				class Main { main() : Object { 0 }; };
 			`,
 			expected: []string{"type A does not conform to B"},
 		},
@@ -169,6 +182,7 @@ func TestSemanticAnalysis(t *testing.T) {
 				class A {
 					x : B;  -- B is undefined, defaults to Object
 				};
+				class Main { main() : Object { 0 }; };
 			`,
 			expected: []string{"undefined type B"},
 		},
@@ -178,6 +192,7 @@ func TestSemanticAnalysis(t *testing.T) {
 				class A {
 					m(x : Int, x : String) : Int { 0 };  -- Duplicate parameter
 				};
+				class Main { main() : Object { 0 }; };
 			`,
 			expected: []string{"duplicate parameter x"},
 		},
@@ -189,6 +204,7 @@ func TestSemanticAnalysis(t *testing.T) {
 						self <- new A  -- Invalid self assignment
 					};
 				};
+				class Main { main() : Object { 0 }; };
 			`,
 			expected: []string{"cannot assign to self"},
 		},
@@ -203,6 +219,105 @@ func TestSemanticAnalysis(t *testing.T) {
 			`,
 			expected: []string{"undefined type UndefinedType"},
 		},
+		{
+			name: "Inheritance from Basic Class",
+			program: `
+				class A inherits Int {};
+				class B inherits IO {};
+			`,
+			expected: []string{"class A cannot inherit from basic class Int"},
+		},
+		{
+			name: "Basic Class Redefinition",
+			program: `
+				class IO {};
+			`,
+			expected: []string{"class IO redefined"},
+		},
+		{
+			name: "Invalid Basic Method Override",
+			program: `
+				class A inherits IO {
+					out_int(x : Int) : Int { x };
+				};
+				class Main { main() : Object { 0 }; };
+			`,
+			expected: []string{"method out_int has incompatible return type"},
+		},
+		{
+			name: "Inherited Attribute Redefinition",
+			program: `
+				class A { x : Int; };
+				class B inherits A { x : Int; };
+				class Main { main() : Object { 0 }; };
+			`,
+			expected: []string{"attribute x is already defined in an inherited class"},
+		},
+		{
+			name: "Let Binding Scope",
+			program: `
+				class A {
+					x : Int <- let y : Int <- 1 in y;
+					z : Int <- y;
+				};
+				class Main { main() : Object { 0 }; };
+			`,
+			expected: []string{"undefined identifier y"},
+		},
+		{
+			name: "Let Binding Scope In Block",
+			program: `
+				class A {
+					f() : Int { { let y : Int <- 1 in y; y; } };
+				};
+				class Main { main() : Object { 0 }; };
+			`,
+			expected: []string{"undefined identifier y"},
+		},
+		{
+			name: "Dispatch to Undefined Method",
+			program: `
+				class Main {
+					main() : Object {
+						(new Main).foo(1 + "a")
+					};
+				};
+			`,
+			expected: []string{"method foo not defined in type Main", "arithmetic operation on non-Int types"},
+		},
+		{
+			name: "Dispatch Arity",
+			program: `
+				class Main inherits IO {
+					main() : Object {
+						out_string("a", "b")
+					};
+				};
+			`,
+			expected: []string{"method out_string expects 1 parameters, got 2"},
+		},
+		{
+			name: "Dispatch Argument Type",
+			program: `
+				class Main {
+					main() : Object {
+						(new IO).out_int("a")
+					};
+				};
+			`,
+			expected: []string{"argument 1 of out_int: type String does not conform to Int"},
+		},
+		{
+			name: "Dispatch Return Type",
+			program: `
+				class Main {
+					main() : Object {
+						let s : String <- "abc".length() in s
+					};
+				};
+			`,
+			expected: []string{"let binding s: type Int does not conform to String"},
+		},
 	}
 
 	for _, tt := range tests {
@@ -238,7 +353,7 @@ func TestSemanticAnalysis(t *testing.T) {
 			}
 
 			for i, expectedErr := range tt.expected {
-				if !strings.Contains(sa.errors[i], expectedErr) {
+				if !strings.Contains(sa.errors[i].Error(), expectedErr) {
 					t.Errorf("Error %d:\nExpected: %s\nGot: %s", i, expectedErr, sa.errors[i])
 				}
 			}
@@ -282,6 +397,35 @@ func TestPositiveCases(t *testing.T) {
 				class A {};
 				class B inherits A {};
 				class C inherits B {};
+				class Main { main() : Object { 0 }; };
+			`,
+		},
+		{
+			name: "Dispatch Through Ancestors",
+			program: `
+				class A { f(x : Int) : Int { x }; };
+				class B inherits A {};
+				class Main inherits IO {
+					main() : Object {
+						let m : Main <- out_string("hi"),
+							n : Int <- (new B).f(1) + (new B)@A.f(2)
+						in m.out_int(n).abort()
+					};
+				};
+			`,
+		},
+		{
+			name: "Inherited Attributes in Initializers",
+			program: `
+				class B inherits A {
+					z : Int <- x + y;
+					m() : Int { x + y + z };
+				};
+				class A {
+					x : Int <- y;
+					y : Int <- 2;
+				};
+				class Main { main() : Object { 0 }; };
 			`,
 		},
 		{
@@ -293,6 +437,17 @@ func TestPositiveCases(t *testing.T) {
 				class B inherits A {
 					copy() : SELF_TYPE { self };
 				};
+				class Main { main() : Object { 0 }; };
+			`,
+		},
+		{
+			name: "Join with SELF_TYPE",
+			program: `
+				class Main {
+					main() : Object { 0 };
+					other(c : Bool) : Main { if c then self else new Main fi };
+					same(c : Bool) : SELF_TYPE { if c then self else copy() fi };
+				};
 			`,
 		},
 	}
@@ -320,3 +475,153 @@ func TestPositiveCases(t *testing.T) {
 		})
 	}
 }
+
+func TestErrorPositions(t *testing.T) {
+	program := parseProgram(`class Main {
+	main() : Object { 1 + "a" };
+};
+`)
+
+	sa := NewSemanticAnalyser()
+	sa.SetFilename("main.cl")
+	sa.Analyze(program)
+
+	if len(sa.Errors()) != 1 {
+		t.Fatalf("Expected 1 error, got %d", len(sa.Errors()))
+	}
+	err := sa.Errors()[0]
+	if err.File != "main.cl" || err.Line != 2 || err.Column != 22 {
+		t.Errorf("Expected error at main.cl:2:22, got %s:%d:%d", err.File, err.Line, err.Column)
+	}
+	if !strings.HasPrefix(err.Error(), "main.cl:2:22: ") {
+		t.Errorf("Unexpected error string %q", err.Error())
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	tests := []struct {
+		program string
+		code    ErrorCode
+	}{
+		{`class Main { main() : Object { 1 + "a" }; };`, ErrTypeMismatch},
+		{`class Main { main() : Object { new B }; };`, ErrUndefinedClass},
+		{`class Main { main() : Object { x }; };`, ErrUndefinedIdentifier},
+		{`class Main { main() : Object { main(1) }; };`, ErrArity},
+		{`class Main { main() : Object { f() }; };`, ErrUndefinedMethod},
+		{`class Main { x : Int; x : Int; main() : Object { 0 }; };`, ErrRedefinition},
+		{`class Main inherits Int { main() : Object { 0 }; };`, ErrBasicInheritance},
+		{`class Main {};`, ErrMissingMain},
+		{`class Main { main() : Object { self <- new Main }; };`, ErrInvalidAssignment},
+	}
+
+	for _, tt := range tests {
+		sa := NewSemanticAnalyser()
+		sa.Analyze(parseProgram(tt.program))
+		if len(sa.Errors()) == 0 || sa.Errors()[0].Code != string(tt.code) {
+			t.Errorf("%s: expected a %s error, got %v", tt.program, tt.code, sa.Errors())
+		}
+	}
+}
+
+func TestLibraryWithoutMain(t *testing.T) {
+	program := parseProgram(`class A { f() : Int { 0 }; };`)
+
+	sa := NewSemanticAnalyser()
+	sa.SetLibrary(true)
+	sa.Analyze(program)
+
+	if len(sa.Errors()) != 0 {
+		t.Errorf("Expected no errors for a library without Main, got %v", sa.Errors())
+	}
+}
+
+func TestExternalClasses(t *testing.T) {
+	program := parseProgram(`
+class A { f() : Int { "not checked" }; };
+class B inherits A { f() : String { "checked" }; };
+class Main { main() : Object { 0 }; };
+`)
+	program.Classes[0].External = true
+
+	sa := NewSemanticAnalyser()
+	sa.Analyze(program)
+
+	// Only the signatures of an external class are used
+	if len(sa.Errors()) != 1 || sa.Errors()[0].Message != "method f has incompatible return type" {
+		t.Errorf("Expected only the override error, got %v", sa.Errors())
+	}
+}
+
+func TestTypeTable(t *testing.T) {
+	program := parseProgram(`
+		class A {};
+		class B inherits A {};
+		class Main {
+			main() : Object {
+				case 42 of
+					x : Int => "string";
+					y : Bool => true;
+				esac
+			};
+			pick(b : Bool) : A {
+				if b then new B else new A fi
+			};
+			me() : SELF_TYPE { self.copy() };
+		};
+	`)
+
+	sa := NewSemanticAnalyser()
+	sa.Analyze(program)
+	if len(sa.Errors()) > 0 {
+		t.Fatalf("Unexpected errors: %v", sa.Errors())
+	}
+
+	methods := map[string]*ast.Method{}
+	for _, feature := range program.Classes[2].Features {
+		if m, ok := feature.(*ast.Method); ok {
+			methods[m.Name.Value] = m
+		}
+	}
+
+	tests := []struct {
+		expr     ast.Expression
+		expected string
+	}{
+		{methods["main"].Body, "Object"},
+		{methods["main"].Body.(*ast.CaseExpression).Expr, "Int"},
+		{methods["pick"].Body, "A"},
+		{methods["pick"].Body.(*ast.IfExpression).Consequence, "B"},
+		{methods["me"].Body, "SELF_TYPE"},
+	}
+	for _, tt := range tests {
+		if got := sa.Types()[tt.expr]; got != tt.expected {
+			t.Errorf("Expected type %s for %T, got %q", tt.expected, tt.expr, got)
+		}
+	}
+}
+
+func TestSerializeTypedProgram(t *testing.T) {
+	program := parseProgram(`
+		class Main inherits IO {
+			x : Int;
+			main() : Object { x <- let y : Int <- 2 in y + 1 };
+			test() : Bool { isvoid out_int(x) };
+		};
+	`)
+
+	sa := NewSemanticAnalyser()
+	sa.Analyze(program)
+	if len(sa.Errors()) > 0 {
+		t.Fatalf("Unexpected errors: %v", sa.Errors())
+	}
+
+	expected := `class Main inherits IO {
+    x : Int;
+    main() : Object { (x[Int] <- (let y : Int <- 2[Int] in (y[Int] + 1[Int])[Int])[Int])[Int] };
+    test() : Bool { (isvoid self[SELF_TYPE].out_int(x[Int])[SELF_TYPE])[Bool] };
+};
+`
+	if got := parser.SerializeTypedProgram(program, sa.Types()); got != expected {
+		t.Errorf("wrong typed serialization.\nexpected:\n%s\ngot:\n%s", expected, got)
+	}
+}
@@ -0,0 +1,43 @@
+(*
+ * A singly linked list of objects. The empty list is a plain List; every
+ * non-empty list is a Cons cell:
+ *
+ *     let l : List <- (new List).cons(3).cons(2).cons(1) in ...
+ *
+ * head() and tail() abort on the empty list.
+ *)
+class List {
+    isNil() : Bool { true };
+
+    head() : Object { { abort(); new Object; } };
+
+    tail() : List { { abort(); self; } };
+
+    length() : Int { 0 };
+
+    cons(x : Object) : List { (new Cons).init(x, self) };
+
+    -- reverse() returns a new list with the elements in the opposite order.
+    reverse() : List { self };
+
+    reverseOnto(acc : List) : List { acc };
+};
+
+class Cons inherits List {
+    car : Object;
+    cdr : List;
+
+    isNil() : Bool { false };
+
+    head() : Object { car };
+
+    tail() : List { cdr };
+
+    length() : Int { 1 + cdr.length() };
+
+    init(x : Object, rest : List) : List { { car <- x; cdr <- rest; self; } };
+
+    reverse() : List { reverseOnto(new List) };
+
+    reverseOnto(acc : List) : List { cdr.reverseOnto(acc.cons(car)) };
+};
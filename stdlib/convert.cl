@@ -0,0 +1,62 @@
+(*
+ * Conversions between Int and String:
+ *
+ *     (new Convert).a2i("-42")   -- -42
+ *     (new Convert).i2a(17)      -- "17"
+ *
+ * a2i stops at the first character that is not a digit.
+ *)
+class Convert {
+    digit(c : String) : Int {
+        if c = "0" then 0 else
+        if c = "1" then 1 else
+        if c = "2" then 2 else
+        if c = "3" then 3 else
+        if c = "4" then 4 else
+        if c = "5" then 5 else
+        if c = "6" then 6 else
+        if c = "7" then 7 else
+        if c = "8" then 8 else
+        if c = "9" then 9 else
+        0 - 1
+        fi fi fi fi fi fi fi fi fi fi
+    };
+
+    char(d : Int) : String { "0123456789".substr(d, 1) };
+
+    a2i(s : String) : Int {
+        if s.length() = 0 then 0 else
+        if s.substr(0, 1) = "-" then 0 - a2iDigits(s.substr(1, s.length() - 1)) else
+        if s.substr(0, 1) = "+" then a2iDigits(s.substr(1, s.length() - 1)) else
+        a2iDigits(s)
+        fi fi fi
+    };
+
+    a2iDigits(s : String) : Int {
+        let n : Int <- 0, i : Int <- 0, d : Int <- 0, done : Bool <- false in {
+            while (not done) loop
+                if i = s.length() then done <- true else {
+                    d <- digit(s.substr(i, 1));
+                    if d < 0 then done <- true else {
+                        n <- n * 10 + d;
+                        i <- i + 1;
+                    } fi;
+                } fi
+            pool;
+            n;
+        }
+    };
+
+    i2a(i : Int) : String {
+        if i = 0 then "0" else
+        if 0 < i then i2aDigits(i) else
+        "-".concat(i2aDigits(0 - i))
+        fi fi
+    };
+
+    i2aDigits(i : Int) : String {
+        if i = 0 then "" else
+        let q : Int <- i / 10 in i2aDigits(q).concat(char(i - q * 10))
+        fi
+    };
+};
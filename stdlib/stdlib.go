@@ -0,0 +1,12 @@
+// Package stdlib bundles the COOL standard library into the compiler. Its
+// modules are imported like any other, e.g. import collections.list;, and
+// are searched after the importing file's directory and the include paths.
+package stdlib
+
+import "embed"
+
+// FS holds the library sources, laid out as their import names map to
+// paths: collections.list is collections/list.cl.
+//
+//go:embed *.cl collections/*.cl
+var FS embed.FS